@@ -2,17 +2,98 @@ package authenticators
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
 	"github.com/Invicton-Labs/gorm-auth/dialectors"
-	"github.com/go-sql-driver/mysql"
 )
 
+// Credentials is an engine-neutral description of the values required
+// to authenticate a new database connection. Each database engine has
+// an adapter that maps these values onto its own driver configuration.
+type Credentials struct {
+	// The host to connect to. If empty, the host in the
+	// driver configuration is left unchanged.
+	Host string
+	// The port to connect to. If zero, the port in the
+	// driver configuration is left unchanged.
+	Port int
+	// The username to connect with
+	Username string
+	// The secret (password, token, etc.) to authenticate with. It's
+	// never included when the credentials are formatted or encoded.
+	Secret string `json:"-"`
+	// The name of the database to connect to. If empty, the
+	// database in the driver configuration is left unchanged.
+	Database string
+	// Whether the connection must be made over TLS
+	RequireTls bool
+	// Whether the secret must be sent to the server in clear text
+	// (e.g. for tokens that the server validates itself). This
+	// should only ever be used in combination with RequireTls.
+	RequireCleartextPassword bool
+	// OPTIONAL: A hint for when these credentials expire. A zero
+	// value means that they don't expire (or that it's unknown).
+	ExpiresAt time.Time
+	// OPTIONAL: A hint for the version of these credentials, which
+	// can be used to detect when they have been rotated.
+	Version string
+}
+
+// String formats the credentials with the secret redacted,
+// so that they can't be logged accidentally.
+func (c Credentials) String() string {
+	return fmt.Sprintf("{Host:%s Port:%d Username:%s Secret:[REDACTED] Database:%s RequireTls:%t RequireCleartextPassword:%t ExpiresAt:%s Version:%s}", c.Host, c.Port, c.Username, c.Database, c.RequireTls, c.RequireCleartextPassword, c.ExpiresAt, c.Version)
+}
+
+// GoString formats the credentials with the secret redacted.
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// getCredentials gets the credentials for a new connection from the given
+// authentication settings, and reports them to the connector. Only the
+// authenticator itself is timed for the connector's metrics.
+func getCredentials(ctx context.Context, authSettings AuthenticationSettings) (*Credentials, stackerr.Error) {
+	start := time.Now()
+	creds, err := authSettings.GetConnectionCredentials(ctx)
+	connectors.RecordCredentialFetch(ctx, time.Since(start), err == nil)
+	if err != nil {
+		return nil, err
+	}
+	connectors.RecordCredentialVersion(ctx, creds.Version)
+	reportCredentials(ctx, creds)
+	return creds, nil
+}
+
+// reportCredentials logs that credentials are being applied to a
+// connection, and runs the connector's OnCredentialFetched hook.
+// The secret is never included.
+func reportCredentials(ctx context.Context, creds *Credentials) {
+	connectors.LoggerFromContext(ctx).DebugContext(ctx, "applying credentials",
+		"host", creds.Host,
+		"port", creds.Port,
+		"username", creds.Username,
+		"credential_version", creds.Version,
+		"expires_at", creds.ExpiresAt,
+	)
+	connectors.NotifyCredentialFetched(ctx, connectors.CredentialFetchedEvent{
+		Host:      creds.Host,
+		Port:      creds.Port,
+		Username:  creds.Username,
+		Database:  creds.Database,
+		Version:   creds.Version,
+		ExpiresAt: creds.ExpiresAt,
+	})
+}
+
 type AuthenticationSettings interface {
-	// UpdateConfigWithAuth adds authentication parameters
-	// to an existing mysql.Config struct.
-	UpdateConfigWithAuth(ctx context.Context, config mysql.Config) (*mysql.Config, stackerr.Error)
+	// GetConnectionCredentials gets the credentials that should
+	// be used for the next connection.
+	GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error)
 	// UpdateDialectorSettings updates the dialector settings with
 	// override values required by this authentication method
-	UpdateDialectorSettings(dialectors.MysqlDialectorInput) (dialectors.MysqlDialectorInput, stackerr.Error)
+	UpdateDialectorSettings(dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error)
 }
@@ -0,0 +1,46 @@
+package authenticators
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsNeverIncludeTheSecret(t *testing.T) {
+	creds := Credentials{
+		Host:     "db.example.com",
+		Port:     5432,
+		Username: "app",
+		Secret:   "super-secret",
+		Version:  "v1",
+	}
+	encoded, err := json.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, formatted := range map[string]string{
+		"String":   creds.String(),
+		"%v":       fmt.Sprintf("%v", creds),
+		"%+v":      fmt.Sprintf("%+v", &creds),
+		"%#v":      fmt.Sprintf("%#v", creds),
+		"JSON":     string(encoded),
+		"JSON ptr": string(mustMarshal(t, &creds)),
+	} {
+		if strings.Contains(formatted, creds.Secret) {
+			t.Errorf("expected %s to redact the secret, got %s", name, formatted)
+		}
+		if !strings.Contains(formatted, creds.Username) {
+			t.Errorf("expected %s to include the username, got %s", name, formatted)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
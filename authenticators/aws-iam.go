@@ -3,22 +3,27 @@ package authenticators
 import (
 	"context"
 	"fmt"
-	"regexp"
+	"sync"
+	"time"
 
 	"github.com/Invicton-Labs/go-stackerr"
+	gormauthaws "github.com/Invicton-Labs/gorm-auth/aws"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
 	"github.com/Invicton-Labs/gorm-auth/dialectors"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
-	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var (
-	rdsHostRegionRegexp       *regexp.Regexp = regexp.MustCompile(`^[^.]+\.[^.]+\.([a-z]+-[a-z]+-[0-9]+)\.rds\.amazonaws\.com$`)
-	rdsHostRegionRegexpReader *regexp.Regexp = regexp.MustCompile(`^reader\.endpoint\.proxy-[^.]+\.([a-z]+-[a-z]+-[0-9]+)\.rds\.amazonaws\.com$`)
+const (
+	// The duration for which an RDS IAM authentication token is valid
+	rdsAuthTokenLifetime time.Duration = 15 * time.Minute
 )
 
-type MysqlConnectionParametersAwsIam struct {
+// ConnectionParametersAwsIam authenticates connections to AWS RDS
+// databases (MySQL or PostgreSQL) using IAM authentication tokens.
+type ConnectionParametersAwsIam struct {
 	// The host of the primary cluster
 	Host string `json:"host"`
 	// The port to connect to the primary cluster
@@ -34,27 +39,49 @@ type MysqlConnectionParametersAwsIam struct {
 	Region string `json:"region"`
 	// The AWS config to use for authentication/credentials
 	AwsCredentials aws.CredentialsProvider
+	// OPTIONAL: How long before a cached token expires that it stops
+	// being used for new connections. Defaults to 5 minutes, and is
+	// capped at half of each token's lifetime. Once a token is halfway
+	// through its usable lifetime, a replacement is generated in the
+	// background.
+	TokenExpiryMargin time.Duration
+	// OPTIONAL: If true, tokens will not be cached, and a new token
+	// will be generated for every new connection.
+	DisableTokenCache bool
+
+	settingsLock sync.Mutex
+	tokenCache   tokenCache
+}
+
+// MysqlConnectionParametersAwsIam is an alias of ConnectionParametersAwsIam,
+// for use with MySQL databases.
+type MysqlConnectionParametersAwsIam = ConnectionParametersAwsIam
+
+// PostgresConnectionParametersAwsIam is an alias of ConnectionParametersAwsIam,
+// for use with PostgreSQL databases.
+type PostgresConnectionParametersAwsIam = ConnectionParametersAwsIam
+
+func (params *ConnectionParametersAwsIam) getTokenExpiryMargin() time.Duration {
+	return tokenExpiryMarginOrDefault(params.TokenExpiryMargin)
 }
 
-func (params *MysqlConnectionParametersAwsIam) UpdateDialectorSettings(dialectorInput dialectors.MysqlDialectorInput) (dialectors.MysqlDialectorInput, stackerr.Error) {
-	// IAM auth rotates tokens frequently, so a new token should be used each time
-	dialectorInput.ShouldReconfigureCallback = nil
-	return dialectorInput, nil
+func (params *ConnectionParametersAwsIam) UpdateDialectorSettings(dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
+	// IAM auth rotates tokens frequently, so connectors are reconfigured
+	// whenever the cached token is replaced
+	return params.tokenCache.updateDialectorSettings(dialectorInput, params.DisableTokenCache, params.getTokenExpiryMargin, params.buildAuthToken), nil
 }
 
-func (params *MysqlConnectionParametersAwsIam) UpdateConfigWithAuth(ctx context.Context, config mysql.Config) (*mysql.Config, stackerr.Error) {
+// buildAuthToken generates a new IAM authentication token.
+func (params *ConnectionParametersAwsIam) buildAuthToken(ctx context.Context) (string, time.Time, stackerr.Error) {
+	params.settingsLock.Lock()
+	defer params.settingsLock.Unlock()
+
 	if params.Region == "" {
 		// If no region was specified, try to extract it from the hostname
-		regionMatches := rdsHostRegionRegexp.FindStringSubmatch(params.Host)
-		if len(regionMatches) == 0 {
-			regionMatches = rdsHostRegionRegexpReader.FindStringSubmatch(params.Host)
-		}
-		if len(regionMatches) > 1 {
-			params.Region = regionMatches[1]
-		}
+		params.Region = gormauthaws.GetRdsRegion(params.Host)
 	}
 	if params.Region == "" {
-		return &config, stackerr.Errorf("no database region was provided, and it could not be determined from the host name (%s)", params.Host)
+		return "", time.Time{}, stackerr.Errorf("no database region was provided, and it could not be determined from the host name (%s)", params.Host)
 	}
 
 	// If no credential source is provided, use the default AWS config
@@ -62,32 +89,53 @@ func (params *MysqlConnectionParametersAwsIam) UpdateConfigWithAuth(ctx context.
 	if params.AwsCredentials == nil {
 		defaultAwsConfig, err := awsconfig.LoadDefaultConfig(ctx)
 		if err != nil {
-			return nil, stackerr.Wrap(err)
+			return "", time.Time{}, stackerr.Wrap(err)
 		}
 		params.AwsCredentials = defaultAwsConfig.Credentials
 	}
 
 	addr := fmt.Sprintf("%s:%d", params.Host, params.Port)
+	spanCtx, span := connectors.StartSpan(ctx, "gormauth.aws.BuildAuthToken", attribute.String("endpoint", addr), attribute.String("region", params.Region))
+	signingTime := time.Now()
 	authenticationToken, err := auth.BuildAuthToken(
-		ctx,
+		spanCtx,
 		addr,
 		params.Region,
 		params.Username,
 		params.AwsCredentials,
 	)
+	connectors.EndSpan(span, err)
 	if err != nil {
-		return nil, stackerr.Wrap(err)
+		return "", time.Time{}, stackerr.Wrap(err)
 	}
 
-	config.User = params.Username
-	config.Passwd = authenticationToken
-	config.Addr = addr
-	config.DBName = params.Schema
+	// Tokens are valid for 15 minutes
+	return authenticationToken, signingTime.Add(rdsAuthTokenLifetime), nil
+}
+
+func (params *ConnectionParametersAwsIam) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
+	creds := &Credentials{
+		Host:     params.Host,
+		Port:     params.Port,
+		Database: params.Schema,
+		Username: params.Username,
+		// IAM requires TLS
+		RequireTls: true,
+		// IAM requires clear text authentication, since
+		// the token is validated by the server itself
+		RequireCleartextPassword: true,
+	}
 
-	// IAM requires clear text authentication
-	config.AllowCleartextPasswords = true
-	// IAM requires native password authentication
-	config.AllowNativePasswords = true
+	return params.tokenCache.applyToken(ctx, creds, params.DisableTokenCache, params.getTokenExpiryMargin(), params.buildAuthToken)
+}
 
-	return &config, nil
+// WrapPostgresConfigCallback wraps a connectors.GetPostgresConfigCallback so that
+// each new PostgreSQL connection uses a fresh IAM authentication token as
+// its password. TLS is always enabled, and if the config does not already
+// specify which root CAs to trust, the AWS root CAs are used. If the
+// callback is nil, a default config with full TLS verification is used.
+func (params *ConnectionParametersAwsIam) WrapPostgresConfigCallback(callback connectors.GetPostgresConfigCallback) connectors.GetPostgresConfigCallback {
+	// RDS certificates are signed by the AWS root CAs, which
+	// aren't necessarily in the system's trusted pool
+	return postgresConfigCallbackWithAuthAndRootCas(params, callback, gormauthaws.GetTlsConfig)
 }
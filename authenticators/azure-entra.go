@@ -0,0 +1,100 @@
+package authenticators
+
+import (
+	"context"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	gormauthazure "github.com/Invicton-Labs/gorm-auth/azure"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+)
+
+// ConnectionParametersAzureEntra authenticates connections to Azure Database
+// for MySQL or PostgreSQL flexible servers using Entra ID (formerly Azure AD)
+// access tokens as passwords.
+type ConnectionParametersAzureEntra struct {
+	// The host of the server
+	Host string `json:"host"`
+	// The port to connect to the server
+	Port int `json:"port"`
+	// The name of the database to connect to
+	Schema string `json:"database"`
+	// The name of the Entra ID user, group or managed identity
+	// that the token is for, as it was created in the database
+	Username string `json:"username"`
+	// The source of access tokens (e.g. managed identity,
+	// client secret or workload identity)
+	TokenSource gormauthazure.TokenSource
+	// OPTIONAL: The scope to request tokens for. Defaults to
+	// gormauthazure.DefaultDatabaseScope (the Azure public cloud).
+	Scope string `json:"scope"`
+	// OPTIONAL: How long before a cached token expires that it stops
+	// being used for new connections. Defaults to 5 minutes, and is
+	// capped at half of each token's lifetime. Once a token is halfway
+	// through its usable lifetime, a replacement is fetched in the
+	// background.
+	TokenExpiryMargin time.Duration
+	// OPTIONAL: If true, tokens will not be cached, and a new token
+	// will be fetched for every new connection.
+	DisableTokenCache bool
+
+	tokenCache tokenCache
+}
+
+// MysqlConnectionParametersAzureEntra is an alias of ConnectionParametersAzureEntra,
+// for use with MySQL databases.
+type MysqlConnectionParametersAzureEntra = ConnectionParametersAzureEntra
+
+// PostgresConnectionParametersAzureEntra is an alias of ConnectionParametersAzureEntra,
+// for use with PostgreSQL databases.
+type PostgresConnectionParametersAzureEntra = ConnectionParametersAzureEntra
+
+func (params *ConnectionParametersAzureEntra) getTokenExpiryMargin() time.Duration {
+	return tokenExpiryMarginOrDefault(params.TokenExpiryMargin)
+}
+
+func (params *ConnectionParametersAzureEntra) UpdateDialectorSettings(dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
+	return params.tokenCache.updateDialectorSettings(dialectorInput, params.DisableTokenCache, params.getTokenExpiryMargin, params.fetchToken), nil
+}
+
+// fetchToken gets a new access token from the token source.
+func (params *ConnectionParametersAzureEntra) fetchToken(ctx context.Context) (string, time.Time, stackerr.Error) {
+	if params.TokenSource == nil {
+		return "", time.Time{}, stackerr.Errorf("no Entra ID token source was provided")
+	}
+	scope := params.Scope
+	if scope == "" {
+		scope = gormauthazure.DefaultDatabaseScope
+	}
+	token, err := params.TokenSource.GetToken(ctx, scope)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.Token, token.ExpiresAt, nil
+}
+
+func (params *ConnectionParametersAzureEntra) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
+	creds := &Credentials{
+		Host:     params.Host,
+		Port:     params.Port,
+		Database: params.Schema,
+		Username: params.Username,
+		// Azure requires TLS for token authentication
+		RequireTls: true,
+		// Tokens are sent as clear text passwords, since
+		// they're validated by the server itself
+		RequireCleartextPassword: true,
+	}
+
+	return params.tokenCache.applyToken(ctx, creds, params.DisableTokenCache, params.getTokenExpiryMargin(), params.fetchToken)
+}
+
+// WrapPostgresConfigCallback wraps a connectors.GetPostgresConfigCallback so that
+// each new PostgreSQL connection uses an Entra ID access token as its password.
+// TLS is always enabled, and if the config does not already specify which root
+// CAs to trust, the Azure Database root CAs are used. If the callback is nil, a
+// default config with full TLS verification is used.
+func (params *ConnectionParametersAzureEntra) WrapPostgresConfigCallback(callback connectors.GetPostgresConfigCallback) connectors.GetPostgresConfigCallback {
+	return postgresConfigCallbackWithAuthAndRootCas(params, callback, gormauthazure.GetTlsConfig)
+}
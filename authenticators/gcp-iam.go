@@ -0,0 +1,180 @@
+package authenticators
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// The OAuth2 scope that is required for Cloud SQL IAM database authentication
+	cloudSqlLoginScope string = "https://www.googleapis.com/auth/sqlservice.login"
+	// The lifetime to assume for access tokens that don't specify an expiry
+	defaultGcpTokenLifetime time.Duration = time.Hour
+	// The suffix of service account email addresses, which is
+	// removed for PostgreSQL usernames
+	serviceAccountEmailSuffix string = ".gserviceaccount.com"
+)
+
+// ConnectionParametersGcpIam authenticates connections to GCP Cloud SQL
+// databases using IAM database authentication, where an OAuth2 access token
+// is used as the password. Use MysqlConnectionParametersGcpIam or
+// PostgresConnectionParametersGcpIam, which convert the IAM principal's email
+// address into the username format that each engine expects.
+//
+// Cloud SQL instances use a per-instance server CA, so a GetTlsConfigFunc that
+// trusts it (e.g. from NewCaFileTlsConfigCallback) should also be provided.
+type ConnectionParametersGcpIam struct {
+	// The host (IP address) of the instance
+	Host string `json:"host"`
+	// The port to connect to the instance
+	Port int `json:"port"`
+	// The name of the database to connect to
+	Schema string `json:"database"`
+	// The email address of the IAM user or service account to connect as
+	Username string `json:"username"`
+	// OPTIONAL: The source of OAuth2 access tokens. If not provided, the
+	// application default credentials are used, with the Cloud SQL login
+	// scope, and a new token is requested whenever the cached one needs
+	// replacing. A provided source must not keep returning the same token
+	// once it's within TokenExpiryMargin of expiring, or every check will
+	// reconfigure the connector. Sources from oauth2.ReuseTokenSource only
+	// refresh 10 seconds before expiry, so wrap the underlying source with
+	// oauth2.ReuseTokenSourceWithExpiry and an early expiry that's longer
+	// than TokenExpiryMargin instead.
+	TokenSource oauth2.TokenSource
+	// OPTIONAL: How long before a cached token expires that it stops
+	// being used for new connections. Defaults to 5 minutes, and is
+	// capped at half of each token's lifetime. Once a token is halfway
+	// through its usable lifetime, a replacement is fetched in the
+	// background.
+	TokenExpiryMargin time.Duration
+	// OPTIONAL: If true, tokens will not be cached, and a new token
+	// will be fetched for every new connection.
+	DisableTokenCache bool
+
+	settingsLock sync.Mutex
+	tokenCache   tokenCache
+	// Gets the application default credentials, for overriding in tests
+	getDefaultTokenSource func(ctx context.Context, scope ...string) (oauth2.TokenSource, error)
+}
+
+// MysqlConnectionParametersGcpIam authenticates connections to Cloud SQL
+// for MySQL databases. MySQL IAM usernames are the part of the email
+// address before the `@`.
+type MysqlConnectionParametersGcpIam struct {
+	ConnectionParametersGcpIam
+}
+
+// PostgresConnectionParametersGcpIam authenticates connections to Cloud SQL
+// for PostgreSQL databases. PostgreSQL IAM usernames are the full email
+// address for users, and the email address without the `.gserviceaccount.com`
+// suffix for service accounts.
+type PostgresConnectionParametersGcpIam struct {
+	ConnectionParametersGcpIam
+}
+
+// GetMysqlGcpIamUsername converts the email address of an IAM principal
+// into a Cloud SQL for MySQL username.
+func GetMysqlGcpIamUsername(email string) string {
+	return strings.SplitN(email, "@", 2)[0]
+}
+
+// GetPostgresGcpIamUsername converts the email address of an IAM principal
+// into a Cloud SQL for PostgreSQL username.
+func GetPostgresGcpIamUsername(email string) string {
+	return strings.TrimSuffix(email, serviceAccountEmailSuffix)
+}
+
+func (params *ConnectionParametersGcpIam) getTokenExpiryMargin() time.Duration {
+	return tokenExpiryMarginOrDefault(params.TokenExpiryMargin)
+}
+
+func (params *ConnectionParametersGcpIam) UpdateDialectorSettings(dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
+	return params.tokenCache.updateDialectorSettings(dialectorInput, params.DisableTokenCache, params.getTokenExpiryMargin, params.fetchToken), nil
+}
+
+// fetchToken gets a new access token from the token source.
+func (params *ConnectionParametersGcpIam) fetchToken(ctx context.Context) (string, time.Time, stackerr.Error) {
+	params.settingsLock.Lock()
+	defer params.settingsLock.Unlock()
+
+	tokenSource := params.TokenSource
+	// If no token source is provided, use the application default credentials.
+	// The default token source reuses each token until 10 seconds before it
+	// expires, which is well inside the expiry margin, so a new one is created
+	// for every fetch to force a new token to be requested.
+	if tokenSource == nil {
+		getDefaultTokenSource := params.getDefaultTokenSource
+		if getDefaultTokenSource == nil {
+			getDefaultTokenSource = google.DefaultTokenSource
+		}
+		var err error
+		tokenSource, err = getDefaultTokenSource(ctx, cloudSqlLoginScope)
+		if err != nil {
+			return "", time.Time{}, stackerr.Wrap(err)
+		}
+	}
+
+	fetched := time.Now()
+	token, err := tokenSource.Token()
+	if err != nil {
+		return "", time.Time{}, stackerr.Wrap(err)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, stackerr.Errorf("token source returned an empty access token")
+	}
+	expiresAt := token.Expiry
+	if expiresAt.IsZero() {
+		expiresAt = fetched.Add(defaultGcpTokenLifetime)
+	}
+	return token.AccessToken, expiresAt, nil
+}
+
+func (params *ConnectionParametersGcpIam) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
+	creds := &Credentials{
+		Host:     params.Host,
+		Port:     params.Port,
+		Database: params.Schema,
+		Username: params.Username,
+		// Cloud SQL requires TLS for IAM authentication
+		RequireTls: true,
+		// Tokens are sent as clear text passwords, since
+		// they're validated by the server itself
+		RequireCleartextPassword: true,
+	}
+
+	return params.tokenCache.applyToken(ctx, creds, params.DisableTokenCache, params.getTokenExpiryMargin(), params.fetchToken)
+}
+
+func (params *MysqlConnectionParametersGcpIam) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
+	creds, err := params.ConnectionParametersGcpIam.GetConnectionCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	creds.Username = GetMysqlGcpIamUsername(creds.Username)
+	return creds, nil
+}
+
+func (params *PostgresConnectionParametersGcpIam) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
+	creds, err := params.ConnectionParametersGcpIam.GetConnectionCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	creds.Username = GetPostgresGcpIamUsername(creds.Username)
+	return creds, nil
+}
+
+// WrapPostgresConfigCallback wraps a connectors.GetPostgresConfigCallback so that
+// each new PostgreSQL connection uses a fresh IAM access token as its password.
+// TLS is always required.
+func (params *PostgresConnectionParametersGcpIam) WrapPostgresConfigCallback(callback connectors.GetPostgresConfigCallback) connectors.GetPostgresConfigCallback {
+	return PostgresConfigCallbackWithAuth(params, callback)
+}
@@ -0,0 +1,142 @@
+package authenticators
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeGcpTokenSource returns numbered access tokens that expire after a
+// fixed lifetime (or without an expiry if the lifetime is zero).
+type fakeGcpTokenSource struct {
+	now      func() time.Time
+	lifetime time.Duration
+	fetches  int
+}
+
+func (s *fakeGcpTokenSource) Token() (*oauth2.Token, error) {
+	s.fetches++
+	token := &oauth2.Token{
+		AccessToken: "token-" + strconv.Itoa(s.fetches),
+	}
+	if s.lifetime > 0 {
+		token.Expiry = s.now().Add(s.lifetime)
+	}
+	return token, nil
+}
+
+func TestGcpIamUsesTheCloudSqlLoginScope(t *testing.T) {
+	source := &fakeGcpTokenSource{
+		now:      time.Now,
+		lifetime: time.Hour,
+	}
+	requestedScopes := [][]string{}
+	params := &ConnectionParametersGcpIam{
+		Host:              "10.0.0.1",
+		Port:              5432,
+		Username:          "app@project.iam.gserviceaccount.com",
+		DisableTokenCache: true,
+		getDefaultTokenSource: func(ctx context.Context, scope ...string) (oauth2.TokenSource, error) {
+			requestedScopes = append(requestedScopes, scope)
+			return source, nil
+		},
+	}
+
+	for i := 1; i <= 2; i++ {
+		creds, err := params.GetConnectionCredentials(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.Secret != "token-"+strconv.Itoa(i) || !creds.RequireTls || !creds.RequireCleartextPassword {
+			t.Errorf("expected token-%d to be sent in clear text over TLS, got %+v", i, creds)
+		}
+	}
+	// A new default source is created for every fetch, so
+	// that its own caching doesn't return the same token
+	if len(requestedScopes) != 2 {
+		t.Fatalf("expected the default token source to be created for each fetch, got %d", len(requestedScopes))
+	}
+	for _, scopes := range requestedScopes {
+		if len(scopes) != 1 || scopes[0] != cloudSqlLoginScope {
+			t.Errorf("expected the Cloud SQL login scope to be requested, got %v", scopes)
+		}
+	}
+}
+
+func TestGcpIamTokenExpiry(t *testing.T) {
+	source := &fakeGcpTokenSource{
+		now:      time.Now,
+		lifetime: 30 * time.Minute,
+	}
+	params := &ConnectionParametersGcpIam{
+		TokenSource:       source,
+		DisableTokenCache: true,
+	}
+	before := time.Now()
+	creds, err := params.GetConnectionCredentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.ExpiresAt.Before(before.Add(30*time.Minute)) || creds.ExpiresAt.After(time.Now().Add(30*time.Minute)) {
+		t.Errorf("expected the token's expiry to be used, got %s", creds.ExpiresAt)
+	}
+
+	// Tokens without an expiry are assumed to have the default lifetime
+	source.lifetime = 0
+	before = time.Now()
+	creds, err = params.GetConnectionCredentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.ExpiresAt.Before(before.Add(defaultGcpTokenLifetime)) || creds.ExpiresAt.After(time.Now().Add(defaultGcpTokenLifetime)) {
+		t.Errorf("expected the default lifetime to be used, got %s", creds.ExpiresAt)
+	}
+}
+
+func TestGcpIamReusesTokensInsideTheExpiryMargin(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	getNow := func() time.Time {
+		return now
+	}
+	source := &fakeGcpTokenSource{
+		now:      getNow,
+		lifetime: time.Hour,
+	}
+	params := &PostgresConnectionParametersGcpIam{
+		ConnectionParametersGcpIam{
+			Username:          "app@project.iam.gserviceaccount.com",
+			TokenSource:       source,
+			TokenExpiryMargin: 10 * time.Minute,
+		},
+	}
+	params.tokenCache.now = getNow
+	getToken := func() string {
+		t.Helper()
+		creds, err := params.GetConnectionCredentials(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.Username != "app@project.iam" {
+			t.Errorf("expected the PostgreSQL username format, got %s", creds.Username)
+		}
+		return creds.Secret
+	}
+
+	if token := getToken(); token != "token-1" {
+		t.Fatalf("expected token-1, got %s", token)
+	}
+	// Before the halfway point of its usable lifetime, the
+	// token is reused without fetching a replacement
+	now = now.Add(20 * time.Minute)
+	if token := getToken(); token != "token-1" || source.fetches != 1 {
+		t.Errorf("expected token-1 to be reused, got %s after %d fetches", token, source.fetches)
+	}
+	// Once it's inside the expiry margin, it's replaced
+	now = now.Add(30 * time.Minute)
+	if token := getToken(); token != "token-2" || source.fetches != 2 {
+		t.Errorf("expected token-2 once token-1 was inside the expiry margin, got %s after %d fetches", token, source.fetches)
+	}
+}
@@ -0,0 +1,55 @@
+package authenticators
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/go-sql-driver/mysql"
+)
+
+// ApplyCredentialsToMysqlConfig maps a set of engine-neutral
+// credentials onto a mysql.Config struct.
+func ApplyCredentialsToMysqlConfig(creds Credentials, config mysql.Config) *mysql.Config {
+	if creds.Host != "" {
+		if creds.Port != 0 {
+			config.Addr = fmt.Sprintf("%s:%d", creds.Host, creds.Port)
+		} else {
+			config.Addr = creds.Host
+		}
+	}
+	if creds.Database != "" {
+		config.DBName = creds.Database
+	}
+	config.User = creds.Username
+	config.Passwd = creds.Secret
+
+	if creds.RequireCleartextPassword {
+		// Cleartext secrets (tokens) are sent as-is
+		config.AllowCleartextPasswords = true
+		// The server may still request native password authentication first
+		config.AllowNativePasswords = true
+	}
+
+	if creds.RequireTls && config.TLS == nil {
+		// If TLS isn't already required, require it. A more specific
+		// TLS config can still be set later.
+		switch config.TLSConfig {
+		case "", "false", "preferred":
+			config.TLSConfig = "true"
+		}
+		config.AllowFallbackToPlaintext = false
+	}
+
+	return &config
+}
+
+// UpdateMysqlConfigWithAuth gets credentials from the given authentication
+// settings and applies them to an existing mysql.Config struct.
+func UpdateMysqlConfigWithAuth(ctx context.Context, authSettings AuthenticationSettings, config mysql.Config) (*mysql.Config, stackerr.Error) {
+	creds, err := getCredentials(ctx, authSettings)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyCredentialsToMysqlConfig(*creds, config), nil
+}
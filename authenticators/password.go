@@ -2,11 +2,10 @@ package authenticators
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
 	"github.com/Invicton-Labs/gorm-auth/dialectors"
-	"github.com/go-sql-driver/mysql"
 )
 
 type PasswordCredentials struct {
@@ -14,9 +13,15 @@ type PasswordCredentials struct {
 	Username string `json:"username"`
 	// The password to connect to the database with
 	Password string `json:"password"`
+	// OPTIONAL: The version of these credentials, if the
+	// source of the credentials tracks versions
+	Version string `json:"-"`
 }
 
-type MysqlConnectionParametersPassword struct {
+// ConnectionParametersPassword authenticates connections (MySQL or
+// PostgreSQL) using a username and password that are retrieved
+// dynamically, so that rotated passwords are picked up.
+type ConnectionParametersPassword struct {
 	// The host of the primary cluster
 	Host string `json:"host"`
 	// The port to connect to the primary cluster
@@ -27,19 +32,38 @@ type MysqlConnectionParametersPassword struct {
 	GetCredentials func(ctx context.Context) (PasswordCredentials, stackerr.Error)
 }
 
-func (params *MysqlConnectionParametersPassword) UpdateDialectorSettings(dialectorInput dialectors.MysqlDialectorInput) (dialectors.MysqlDialectorInput, stackerr.Error) {
+// MysqlConnectionParametersPassword is an alias of ConnectionParametersPassword,
+// for use with MySQL databases.
+type MysqlConnectionParametersPassword = ConnectionParametersPassword
+
+// PostgresConnectionParametersPassword is an alias of ConnectionParametersPassword,
+// for use with PostgreSQL databases.
+type PostgresConnectionParametersPassword = ConnectionParametersPassword
+
+func (params *ConnectionParametersPassword) UpdateDialectorSettings(dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
 	return dialectorInput, nil
 }
 
-func (params *MysqlConnectionParametersPassword) UpdateConfigWithAuth(ctx context.Context, config mysql.Config) (*mysql.Config, stackerr.Error) {
+func (params *ConnectionParametersPassword) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
 	// Get the credentials
 	creds, err := params.GetCredentials(ctx)
 	if err != nil {
-		return &config, err
+		return nil, err
 	}
-	config.Addr = fmt.Sprintf("%s:%d", params.Host, params.Port)
-	config.DBName = params.Schema
-	config.User = creds.Username
-	config.Passwd = creds.Password
-	return &config, nil
+	return &Credentials{
+		Host:     params.Host,
+		Port:     params.Port,
+		Database: params.Schema,
+		Username: creds.Username,
+		Secret:   creds.Password,
+		Version:  creds.Version,
+	}, nil
+}
+
+// WrapPostgresConfigCallback wraps a connectors.GetPostgresConfigCallback so that
+// each new PostgreSQL connection uses the host, port, database and the latest
+// username/password from these parameters. If the callback is nil, a default
+// config is used.
+func (params *ConnectionParametersPassword) WrapPostgresConfigCallback(callback connectors.GetPostgresConfigCallback) connectors.GetPostgresConfigCallback {
+	return PostgresConfigCallbackWithAuth(params, callback)
 }
@@ -0,0 +1,196 @@
+package authenticators
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// ApplyCredentialsToPostgresConfig maps a set of engine-neutral
+// credentials onto a pgx.ConnConfig struct.
+func ApplyCredentialsToPostgresConfig(creds Credentials, config pgx.ConnConfig) *pgx.ConnConfig {
+	// Make a copy so we don't modify the fallbacks or TLS
+	// config of the original value, since they're pointers
+	config = *config.Copy()
+
+	originalHost := config.Host
+	originalPort := config.Port
+	if creds.Host != "" {
+		config.Host = creds.Host
+	}
+	if creds.Port != 0 {
+		config.Port = uint16(creds.Port)
+	}
+	if creds.Database != "" {
+		config.Database = creds.Database
+	}
+	config.User = creds.Username
+	config.Password = creds.Secret
+
+	// If the address changed, any fallbacks for the original address
+	// (e.g. the non-TLS fallback from `sslmode=prefer`) need to be
+	// pointed at the new address instead.
+	if config.Host != originalHost || config.Port != originalPort {
+		config.TLSConfig = withServerName(config.TLSConfig, originalHost, config.Host)
+		seen := map[string]struct{}{}
+		fallbacks := make([]*pgconn.FallbackConfig, 0, len(config.Fallbacks))
+		for _, fallback := range config.Fallbacks {
+			if fallback.Host == originalHost && fallback.Port == originalPort {
+				fallback.Host = config.Host
+				fallback.Port = config.Port
+				fallback.TLSConfig = withServerName(fallback.TLSConfig, originalHost, config.Host)
+			}
+			key := fmt.Sprintf("%s:%d:%t", fallback.Host, fallback.Port, fallback.TLSConfig != nil)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			fallbacks = append(fallbacks, fallback)
+		}
+		config.Fallbacks = fallbacks
+	}
+
+	if creds.RequireTls {
+		// If TLS isn't already configured, require it. A more specific
+		// TLS config can still be applied later.
+		if config.TLSConfig == nil {
+			config.TLSConfig = &tls.Config{
+				ServerName: config.Host,
+			}
+		}
+		// Drop any fallbacks that would connect without TLS
+		fallbacks := make([]*pgconn.FallbackConfig, 0, len(config.Fallbacks))
+		for _, fallback := range config.Fallbacks {
+			if fallback.TLSConfig != nil {
+				fallbacks = append(fallbacks, fallback)
+			}
+		}
+		config.Fallbacks = fallbacks
+	}
+
+	return &config
+}
+
+// withServerName returns a copy of the given TLS config with the ServerName
+// updated to the new host, if it was previously set to the old host.
+func withServerName(tlsConfig *tls.Config, oldHost string, newHost string) *tls.Config {
+	if tlsConfig == nil || tlsConfig.ServerName != oldHost {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = newHost
+	return tlsConfig
+}
+
+// UpdatePostgresConfigWithAuth gets credentials from the given authentication
+// settings and applies them to an existing pgx.ConnConfig struct.
+func UpdatePostgresConfigWithAuth(ctx context.Context, authSettings AuthenticationSettings, config pgx.ConnConfig) (*pgx.ConnConfig, stackerr.Error) {
+	creds, err := getCredentials(ctx, authSettings)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyCredentialsToPostgresConfig(*creds, config), nil
+}
+
+// PostgresConfigCallbackWithAuth wraps a connectors.GetPostgresConfigCallback so
+// that the credentials from the given authentication settings are applied to
+// each new connection. If the callback is nil, a default config is used.
+func PostgresConfigCallbackWithAuth(authSettings AuthenticationSettings, callback connectors.GetPostgresConfigCallback) connectors.GetPostgresConfigCallback {
+	return func(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+		var config pgx.ConnConfig
+		var opts []stdlib.OptionOpenDB
+		if callback != nil {
+			var err stackerr.Error
+			config, opts, err = callback(ctx)
+			if err != nil {
+				return config, nil, err
+			}
+		} else {
+			// pgx requires that configs be created by ParseConfig
+			defaultConfig, err := pgx.ParseConfig("")
+			if err != nil {
+				return config, nil, stackerr.Wrap(err)
+			}
+			config = *defaultConfig
+		}
+
+		if authSettings == nil {
+			return config, opts, nil
+		}
+
+		// Get the authentication parameters
+		updatedConfig, err := UpdatePostgresConfigWithAuth(ctx, authSettings, config)
+		if err != nil {
+			return config, nil, err
+		}
+
+		return *updatedConfig, opts, nil
+	}
+}
+
+// postgresConfigCallbackWithAuthAndRootCas wraps a connectors.GetPostgresConfigCallback
+// so that it applies the credentials from the given authentication settings, and so
+// that the primary host and all fallbacks trust the root CAs from getTlsConfig (unless
+// the config already specifies its own root CAs). If the callback is nil, a default
+// config with full TLS verification is used.
+func postgresConfigCallbackWithAuthAndRootCas(authSettings AuthenticationSettings, callback connectors.GetPostgresConfigCallback, getTlsConfig func(ctx context.Context, host string) (*tls.Config, stackerr.Error)) connectors.GetPostgresConfigCallback {
+	if callback == nil {
+		callback = func(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+			// pgx requires that configs be created by ParseConfig
+			config, err := pgx.ParseConfig("sslmode=verify-full")
+			if err != nil {
+				return pgx.ConnConfig{}, nil, stackerr.Wrap(err)
+			}
+			return *config, nil, nil
+		}
+	}
+	f := PostgresConfigCallbackWithAuth(authSettings, callback)
+	return func(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+		config, opts, err := f(ctx)
+		if err != nil {
+			return config, nil, err
+		}
+
+		config.TLSConfig, err = withDefaultRootCas(ctx, config.TLSConfig, config.Host, getTlsConfig)
+		if err != nil {
+			return config, nil, err
+		}
+		for _, fallback := range config.Fallbacks {
+			fallback.TLSConfig, err = withDefaultRootCas(ctx, fallback.TLSConfig, fallback.Host, getTlsConfig)
+			if err != nil {
+				return config, nil, err
+			}
+		}
+		return config, opts, nil
+	}
+}
+
+// withDefaultRootCas returns a TLS config that trusts the root CAs from
+// getTlsConfig, unless the given TLS config already specifies its own root CAs.
+func withDefaultRootCas(ctx context.Context, tlsConfig *tls.Config, host string, getTlsConfig func(ctx context.Context, host string) (*tls.Config, stackerr.Error)) (*tls.Config, stackerr.Error) {
+	if tlsConfig != nil && (tlsConfig.RootCAs != nil || tlsConfig.InsecureSkipVerify) {
+		return tlsConfig, nil
+	}
+	defaultTlsConfig, err := getTlsConfig(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return defaultTlsConfig, nil
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.RootCAs = defaultTlsConfig.RootCAs
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = defaultTlsConfig.ServerName
+	}
+	if tlsConfig.MinVersion < defaultTlsConfig.MinVersion {
+		tlsConfig.MinVersion = defaultTlsConfig.MinVersion
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,304 @@
+package authenticators
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+)
+
+const (
+	// The default duration before a token expires that it
+	// will stop being used for new connections
+	defaultTokenExpiryMargin time.Duration = 5 * time.Minute
+	// The maximum duration to allow a background token
+	// refresh to run for
+	backgroundTokenRefreshTimeout time.Duration = 30 * time.Second
+)
+
+// A function signature for a function that generates a new token,
+// along with the time at which it expires.
+type fetchTokenFunc func(ctx context.Context) (token string, expiresAt time.Time, err stackerr.Error)
+
+type cachedToken struct {
+	token string
+	// When the token was requested
+	issued    time.Time
+	expiresAt time.Time
+	// A unique identifier for this token, which changes
+	// every time a new token is generated
+	version string
+}
+
+// A synchronous token fetch, which concurrent callers wait for
+// instead of each generating their own token.
+type tokenFetch struct {
+	done  chan struct{}
+	token *cachedToken
+	err   stackerr.Error
+}
+
+// tokenCache caches a short-lived token and reuses it until shortly
+// before it expires. Once a token has passed the halfway point of its
+// usable lifetime, a new one is generated in the background so that
+// callers don't need to wait for it.
+type tokenCache struct {
+	lock       sync.Mutex
+	current    *cachedToken
+	refreshing bool
+	// The synchronous fetch that is in progress, if any
+	fetching *tokenFetch
+	counter  uint64
+	// A function for getting the current time, which
+	// can be replaced for testing
+	now func() time.Time
+}
+
+func (c *tokenCache) getNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// usableUntil returns the time after which a token should no
+// longer be used for new connections. The margin is capped at half
+// of the token's lifetime, so that a token that is shorter-lived
+// than the margin is still used instead of being replaced at once.
+func usableUntil(token *cachedToken, margin time.Duration) time.Time {
+	if limit := token.expiresAt.Sub(token.issued) / 2; margin > limit {
+		margin = limit
+	}
+	return token.expiresAt.Add(-margin)
+}
+
+// store saves a newly generated token in the cache. If the token is the
+// same as the cached one (e.g. because the token source caches tokens
+// itself), the version is kept so that connectors don't reconfigure
+// unnecessarily. The lock must be held.
+func (c *tokenCache) store(token string, expiresAt time.Time, issued time.Time) *cachedToken {
+	if c.current != nil && c.current.token == token {
+		c.current = &cachedToken{
+			token:     token,
+			issued:    issued,
+			expiresAt: expiresAt,
+			version:   c.current.version,
+		}
+		return c.current
+	}
+	c.counter++
+	c.current = &cachedToken{
+		token:     token,
+		issued:    issued,
+		expiresAt: expiresAt,
+		version:   strconv.FormatUint(c.counter, 10),
+	}
+	return c.current
+}
+
+// usable returns the cached token if it's still usable, or nil if it's
+// not. If the cached token is past the halfway point of its usable
+// lifetime, a replacement is generated in the background. Tokens that
+// don't expire are always usable. The lock must be held.
+func (c *tokenCache) usable(ctx context.Context, margin time.Duration, fetch fetchTokenFunc) *cachedToken {
+	if c.current == nil {
+		return nil
+	}
+	// Tokens without an expiry are used until they fail
+	// authentication, at which point they're invalidated
+	if c.current.expiresAt.IsZero() {
+		return c.current
+	}
+	now := c.getNow()
+	if !now.Before(usableUntil(c.current, margin)) {
+		return nil
+	}
+	refreshAt := c.current.issued.Add(usableUntil(c.current, margin).Sub(c.current.issued) / 2)
+	if !c.refreshing && !now.Before(refreshAt) {
+		c.refreshing = true
+		go c.refreshInBackground(connectors.LoggerFromContext(ctx), fetch)
+	}
+	return c.current
+}
+
+// peek returns the cached token if it's still usable, or nil if
+// it's not, without synchronously generating a new one.
+func (c *tokenCache) peek(ctx context.Context, margin time.Duration, fetch fetchTokenFunc) *cachedToken {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.usable(ctx, margin, fetch)
+}
+
+// get returns the cached token if it's still usable, or synchronously
+// generates a new one if it's not. The lock isn't held while a token is
+// generated, and concurrent callers wait for the same token instead of
+// each generating their own.
+func (c *tokenCache) get(ctx context.Context, margin time.Duration, fetch fetchTokenFunc) (*cachedToken, stackerr.Error) {
+	c.lock.Lock()
+	if token := c.usable(ctx, margin, fetch); token != nil {
+		c.lock.Unlock()
+		return token, nil
+	}
+
+	// There's no usable token, so generate one now
+	// unless another caller is already doing so
+	inFlight := c.fetching
+	if inFlight == nil {
+		inFlight = &tokenFetch{
+			done: make(chan struct{}),
+		}
+		c.fetching = inFlight
+		c.lock.Unlock()
+		c.fetchSync(ctx, inFlight, fetch)
+	} else {
+		c.lock.Unlock()
+	}
+
+	select {
+	case <-inFlight.done:
+		return inFlight.token, inFlight.err
+	case <-ctx.Done():
+		return nil, stackerr.Wrap(ctx.Err())
+	}
+}
+
+// fetchSync generates a new token for a synchronous fetch, stores
+// it in the cache, and lets any waiting callers know that it's done.
+func (c *tokenCache) fetchSync(ctx context.Context, inFlight *tokenFetch, fetch fetchTokenFunc) {
+	issued := c.getNow()
+	token, expiresAt, err := fetchWithSpan(ctx, fetch)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer close(inFlight.done)
+	c.fetching = nil
+	if err != nil {
+		connectors.LoggerFromContext(ctx).ErrorContext(ctx, "failed to fetch token", "error", err)
+		inFlight.err = err
+		return
+	}
+	inFlight.token = c.store(token, expiresAt, issued)
+	connectors.LoggerFromContext(ctx).InfoContext(ctx, "fetched new token", "credential_version", inFlight.token.version, "expires_at", inFlight.token.expiresAt)
+}
+
+// fetchWithSpan generates a new token inside a tracing span. The
+// token itself is never recorded.
+func fetchWithSpan(ctx context.Context, fetch fetchTokenFunc) (string, time.Time, stackerr.Error) {
+	ctx, span := connectors.StartSpan(ctx, "gormauth.FetchToken")
+	token, expiresAt, err := fetch(ctx)
+	connectors.EndSpan(span, err)
+	return token, expiresAt, err
+}
+
+// invalidate discards the cached token, so that the next
+// call to get will generate a new one.
+func (c *tokenCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.current = nil
+}
+
+func (c *tokenCache) refreshInBackground(logger connectors.Logger, fetch fetchTokenFunc) {
+	// Don't use the caller's context, since it might be
+	// cancelled as soon as the caller's connection is made
+	ctx, cancel := context.WithTimeout(context.Background(), backgroundTokenRefreshTimeout)
+	defer cancel()
+
+	issued := c.getNow()
+	token, expiresAt, err := fetch(ctx)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.refreshing = false
+	// If the refresh failed, the existing token continues to be used until
+	// it's no longer usable, at which point a synchronous refresh is done
+	// and the error is returned to the caller.
+	if err != nil {
+		logger.WarnContext(ctx, "failed to refresh token in the background", "error", err)
+		return
+	}
+	stored := c.store(token, expiresAt, issued)
+	logger.InfoContext(ctx, "refreshed token in the background", "credential_version", stored.version, "expires_at", stored.expiresAt)
+}
+
+// getForConnection gets a token for a new connection. If the previous
+// token failed authentication, it isn't reused.
+func (c *tokenCache) getForConnection(ctx context.Context, margin time.Duration, fetch fetchTokenFunc) (*cachedToken, stackerr.Error) {
+	if connectors.IsAuthFailureRetry(ctx) {
+		c.invalidate()
+	}
+	return c.get(ctx, margin, fetch)
+}
+
+// shouldReconfigureCallback creates a callback that requests a reconfiguration
+// whenever the cached token has been replaced, or when it's no longer usable.
+// Each callback tracks the token version it last saw separately, since the
+// same parameters may be used for multiple dialectors.
+func (c *tokenCache) shouldReconfigureCallback(margin func() time.Duration, fetch fetchTokenFunc) connectors.ShouldReconfigureCallback {
+	var lastVersion string
+	return func(ctx context.Context) (bool, stackerr.Error) {
+		token := c.peek(ctx, margin(), fetch)
+		if token == nil {
+			return true, nil
+		}
+		// The callback is first called once the connector has
+		// been configured, so it's using the current token
+		if lastVersion == "" {
+			lastVersion = token.version
+			return false, nil
+		}
+		if token.version != lastVersion {
+			lastVersion = token.version
+			return true, nil
+		}
+		return false, nil
+	}
+}
+
+// tokenExpiryMarginOrDefault returns the given token expiry margin,
+// or the default margin if it isn't set.
+func tokenExpiryMarginOrDefault(margin time.Duration) time.Duration {
+	if margin > 0 {
+		return margin
+	}
+	return defaultTokenExpiryMargin
+}
+
+// updateDialectorSettings sets the reconfigure callback of a dialector that
+// uses tokens from this cache. If the cache is disabled, the callback is
+// removed, since a new token is fetched for every connection anyway.
+func (c *tokenCache) updateDialectorSettings(dialectorInput dialectors.DialectorInput, disableCache bool, margin func() time.Duration, fetch fetchTokenFunc) dialectors.DialectorInput {
+	if disableCache {
+		dialectorInput.ShouldReconfigureCallback = nil
+		return dialectorInput
+	}
+	// Reconfigure whenever the cached token has been replaced, or when it's no longer usable
+	dialectorInput.ShouldReconfigureCallback = c.shouldReconfigureCallback(margin, fetch)
+	return dialectorInput
+}
+
+// applyToken sets the secret of a set of credentials to a token, which is
+// taken from this cache unless the cache is disabled.
+func (c *tokenCache) applyToken(ctx context.Context, creds *Credentials, disableCache bool, margin time.Duration, fetch fetchTokenFunc) (*Credentials, stackerr.Error) {
+	if disableCache {
+		var err stackerr.Error
+		creds.Secret, creds.ExpiresAt, err = fetchWithSpan(ctx, fetch)
+		if err != nil {
+			return nil, err
+		}
+		return creds, nil
+	}
+
+	token, err := c.getForConnection(ctx, margin, fetch)
+	if err != nil {
+		return nil, err
+	}
+	creds.Secret = token.token
+	creds.ExpiresAt = token.expiresAt
+	creds.Version = token.version
+	return creds, nil
+}
@@ -0,0 +1,163 @@
+package authenticators
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// fakeTokens generates numbered tokens with a fixed lifetime, counting
+// how many have been generated.
+type fakeTokens struct {
+	lock     sync.Mutex
+	now      time.Time
+	lifetime time.Duration
+	fetches  int
+	// OPTIONAL: A channel that each fetch waits on before returning
+	release chan struct{}
+}
+
+func (f *fakeTokens) getNow() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeTokens) advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func (f *fakeTokens) getFetches() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.fetches
+}
+
+func (f *fakeTokens) fetch(ctx context.Context) (string, time.Time, stackerr.Error) {
+	if f.release != nil {
+		<-f.release
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fetches++
+	return "token-" + strconv.Itoa(f.fetches), f.now.Add(f.lifetime), nil
+}
+
+func newFakeTokens(lifetime time.Duration) (*fakeTokens, *tokenCache) {
+	tokens := &fakeTokens{
+		now:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		lifetime: lifetime,
+	}
+	return tokens, &tokenCache{
+		now: tokens.getNow,
+	}
+}
+
+func TestTokenCacheFetchesConcurrentlyRequestedTokensOnce(t *testing.T) {
+	tokens, cache := newFakeTokens(time.Hour)
+	tokens.release = make(chan struct{})
+
+	results := make(chan *cachedToken, 3)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			token, err := cache.get(context.Background(), time.Minute, tokens.fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- token
+		}()
+	}
+
+	// The lock isn't held while the token is being fetched
+	for {
+		cache.lock.Lock()
+		fetching := cache.fetching != nil
+		cache.lock.Unlock()
+		if fetching {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if token := cache.peek(context.Background(), time.Minute, tokens.fetch); token != nil {
+		t.Fatalf("expected no usable token while the first one is fetched, got %s", token.token)
+	}
+
+	close(tokens.release)
+	for i := 0; i < cap(results); i++ {
+		if token := <-results; token == nil || token.token != "token-1" {
+			t.Errorf("expected every caller to get token-1, got %+v", token)
+		}
+	}
+	if fetches := tokens.getFetches(); fetches != 1 {
+		t.Errorf("expected 1 fetch, got %d", fetches)
+	}
+}
+
+func TestTokenCacheCapsTheExpiryMargin(t *testing.T) {
+	// The margin is longer than the token's lifetime
+	tokens, cache := newFakeTokens(4 * time.Minute)
+	margin := 10 * time.Minute
+
+	if _, err := cache.get(context.Background(), margin, tokens.fetch); err != nil {
+		t.Fatal(err)
+	}
+	// The token is still used until halfway through its lifetime,
+	// and isn't refreshed in the background before then either
+	tokens.advance(time.Minute - time.Second)
+	token, err := cache.get(context.Background(), margin, tokens.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.token != "token-1" || tokens.getFetches() != 1 {
+		t.Errorf("expected token-1 to be reused, got %s after %d fetches", token.token, tokens.getFetches())
+	}
+	tokens.advance(time.Minute + time.Second)
+	if token := cache.peek(context.Background(), margin, tokens.fetch); token != nil {
+		t.Errorf("expected token-1 to be unusable halfway through its lifetime, got %s", token.token)
+	}
+}
+
+func TestTokenCacheShouldReconfigureCallback(t *testing.T) {
+	tokens, cache := newFakeTokens(time.Hour)
+	margin := func() time.Duration {
+		return time.Minute
+	}
+	shouldReconfigure := cache.shouldReconfigureCallback(margin, tokens.fetch)
+	check := func() bool {
+		t.Helper()
+		reconfigure, err := shouldReconfigure(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reconfigure
+	}
+
+	// The connector is configured with the first token
+	if _, err := cache.get(context.Background(), margin(), tokens.fetch); err != nil {
+		t.Fatal(err)
+	}
+	if check() {
+		t.Error("expected no reconfiguration for the token that the connector was just configured with")
+	}
+	if check() {
+		t.Error("expected no reconfiguration while the token is unchanged")
+	}
+
+	// The token is replaced
+	cache.invalidate()
+	if _, err := cache.get(context.Background(), margin(), tokens.fetch); err != nil {
+		t.Fatal(err)
+	}
+	if !check() {
+		t.Error("expected a reconfiguration once the token was replaced")
+	}
+	if check() {
+		t.Error("expected no reconfiguration after the connector picked up the new token")
+	}
+}
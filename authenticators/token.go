@@ -0,0 +1,120 @@
+package authenticators
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+)
+
+// A short-lived bearer token that is used as a database password
+type Token struct {
+	// The token itself
+	Value string
+	// When the token expires. A zero value means that the token
+	// doesn't expire, so it's used until it fails authentication,
+	// at which point a new token is fetched.
+	ExpiresAt time.Time
+}
+
+// TokenSource gets bearer tokens (e.g. from an OIDC provider, or a JWT
+// issuer for a database proxy). Implementations don't need to cache
+// tokens, since TokenAuthenticator caches them until shortly before
+// they expire.
+type TokenSource interface {
+	// GetToken gets a new token
+	GetToken(ctx context.Context) (Token, stackerr.Error)
+}
+
+// TokenSourceFunc is an adapter that allows a function
+// to be used as a TokenSource.
+type TokenSourceFunc func(ctx context.Context) (Token, stackerr.Error)
+
+func (f TokenSourceFunc) GetToken(ctx context.Context) (Token, stackerr.Error) {
+	return f(ctx)
+}
+
+// TokenAuthenticator authenticates connections (MySQL or PostgreSQL) using
+// short-lived bearer tokens from a TokenSource as passwords. Tokens are sent
+// in clear text, so TLS is always required. Tokens are cached and refreshed
+// in the background before they expire, and connectors are reconfigured
+// whenever a new token is fetched.
+type TokenAuthenticator struct {
+	// The host of the database
+	Host string `json:"host"`
+	// The port to connect to the database
+	Port int `json:"port"`
+	// The name of the database to connect to
+	Schema string `json:"database"`
+	// The username to connect with
+	Username string `json:"username"`
+	// The source of tokens
+	TokenSource TokenSource
+	// OPTIONAL: A function that gets the TLS config to use for PostgreSQL
+	// connections, if the config does not already specify which root CAs
+	// to trust. For MySQL connections, use the GetTlsConfigFunc of the
+	// connection parameters instead.
+	GetTlsConfigFunc func(ctx context.Context, host string) (*tls.Config, stackerr.Error)
+	// OPTIONAL: How long before a cached token expires that it stops
+	// being used for new connections. Defaults to 5 minutes, and is
+	// capped at half of each token's lifetime. Once a token is halfway
+	// through its usable lifetime, a replacement is fetched in the
+	// background.
+	TokenExpiryMargin time.Duration
+	// OPTIONAL: If true, tokens will not be cached, and a new token
+	// will be fetched for every new connection.
+	DisableTokenCache bool
+
+	tokenCache tokenCache
+}
+
+func (params *TokenAuthenticator) getTokenExpiryMargin() time.Duration {
+	return tokenExpiryMarginOrDefault(params.TokenExpiryMargin)
+}
+
+func (params *TokenAuthenticator) UpdateDialectorSettings(dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
+	return params.tokenCache.updateDialectorSettings(dialectorInput, params.DisableTokenCache, params.getTokenExpiryMargin, params.fetchToken), nil
+}
+
+// fetchToken gets a new token from the token source.
+func (params *TokenAuthenticator) fetchToken(ctx context.Context) (string, time.Time, stackerr.Error) {
+	if params.TokenSource == nil {
+		return "", time.Time{}, stackerr.Errorf("no token source was provided")
+	}
+	token, err := params.TokenSource.GetToken(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if token.Value == "" {
+		return "", time.Time{}, stackerr.Errorf("token source returned an empty token")
+	}
+	return token.Value, token.ExpiresAt, nil
+}
+
+func (params *TokenAuthenticator) GetConnectionCredentials(ctx context.Context) (*Credentials, stackerr.Error) {
+	creds := &Credentials{
+		Host:     params.Host,
+		Port:     params.Port,
+		Database: params.Schema,
+		Username: params.Username,
+		// Tokens are sent in clear text, so TLS is required
+		RequireTls:               true,
+		RequireCleartextPassword: true,
+	}
+
+	return params.tokenCache.applyToken(ctx, creds, params.DisableTokenCache, params.getTokenExpiryMargin(), params.fetchToken)
+}
+
+// WrapPostgresConfigCallback wraps a connectors.GetPostgresConfigCallback so that
+// each new PostgreSQL connection uses a token as its password. TLS is always
+// enabled, and if GetTlsConfigFunc is set and the config does not already specify
+// which root CAs to trust, the root CAs from GetTlsConfigFunc are used.
+func (params *TokenAuthenticator) WrapPostgresConfigCallback(callback connectors.GetPostgresConfigCallback) connectors.GetPostgresConfigCallback {
+	if params.GetTlsConfigFunc == nil {
+		return PostgresConfigCallbackWithAuth(params, callback)
+	}
+	return postgresConfigCallbackWithAuthAndRootCas(params, callback, params.GetTlsConfigFunc)
+}
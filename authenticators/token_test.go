@@ -0,0 +1,81 @@
+package authenticators
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+)
+
+func TestTokenWithoutExpiryIsUsedUntilAuthenticationFails(t *testing.T) {
+	fetches := 0
+	params := &TokenAuthenticator{
+		Host:     "db.example.com",
+		Port:     5432,
+		Username: "app",
+		TokenSource: TokenSourceFunc(func(ctx context.Context) (Token, stackerr.Error) {
+			fetches++
+			return Token{
+				Value: "token-" + strconv.Itoa(fetches),
+			}, nil
+		}),
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	params.tokenCache.now = func() time.Time {
+		return now
+	}
+	dialectorInput, err := params.UpdateDialectorSettings(dialectors.DialectorInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getToken := func(ctx context.Context) string {
+		t.Helper()
+		creds, err := params.GetConnectionCredentials(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !creds.ExpiresAt.IsZero() {
+			t.Errorf("expected credentials without an expiry, got %s", creds.ExpiresAt)
+		}
+		return creds.Secret
+	}
+	shouldReconfigure := func() bool {
+		t.Helper()
+		reconfigure, err := dialectorInput.ShouldReconfigureCallback(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reconfigure
+	}
+
+	if token := getToken(context.Background()); token != "token-1" {
+		t.Fatalf("expected token-1, got %s", token)
+	}
+	shouldReconfigure()
+
+	// The token keeps being used, no matter how much time passes
+	for i := 0; i < 3; i++ {
+		now = now.Add(24 * time.Hour)
+		if shouldReconfigure() {
+			t.Fatal("expected no reconfiguration for a token without an expiry")
+		}
+		if token := getToken(context.Background()); token != "token-1" {
+			t.Fatalf("expected token-1 to be reused, got %s", token)
+		}
+	}
+
+	// Once it fails authentication, a new token is fetched
+	if token := getToken(connectors.WithAuthFailureRetry(context.Background(), "1")); token != "token-2" {
+		t.Fatalf("expected token-2 after an authentication failure, got %s", token)
+	}
+	if !shouldReconfigure() {
+		t.Error("expected a reconfiguration after the token was replaced")
+	}
+	if fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", fetches)
+	}
+}
@@ -3,9 +3,16 @@ package awscerts
 import (
 	"crypto/x509"
 	"embed"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Invicton-Labs/go-stackerr"
 )
@@ -13,89 +20,465 @@ import (
 //go:embed bundles/*
 var awsCertBundles embed.FS
 
+//go:generate curl -fsSL -o bundles/rds-global-aws-us-gov.pem https://truststore.pki.us-gov-west-1.rds.amazonaws.com/global/global-bundle.pem
+//go:generate curl -fsSL -o bundles/rds-global-aws-cn.pem https://rds-truststore.s3.cn-north-1.amazonaws.com.cn/global/global-bundle.pem
+
 const (
 	awsRootCertBundleUrl string = "https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem"
+
+	// The name of the embedded file that contains the global RDS bundle
+	globalBundleFileName string = "rds-global.pem"
+	// The name of the embedded file that contains the global RDS bundle
+	// of the AWS GovCloud (US) partition, from
+	// https://truststore.pki.us-gov-west-1.rds.amazonaws.com/global/global-bundle.pem
+	usGovGlobalBundleFileName string = "rds-global-aws-us-gov.pem"
+	// The name of the embedded file that contains the global RDS bundle
+	// of the AWS China partition, from
+	// https://rds-truststore.s3.cn-north-1.amazonaws.com.cn/global/global-bundle.pem
+	cnGlobalBundleFileName string = "rds-global-aws-cn.pem"
+	// The prefix of the embedded files that contain the Amazon root CAs,
+	// which are used by RDS Proxy and are always trusted
+	amazonRootCaFilePrefix string = "AmazonRootCA"
+	// The name of the embedded file that contains the Starfield root CA,
+	// which is cross-signed by the Amazon root CAs
+	starfieldRootCaFileName string = "SFSRootCAG2.pem"
+
+	// The timeout for downloading a bundle, if no HTTP client is provided
+	defaultDownloadTimeout time.Duration = 10 * time.Second
+	// The maximum size of a downloaded bundle
+	maxBundleSize int64 = 4 * 1024 * 1024
 )
 
-var (
-	globalAwsRootCertPool        *x509.CertPool
-	globalAwsRootCertPoolOnce    sync.Once
-	globalAwsRootCertPoolInitErr stackerr.Error
+const (
+	// The default duration before a certificate in a bundle
+	// expires that a new bundle will be downloaded
+	defaultExpiryMargin time.Duration = 30 * 24 * time.Hour
+	// The default interval between checks of a bundle for
+	// certificates that are close to expiring
+	defaultCheckInterval time.Duration = 24 * time.Hour
 )
 
-func initCertPool(httpClient *http.Client) stackerr.Error {
-	entries, err := awsCertBundles.ReadDir("bundles")
+// BundleOptions control how certificate bundles are loaded and refreshed.
+// Each bundle's CertPool is shared by every caller, so the options of the
+// caller that triggers a check of the bundle are used for that check.
+type BundleOptions struct {
+	// OPTIONAL: The HTTP client to download new bundles with. If not
+	// provided, a client with a 10 second timeout is used.
+	HttpClient *http.Client
+	// OPTIONAL: How long before a certificate in a bundle expires that
+	// a new bundle will be downloaded. Defaults to 30 days.
+	ExpiryMargin time.Duration
+	// OPTIONAL: How often bundles are re-checked for certificates that
+	// are close to expiring. Defaults to 24 hours.
+	CheckInterval time.Duration
+	// OPTIONAL: The directory to cache downloaded bundles in, which must
+	// only be writable by trusted users, since the CAs in cached bundles
+	// are trusted. If empty, downloaded bundles are not cached.
+	CacheDir string
+	// OPTIONAL: The URL that the global RDS bundle is downloaded from,
+	// e.g. to use a mirror or a local stand-in. Defaults to AWS's URL.
+	GlobalBundleUrl string
+	// OPTIONAL: The URLs that region-specific bundles are downloaded
+	// from, by partition, e.g. to use a mirror or a local stand-in. The
+	// `%[1]s` placeholder is replaced with the region. Partitions that
+	// aren't included use AWS's URLs.
+	RegionalBundleUrls map[string]string
+}
+
+func (o *BundleOptions) getHttpClient() *http.Client {
+	if o != nil && o.HttpClient != nil {
+		return o.HttpClient
+	}
+	return &http.Client{
+		Timeout: defaultDownloadTimeout,
+	}
+}
+
+func (o *BundleOptions) getExpiryMargin() time.Duration {
+	if o != nil && o.ExpiryMargin > 0 {
+		return o.ExpiryMargin
+	}
+	return defaultExpiryMargin
+}
+
+func (o *BundleOptions) getCheckInterval() time.Duration {
+	if o != nil && o.CheckInterval > 0 {
+		return o.CheckInterval
+	}
+	return defaultCheckInterval
+}
+
+func (o *BundleOptions) getCacheDir() string {
+	if o != nil {
+		return o.CacheDir
+	}
+	return ""
+}
+
+func (o *BundleOptions) getGlobalBundleUrl() string {
+	if o != nil && o.GlobalBundleUrl != "" {
+		return o.GlobalBundleUrl
+	}
+	return awsRootCertBundleUrl
+}
+
+func (o *BundleOptions) getRegionalBundleUrl(partition string) string {
+	if o != nil {
+		if url, ok := o.RegionalBundleUrls[partition]; ok {
+			return url
+		}
+	}
+	return defaultRegionalBundleUrls[partition]
+}
+
+// A load of a bundle that hasn't been loaded before, which
+// concurrent callers wait for instead of each loading it.
+type bundleLoad struct {
+	done chan struct{}
+	pool *x509.CertPool
+	err  stackerr.Error
+}
+
+// bundle is a certificate bundle that is embedded in this package, but that
+// can be replaced by a newer version downloaded from AWS when certificates
+// in it are close to expiring.
+type bundle struct {
+	lock sync.Mutex
+	// The name of the cached file
+	fileName string
+	// A function that gets the URL to download a new version from
+	getUrl func(options *BundleOptions) string
+	// A function that gets the embedded version of the bundle,
+	// or nil if there is no embedded version
+	getEmbedded func() ([]byte, stackerr.Error)
+	// Whether the Amazon root CAs should be trusted too
+	includeAmazonRootCas bool
+
+	pool      *x509.CertPool
+	lastCheck time.Time
+	// The load or refresh that is in progress, if any
+	loading *bundleLoad
+}
+
+var globalBundle = &bundle{
+	fileName: globalBundleFileName,
+	getUrl: func(options *BundleOptions) string {
+		return options.getGlobalBundleUrl()
+	},
+	getEmbedded: func() ([]byte, stackerr.Error) {
+		return readEmbeddedBundle(globalBundleFileName)
+	},
+	includeAmazonRootCas: true,
+}
+
+// readEmbeddedBundle reads one of the bundles that is embedded in this package.
+func readEmbeddedBundle(fileName string) ([]byte, stackerr.Error) {
+	pemBytes, err := awsCertBundles.ReadFile(fmt.Sprintf("bundles/%s", fileName))
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return pemBytes, nil
+}
+
+// hasEmbeddedBundle returns whether a bundle is embedded in this package.
+func hasEmbeddedBundle(fileName string) bool {
+	_, err := fs.Stat(awsCertBundles, fmt.Sprintf("bundles/%s", fileName))
+	return err == nil
+}
+
+// parseCertificates parses all certificates in a PEM bundle.
+func parseCertificates(pemBytes []byte) ([]*x509.Certificate, stackerr.Error) {
+	certs := []*x509.Certificate{}
+	for len(pemBytes) > 0 {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		certs = append(certs, crt)
+	}
+	return certs, nil
+}
+
+// needsRefresh determines whether a bundle should be replaced. Certificates
+// that have already expired are ignored, since bundles keep expired CAs for
+// some time after their replacements are added. A bundle needs to be
+// replaced if any certificate that is still valid will expire soon, or if
+// there are no valid certificates left.
+func needsRefresh(certs []*x509.Certificate, now time.Time, expiryMargin time.Duration) bool {
+	hasValid := false
+	for _, crt := range certs {
+		if now.After(crt.NotAfter) {
+			continue
+		}
+		hasValid = true
+		if crt.NotAfter.Sub(now) < expiryMargin {
+			return true
+		}
+	}
+	return !hasValid
+}
+
+// validateBundle ensures that a bundle only contains CA certificates, and
+// that at least one of them is currently valid.
+func validateBundle(certs []*x509.Certificate, now time.Time) stackerr.Error {
+	if len(certs) == 0 {
+		return stackerr.Errorf("bundle does not contain any certificates")
+	}
+	hasValid := false
+	for _, crt := range certs {
+		if !crt.IsCA {
+			return stackerr.Errorf("bundle contains a non-CA certificate (%s)", crt.Subject.String())
+		}
+		if !now.Before(crt.NotBefore) && !now.After(crt.NotAfter) {
+			hasValid = true
+		}
+	}
+	if !hasValid {
+		return stackerr.Errorf("bundle does not contain any currently valid certificates")
+	}
+	return nil
+}
+
+// getCachePath gets the path that a bundle is cached at, or an
+// empty string if bundles aren't cached.
+func getCachePath(cacheDir string, fileName string) string {
+	if cacheDir == "" {
+		return ""
+	}
+	return filepath.Join(cacheDir, fileName)
+}
+
+// readCachedBundle reads a previously downloaded bundle from the cache.
+func readCachedBundle(cacheDir string, fileName string, now time.Time) []byte {
+	path := getCachePath(cacheDir, fileName)
+	if path == "" {
+		return nil
+	}
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	certs, serr := parseCertificates(pemBytes)
+	if serr != nil || validateBundle(certs, now) != nil {
+		return nil
+	}
+	return pemBytes
+}
+
+// writeCachedBundle writes a downloaded bundle to the cache. The
+// bundle is written to a temporary file first, so that other
+// processes never read a partially written bundle.
+func writeCachedBundle(cacheDir string, fileName string, pemBytes []byte) stackerr.Error {
+	path := getCachePath(cacheDir, fileName)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return stackerr.Wrap(err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), fileName+".*.tmp")
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(pemBytes); err != nil {
+		tmpFile.Close()
+		return stackerr.Wrap(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return stackerr.Wrap(err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// downloadBundle downloads a new version of a bundle and validates it.
+func downloadBundle(httpClient *http.Client, url string, now time.Time) ([]byte, stackerr.Error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, stackerr.Errorf("failed to download certificate bundle from %s: status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBundleSize))
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	certs, serr := parseCertificates(body)
+	if serr != nil {
+		return nil, serr
+	}
+	if serr := validateBundle(certs, now); serr != nil {
+		return nil, serr
+	}
+	return body, nil
+}
 
-	rootCertPool := x509.NewCertPool()
+// getAmazonRootCas gets the PEM bytes of the embedded Amazon root CAs.
+func getAmazonRootCas() ([][]byte, stackerr.Error) {
+	entries, err := awsCertBundles.ReadDir("bundles")
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	rootCas := [][]byte{}
 	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), amazonRootCaFilePrefix) && entry.Name() != starfieldRootCaFileName {
+			continue
+		}
 		pemBytes, err := awsCertBundles.ReadFile(fmt.Sprintf("bundles/%s", entry.Name()))
 		if err != nil {
-			return stackerr.Wrap(err)
+			return nil, stackerr.Wrap(err)
 		}
-		if ok := rootCertPool.AppendCertsFromPEM(pemBytes); !ok {
-			return stackerr.Errorf("failed to parse PEM file %s", entry.Name())
+		rootCas = append(rootCas, pemBytes)
+	}
+	return rootCas, nil
+}
+
+// load selects the newest usable version of the bundle (embedded, cached
+// or downloaded) and creates a CertPool from it, along with the Amazon
+// root CAs if required.
+func (b *bundle) load(options *BundleOptions, now time.Time) (*x509.CertPool, stackerr.Error) {
+	embeddedBytes, err := b.getEmbedded()
+	if err != nil {
+		return nil, err
+	}
+
+	// Try the cached bundle first, since it's newer than the
+	// embedded one if it exists, then fall back to the embedded
+	// bundle.
+	candidates := [][]byte{}
+	if cachedBytes := readCachedBundle(options.getCacheDir(), b.fileName, now); cachedBytes != nil {
+		candidates = append(candidates, cachedBytes)
+	}
+	if embeddedBytes != nil {
+		candidates = append(candidates, embeddedBytes)
+	}
+
+	var selected []byte
+	for _, candidate := range candidates {
+		certs, err := parseCertificates(candidate)
+		if err != nil {
+			continue
+		}
+		if !needsRefresh(certs, now, options.getExpiryMargin()) {
+			selected = candidate
+			break
 		}
 	}
 
-	globalAwsRootCertPool = rootCertPool
-	return nil
+	if selected == nil {
+		// All available bundles have certificates that are close to
+		// expiring, so try to download a new one. If that fails (e.g.
+		// because there's no internet access), use the best bundle
+		// that we already have.
+		downloadedBytes, err := downloadBundle(options.getHttpClient(), b.getUrl(options), now)
+		if err == nil {
+			// Failing to cache the bundle isn't fatal, it just
+			// means it will be downloaded again next time
+			_ = writeCachedBundle(options.getCacheDir(), b.fileName, downloadedBytes)
+			selected = downloadedBytes
+		} else if len(candidates) > 0 {
+			selected = candidates[0]
+		} else {
+			// There's no embedded or cached version to fall back to
+			return nil, err
+		}
+	}
+
+	bundles := [][]byte{selected}
+	if b.includeAmazonRootCas {
+		rootCas, err := getAmazonRootCas()
+		if err != nil {
+			return nil, err
+		}
+		bundles = append(rootCas, selected)
+	}
+
+	pool := x509.NewCertPool()
+	for _, pemBytes := range bundles {
+		if ok := pool.AppendCertsFromPEM(pemBytes); !ok {
+			return nil, stackerr.Errorf("failed to parse PEM bundle for %s", b.fileName)
+		}
+	}
+	return pool, nil
+}
+
+// refresh loads the bundle without holding the lock, and then replaces the
+// CertPool with the result. If it can't be loaded, the existing CertPool (if
+// any) continues to be used.
+func (b *bundle) refresh(inFlight *bundleLoad, options *BundleOptions, now time.Time) {
+	pool, err := b.load(options, now)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	defer close(inFlight.done)
+	b.loading = nil
+	b.lastCheck = now
+	if err == nil {
+		b.pool = pool
+	} else if b.pool == nil {
+		inFlight.err = err
+		return
+	}
+	inFlight.pool = b.pool
+}
+
+// get gets the CertPool for the bundle, re-checking the bundle for
+// certificates that are close to expiring periodically. Once the bundle
+// has been loaded, re-checks are done in the background, and the existing
+// CertPool is used until they finish.
+func (b *bundle) get(options *BundleOptions) (*x509.CertPool, stackerr.Error) {
+	b.lock.Lock()
+	now := time.Now()
+	if b.pool != nil && (b.loading != nil || now.Sub(b.lastCheck) < options.getCheckInterval()) {
+		pool := b.pool
+		b.lock.Unlock()
+		return pool, nil
+	}
+
+	inFlight := b.loading
+	if inFlight == nil {
+		inFlight = &bundleLoad{
+			done: make(chan struct{}),
+		}
+		b.loading = inFlight
+		if b.pool != nil {
+			pool := b.pool
+			b.lock.Unlock()
+			go b.refresh(inFlight, options, now)
+			return pool, nil
+		}
+		b.lock.Unlock()
+		b.refresh(inFlight, options, now)
+	} else {
+		b.lock.Unlock()
+	}
 
-	// hasExpired := false
-
-	// for len(pemBytes) > 0 {
-	// 	var block *pem.Block
-	// 	block, pemBytes = pem.Decode(pemBytes)
-	// 	crt, err := x509.ParseCertificate(block.Bytes)
-	// 	if err != nil {
-	// 		return stackerr.Wrap(err)
-	// 	}
-	// 	if time.Until(crt.NotAfter) < time.Hour {
-	// 		hasExpired = true
-	// 		break
-	// 	}
-	// }
-
-	// if !hasExpired {
-	// 	globalAwsRootCertPool = rootCertPool
-	// 	return nil
-	// }
-
-	// if httpClient == nil {
-	// 	httpClient = http.DefaultClient
-	// }
-	// resp, err := httpClient.Get(awsRootCertBundleUrl)
-	// if err != nil {
-	// 	return stackerr.Wrap(err)
-	// }
-	// body, err := io.ReadAll(resp.Body)
-	// resp.Body.Close()
-	// if err != nil {
-	// 	return stackerr.Wrap(err)
-	// }
-
-	// rootCertPool = x509.NewCertPool()
-	// if ok := rootCertPool.AppendCertsFromPEM(body); !ok {
-	// 	return stackerr.Wrap(err)
-	// }
-	// globalAwsRootCertPool = rootCertPool
-	// return nil
+	<-inFlight.done
+	return inFlight.pool, inFlight.err
 }
 
 // GetGlobalRootCertPool gets a CertPool for AWS's global certificate bundle.
 // It first attempts to load the certificate bundle that is included in this
-// package, which will allow it to function even without public internet access.
-// If any of the certificates in the included bundle have expired, or will expire
-// soon, it will attempt to load new certificates from AWS directly via HTTP.
-// It caches the CertPool for future use.
-func GetGlobalRootCertPool(httpClient *http.Client) (*x509.CertPool, stackerr.Error) {
-	globalAwsRootCertPoolOnce.Do(func() {
-		globalAwsRootCertPoolInitErr = initCertPool(httpClient)
-	})
-	if globalAwsRootCertPoolInitErr != nil {
-		return nil, globalAwsRootCertPoolInitErr
-	}
-	return globalAwsRootCertPool, nil
+// package (or a newer one that was previously downloaded and cached in the
+// options' CacheDir), which will allow it to function even without public
+// internet access. If any of the still-valid certificates in that bundle will
+// expire soon, it will attempt to download a new bundle from AWS. The CertPool
+// is cached, and the bundle is re-checked in the background every
+// CheckInterval. If the options are nil, the defaults are used.
+func GetGlobalRootCertPool(options *BundleOptions) (*x509.CertPool, stackerr.Error) {
+	return globalBundle.get(options)
 }
@@ -0,0 +1,287 @@
+package awscerts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// newTestCertificate creates a self-signed certificate with
+// the given common name and validity period.
+func newTestCertificate(t *testing.T, commonName string, notBefore time.Time, notAfter time.Time, isCa bool) (*x509.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	})
+}
+
+// serveBundle starts a server that serves the given bundle with the given
+// status, and counts the number of requests.
+func serveBundle(t *testing.T, status int, pemBytes []byte) (*httptest.Server, func() int) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		w.WriteHeader(status)
+		w.Write(pemBytes)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func TestNeedsRefresh(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	margin := 30 * 24 * time.Hour
+	expired, _ := newTestCertificate(t, "expired", now.AddDate(-2, 0, 0), now.AddDate(0, -1, 0), true)
+	expiringSoon, _ := newTestCertificate(t, "expiring soon", now.AddDate(-1, 0, 0), now.AddDate(0, 0, 10), true)
+	valid, _ := newTestCertificate(t, "valid", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+
+	for _, test := range []struct {
+		name     string
+		certs    []*x509.Certificate
+		expected bool
+	}{
+		{"valid", []*x509.Certificate{valid}, false},
+		{"expired CAs are ignored", []*x509.Certificate{expired, valid}, false},
+		{"a CA expires soon", []*x509.Certificate{valid, expiringSoon}, true},
+		{"only expired CAs", []*x509.Certificate{expired}, true},
+		{"empty", nil, true},
+	} {
+		if refresh := needsRefresh(test.certs, now, margin); refresh != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, refresh)
+		}
+	}
+}
+
+func TestValidateBundle(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expired, _ := newTestCertificate(t, "expired", now.AddDate(-2, 0, 0), now.AddDate(0, -1, 0), true)
+	notYetValid, _ := newTestCertificate(t, "not yet valid", now.AddDate(0, 1, 0), now.AddDate(2, 0, 0), true)
+	valid, _ := newTestCertificate(t, "valid", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+	leaf, _ := newTestCertificate(t, "leaf", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), false)
+
+	if err := validateBundle([]*x509.Certificate{expired, valid}, now); err != nil {
+		t.Errorf("expected a bundle with a valid CA to be accepted, got %v", err)
+	}
+	for name, certs := range map[string][]*x509.Certificate{
+		"empty":            nil,
+		"non-CA":           {valid, leaf},
+		"no valid CAs":     {expired, notYetValid},
+		"only expired CAs": {expired},
+	} {
+		if err := validateBundle(certs, now); err == nil {
+			t.Errorf("%s: expected the bundle to be rejected", name)
+		}
+	}
+}
+
+func TestDownloadBundle(t *testing.T) {
+	now := time.Now()
+	_, validPem := newTestCertificate(t, "valid", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+	_, leafPem := newTestCertificate(t, "leaf", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), false)
+
+	server, _ := serveBundle(t, http.StatusOK, validPem)
+	pemBytes, err := downloadBundle(http.DefaultClient, server.URL, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pemBytes) != string(validPem) {
+		t.Error("expected the downloaded bundle to be returned")
+	}
+
+	for name, server := range map[string]*httptest.Server{
+		"error status": func() *httptest.Server { s, _ := serveBundle(t, http.StatusNotFound, validPem); return s }(),
+		"non-CA":       func() *httptest.Server { s, _ := serveBundle(t, http.StatusOK, leafPem); return s }(),
+		"not PEM":      func() *httptest.Server { s, _ := serveBundle(t, http.StatusOK, []byte("<html></html>")); return s }(),
+	} {
+		if _, err := downloadBundle(http.DefaultClient, server.URL, now); err == nil {
+			t.Errorf("%s: expected the download to fail", name)
+		}
+	}
+}
+
+func TestCachedBundles(t *testing.T) {
+	now := time.Now()
+	_, validPem := newTestCertificate(t, "valid", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+	_, expiredPem := newTestCertificate(t, "expired", now.AddDate(-2, 0, 0), now.AddDate(0, -1, 0), true)
+	cacheDir := filepath.Join(t.TempDir(), "certs")
+
+	if err := writeCachedBundle(cacheDir, "test-bundle.pem", validPem); err != nil {
+		t.Fatal(err)
+	}
+	if cached := readCachedBundle(cacheDir, "test-bundle.pem", now); string(cached) != string(validPem) {
+		t.Error("expected the cached bundle to be read back")
+	}
+	// Bundles aren't cached unless a cache directory is set
+	if err := writeCachedBundle("", "test-bundle.pem", validPem); err != nil {
+		t.Fatal(err)
+	}
+	if cached := readCachedBundle("", "test-bundle.pem", now); cached != nil {
+		t.Error("expected no cached bundle without a cache directory")
+	}
+	// Cached bundles without any valid CAs are ignored
+	if err := os.WriteFile(filepath.Join(cacheDir, "expired-bundle.pem"), expiredPem, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cached := readCachedBundle(cacheDir, "expired-bundle.pem", now); cached != nil {
+		t.Error("expected a cached bundle without valid CAs to be ignored")
+	}
+}
+
+func TestBundleDownloadsAndCachesReplacements(t *testing.T) {
+	now := time.Now()
+	_, expiringPem := newTestCertificate(t, "expiring", now.AddDate(-1, 0, 0), now.AddDate(0, 0, 1), true)
+	_, validPem := newTestCertificate(t, "valid", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+	server, requests := serveBundle(t, http.StatusOK, validPem)
+	options := &BundleOptions{
+		CacheDir:        t.TempDir(),
+		GlobalBundleUrl: server.URL,
+	}
+	b := &bundle{
+		fileName: "test-bundle.pem",
+		getUrl:   globalBundle.getUrl,
+		getEmbedded: func() ([]byte, stackerr.Error) {
+			return expiringPem, nil
+		},
+	}
+
+	if _, err := b.get(options); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != 1 {
+		t.Fatalf("expected the expiring bundle to be replaced by a download, got %d requests", requests())
+	}
+	if cached := readCachedBundle(options.CacheDir, b.fileName, now); string(cached) != string(validPem) {
+		t.Error("expected the downloaded bundle to be cached")
+	}
+
+	// Once cached, the replacement is used without downloading it again
+	b = &bundle{
+		fileName:    b.fileName,
+		getUrl:      b.getUrl,
+		getEmbedded: b.getEmbedded,
+	}
+	if _, err := b.get(options); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != 1 {
+		t.Errorf("expected the cached bundle to be used, got %d requests", requests())
+	}
+}
+
+func TestBundleKeepsTheExistingPoolWhenDownloadsFail(t *testing.T) {
+	now := time.Now()
+	_, expiringPem := newTestCertificate(t, "expiring", now.AddDate(-1, 0, 0), now.AddDate(0, 0, 1), true)
+	server, requests := serveBundle(t, http.StatusInternalServerError, nil)
+	options := &BundleOptions{
+		GlobalBundleUrl: server.URL,
+	}
+
+	// The embedded bundle is used if a replacement can't be downloaded
+	b := &bundle{
+		fileName: "test-bundle.pem",
+		getUrl:   globalBundle.getUrl,
+		getEmbedded: func() ([]byte, stackerr.Error) {
+			return expiringPem, nil
+		},
+	}
+	pool, err := b.get(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool == nil || requests() != 1 {
+		t.Fatalf("expected the embedded bundle after 1 download attempt, got %d requests", requests())
+	}
+
+	// Without an embedded bundle, the previous pool is kept
+	b = &bundle{
+		fileName: "test-bundle.pem",
+		getUrl:   globalBundle.getUrl,
+		getEmbedded: func() ([]byte, stackerr.Error) {
+			return nil, nil
+		},
+		pool:      pool,
+		lastCheck: now.Add(-48 * time.Hour),
+	}
+	if refreshed, err := b.get(options); err != nil || refreshed != pool {
+		t.Fatalf("expected the previous pool while the bundle is re-checked, got %v", err)
+	}
+	// The re-check happens in the background
+	for {
+		b.lock.Lock()
+		loading := b.loading != nil
+		b.lock.Unlock()
+		if !loading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if refreshed, err := b.get(options); err != nil || refreshed != pool {
+		t.Errorf("expected the previous pool to be kept after the download failed, got %v", err)
+	}
+	if requests() != 2 {
+		t.Errorf("expected 2 download attempts, got %d", requests())
+	}
+
+	// With nothing to fall back to, the error is returned
+	b = &bundle{
+		fileName: "test-bundle.pem",
+		getUrl:   globalBundle.getUrl,
+		getEmbedded: func() ([]byte, stackerr.Error) {
+			return nil, nil
+		},
+	}
+	if _, err := b.get(options); err == nil {
+		t.Error("expected an error with no bundle to fall back to")
+	}
+}
+
+func TestGlobalRootCertPool(t *testing.T) {
+	pool, err := GetGlobalRootCertPool(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool == nil {
+		t.Error("expected a pool from the embedded bundle")
+	}
+}
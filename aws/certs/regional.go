@@ -0,0 +1,143 @@
+package awscerts
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+const (
+	// The standard AWS partition
+	PartitionAws string = "aws"
+	// The AWS GovCloud (US) partition
+	PartitionAwsUsGov string = "aws-us-gov"
+	// The AWS China partition
+	PartitionAwsCn string = "aws-cn"
+)
+
+var (
+	regionRegexp *regexp.Regexp = regexp.MustCompile(`^[a-z]{2}(?:-[a-z]+)+-[0-9]+$`)
+
+	// The URLs that region-specific bundles are downloaded from, by
+	// partition. The `%[1]s` placeholder is replaced with the region.
+	defaultRegionalBundleUrls map[string]string = map[string]string{
+		PartitionAws:      "https://truststore.pki.rds.amazonaws.com/%[1]s/%[1]s-bundle.pem",
+		PartitionAwsUsGov: "https://truststore.pki.%[1]s.rds.amazonaws.com/%[1]s/%[1]s-bundle.pem",
+		PartitionAwsCn:    "https://rds-truststore.s3.cn-north-1.amazonaws.com.cn/%[1]s/%[1]s-bundle.pem",
+	}
+
+	regionalBundlesLock sync.Mutex
+	regionalBundles     = map[string]*bundle{}
+
+	// The names of the embedded files that contain the global RDS
+	// bundle of each partition
+	partitionGlobalBundleFileNames = map[string]string{
+		PartitionAws:      globalBundleFileName,
+		PartitionAwsUsGov: usGovGlobalBundleFileName,
+		PartitionAwsCn:    cnGlobalBundleFileName,
+	}
+)
+
+// GetPartition gets the AWS partition that a region is in.
+func GetPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return PartitionAwsUsGov
+	case strings.HasPrefix(region, "cn-"):
+		return PartitionAwsCn
+	default:
+		return PartitionAws
+	}
+}
+
+// getEmbeddedRegionalBundle extracts the CAs for a specific region from the
+// embedded global bundle of the region's partition. If no bundle is embedded
+// for the partition, no CAs are returned.
+func getEmbeddedRegionalBundle(region string) ([]byte, stackerr.Error) {
+	fileName := partitionGlobalBundleFileNames[GetPartition(region)]
+	if !hasEmbeddedBundle(fileName) {
+		return nil, nil
+	}
+	globalBytes, err := readEmbeddedBundle(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return extractRegionalCas(globalBytes, region)
+}
+
+// extractRegionalCas extracts the CAs for a specific region from a global
+// bundle. If there are none, no CAs are returned.
+func extractRegionalCas(globalBytes []byte, region string) ([]byte, stackerr.Error) {
+	certs, err := parseCertificates(globalBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	regionalBytes := []byte{}
+	for _, crt := range certs {
+		// Regional CAs have the region in their common name,
+		// e.g. `Amazon RDS us-east-1 Root CA RSA2048 G1`. CAs
+		// for pre-release environments are excluded.
+		words := strings.Fields(crt.Subject.CommonName)
+		hasRegion := false
+		isPrerelease := false
+		for _, word := range words {
+			switch word {
+			case region:
+				hasRegion = true
+			case "Beta", "Preview":
+				isPrerelease = true
+			}
+		}
+		if !hasRegion || isPrerelease {
+			continue
+		}
+		regionalBytes = append(regionalBytes, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: crt.Raw,
+		})...)
+	}
+	if len(regionalBytes) == 0 {
+		return nil, nil
+	}
+	return regionalBytes, nil
+}
+
+// GetRegionalRootCertPool gets a CertPool that only trusts the RDS CAs for a
+// specific region (and, optionally, the Amazon root CAs that are used by
+// RDS Proxy). The CAs are extracted from the global bundle of the region's
+// partition that is included in this package. If that bundle isn't included,
+// or its certificates are close to expiring, the regional bundle is
+// downloaded from AWS, unless it has already been placed in the options'
+// CacheDir. Bundles are refreshed the same way as the global bundle. If the
+// options are nil, the defaults are used.
+func GetRegionalRootCertPool(region string, includeAmazonRootCas bool, options *BundleOptions) (*x509.CertPool, stackerr.Error) {
+	if !regionRegexp.MatchString(region) {
+		return nil, stackerr.Errorf("invalid AWS region '%s'", region)
+	}
+
+	key := fmt.Sprintf("%s/%t", region, includeAmazonRootCas)
+	regionalBundlesLock.Lock()
+	b, ok := regionalBundles[key]
+	if !ok {
+		b = &bundle{
+			fileName: fmt.Sprintf("%s-bundle.pem", region),
+			getUrl: func(options *BundleOptions) string {
+				return fmt.Sprintf(options.getRegionalBundleUrl(GetPartition(region)), region)
+			},
+			getEmbedded: func() ([]byte, stackerr.Error) {
+				return getEmbeddedRegionalBundle(region)
+			},
+			includeAmazonRootCas: includeAmazonRootCas,
+		}
+		regionalBundles[key] = b
+	}
+	regionalBundlesLock.Unlock()
+
+	return b.get(options)
+}
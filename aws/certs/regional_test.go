@@ -0,0 +1,119 @@
+package awscerts
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPartition(t *testing.T) {
+	for region, expected := range map[string]string{
+		"us-east-1":      PartitionAws,
+		"eu-west-2":      PartitionAws,
+		"ap-southeast-4": PartitionAws,
+		"us-gov-west-1":  PartitionAwsUsGov,
+		"us-gov-east-1":  PartitionAwsUsGov,
+		"cn-north-1":     PartitionAwsCn,
+		"cn-northwest-1": PartitionAwsCn,
+	} {
+		if partition := GetPartition(region); partition != expected {
+			t.Errorf("expected %s to be in %s, got %s", region, expected, partition)
+		}
+	}
+}
+
+func TestExtractRegionalCas(t *testing.T) {
+	now := time.Now()
+	globalBytes := []byte{}
+	for _, commonName := range []string{
+		"Amazon RDS us-east-1 Root CA RSA2048 G1",
+		"Amazon RDS us-east-1 Root CA ECC384 G1",
+		"Amazon RDS Beta us-east-1 Root CA RSA2048 G1",
+		"Amazon RDS Preview us-east-1 Root CA RSA2048 G1",
+		"Amazon RDS us-east-10 Root CA RSA2048 G1",
+		"Amazon RDS us-east-2 Root CA RSA2048 G1",
+		"Amazon RDS Root 2019 CA",
+	} {
+		_, pemBytes := newTestCertificate(t, commonName, now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+		globalBytes = append(globalBytes, pemBytes...)
+	}
+
+	regionalBytes, err := extractRegionalCas(globalBytes, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parseCertificates(regionalBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonNames := []string{}
+	for _, crt := range certs {
+		commonNames = append(commonNames, crt.Subject.CommonName)
+	}
+	if len(commonNames) != 2 || commonNames[0] != "Amazon RDS us-east-1 Root CA RSA2048 G1" || commonNames[1] != "Amazon RDS us-east-1 Root CA ECC384 G1" {
+		t.Errorf("expected only the non-prerelease us-east-1 CAs, got %v", commonNames)
+	}
+
+	if regionalBytes, err := extractRegionalCas(globalBytes, "eu-west-1"); err != nil || regionalBytes != nil {
+		t.Errorf("expected no CAs for a region that isn't in the bundle, got %d bytes (%v)", len(regionalBytes), err)
+	}
+}
+
+func TestEmbeddedRegionalBundle(t *testing.T) {
+	regionalBytes, err := getEmbeddedRegionalBundle("us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parseCertificates(regionalBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) == 0 {
+		t.Fatal("expected the us-east-1 CAs to be extracted from the embedded global bundle")
+	}
+	for _, crt := range certs {
+		if name := crt.Subject.CommonName; !strings.Contains(name, "us-east-1") || strings.Contains(name, "Beta") || strings.Contains(name, "Preview") {
+			t.Errorf("unexpected CA %s", name)
+		}
+	}
+}
+
+func TestRegionalBundlesAreDownloadedWhenNotEmbedded(t *testing.T) {
+	now := time.Now()
+	_, validPem := newTestCertificate(t, "Amazon RDS zz-test-1 Root CA RSA2048 G1", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0), true)
+	requestedPaths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPaths = append(requestedPaths, r.URL.Path)
+		w.Write(validPem)
+	}))
+	t.Cleanup(server.Close)
+
+	// The region isn't in the embedded global bundle
+	pool, err := GetRegionalRootCertPool("zz-test-1", false, &BundleOptions{
+		RegionalBundleUrls: map[string]string{
+			PartitionAws: server.URL + "/%[1]s/%[1]s-bundle.pem",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requestedPaths) != 1 || requestedPaths[0] != "/zz-test-1/zz-test-1-bundle.pem" {
+		t.Fatalf("expected the regional bundle to be downloaded, got %v", requestedPaths)
+	}
+	certs, err := parseCertificates(validPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("expected the pool to trust the downloaded CA: %v", err)
+	}
+}
+
+func TestGetRegionalRootCertPoolRejectsInvalidRegions(t *testing.T) {
+	if _, err := GetRegionalRootCertPool("../../etc", false, nil); err == nil {
+		t.Error("expected an invalid region to be rejected")
+	}
+}
@@ -0,0 +1,30 @@
+package gormauthaws
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Matches RDS and RDS Proxy host names in all partitions, e.g.
+	// `mycluster.cluster-123456789012.us-east-1.rds.amazonaws.com`,
+	// `reader.endpoint.proxy-123456789012.us-gov-west-1.rds.amazonaws.com`
+	// or `mydb.123456789012.cn-north-1.rds.amazonaws.com.cn`.
+	rdsHostRegionRegexp *regexp.Regexp = regexp.MustCompile(`^[^.]+(?:\.[^.]+)*\.([a-z]{2}(?:-[a-z]+)+-[0-9]+)\.rds\.amazonaws\.com(?:\.cn)?$`)
+)
+
+// GetRdsRegion attempts to parse the AWS region out of an RDS or RDS
+// Proxy host name. It returns an empty string if the host name is
+// not a recognized RDS host name.
+func GetRdsRegion(host string) string {
+	regionMatches := rdsHostRegionRegexp.FindStringSubmatch(strings.ToLower(host))
+	if len(regionMatches) > 1 {
+		return regionMatches[1]
+	}
+	return ""
+}
+
+// IsRdsProxyHost determines whether a host name is an RDS Proxy endpoint.
+func IsRdsProxyHost(host string) bool {
+	return GetRdsRegion(host) != "" && strings.Contains(strings.ToLower(host), ".proxy-")
+}
@@ -0,0 +1,304 @@
+package awssecretsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+const (
+	// The staging label of the current version of a secret
+	StageCurrent string = "AWSCURRENT"
+	// The staging label of a new version of a secret that
+	// is in the process of being rotated in
+	StagePending string = "AWSPENDING"
+	// The staging label of the previous version of a secret
+	StagePrevious string = "AWSPREVIOUS"
+
+	// The default minimum duration between checks for new secret versions
+	defaultVersionCheckInterval time.Duration = time.Minute
+)
+
+// The order in which secret versions are tried when the credentials
+// in a version fail authentication.
+var fallbackStages = []string{StageCurrent, StagePending, StagePrevious}
+
+// RdsSecret is the standard JSON structure of a secret
+// that Secrets Manager manages for an RDS database.
+type RdsSecret struct {
+	Engine               string `json:"engine"`
+	Host                 string `json:"host"`
+	Port                 int    `json:"port"`
+	Username             string `json:"username"`
+	Password             string `json:"password"`
+	DbName               string `json:"dbname"`
+	DbInstanceIdentifier string `json:"dbInstanceIdentifier,omitempty"`
+	DbClusterIdentifier  string `json:"dbClusterIdentifier,omitempty"`
+}
+
+// SecretsManagerClient is the subset of the Secrets Manager API that is used
+// by the CredentialsProvider. It is satisfied by *secretsmanager.Client.
+type SecretsManagerClient interface {
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// CredentialsProvider loads database credentials from an RDS secret in
+// AWS Secrets Manager. Secret values are cached by version ID, so the
+// secret value is only retrieved again when a new version is staged.
+//
+// If credentials fail authentication (e.g. part-way through a rotation),
+// the provider falls back to the AWSPENDING and AWSPREVIOUS versions of
+// the secret, until the AWSCURRENT version changes.
+type CredentialsProvider struct {
+	// The ID or ARN of the secret
+	SecretId string
+	// OPTIONAL: The Secrets Manager client to use. If not provided, a
+	// client is created using the default AWS config. To use a local
+	// stand-in for the Secrets Manager API, provide a client with a
+	// custom endpoint resolver.
+	Client SecretsManagerClient
+	// OPTIONAL: The minimum duration between checks for new versions
+	// of the secret. Defaults to 1 minute. Checks are always made
+	// immediately after credentials fail authentication.
+	VersionCheckInterval time.Duration
+	// OPTIONAL: The clock to use for timing version checks. If not
+	// provided, the system clock is used.
+	Clock connectors.Clock
+
+	lock             sync.Mutex
+	secretsByVersion map[string]*RdsSecret
+	stageVersions    map[string]string
+	lastVersionCheck time.Time
+	activeStage      string
+}
+
+// NewCredentialsProvider creates a new CredentialsProvider for the given secret.
+// If the client is nil, one is created using the default AWS config.
+func NewCredentialsProvider(secretId string, client SecretsManagerClient) *CredentialsProvider {
+	return &CredentialsProvider{
+		SecretId: secretId,
+		Client:   client,
+	}
+}
+
+func (p *CredentialsProvider) getClient(ctx context.Context) (SecretsManagerClient, stackerr.Error) {
+	if p.Client == nil {
+		defaultAwsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		p.Client = secretsmanager.NewFromConfig(defaultAwsConfig)
+	}
+	return p.Client, nil
+}
+
+func (p *CredentialsProvider) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock.Now()
+	}
+	return time.Now()
+}
+
+// refreshVersions checks which versions of the secret are staged, if
+// it's been long enough since the last check or if `force` is true.
+// The lock must be held.
+func (p *CredentialsProvider) refreshVersions(ctx context.Context, force bool) stackerr.Error {
+	interval := p.VersionCheckInterval
+	if interval <= 0 {
+		interval = defaultVersionCheckInterval
+	}
+	now := p.now()
+	if !force && p.stageVersions != nil && now.Sub(p.lastVersionCheck) < interval {
+		return nil
+	}
+
+	client, err := p.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	output, cerr := client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(p.SecretId),
+	})
+	if cerr != nil {
+		return stackerr.Wrap(cerr)
+	}
+
+	stageVersions := map[string]string{}
+	for versionId, stages := range output.VersionIdsToStages {
+		for _, stage := range stages {
+			stageVersions[stage] = versionId
+		}
+	}
+	if stageVersions[StageCurrent] == "" {
+		return stackerr.Errorf("secret '%s' has no %s version", p.SecretId, StageCurrent)
+	}
+
+	// If the current version has changed, any fallback is no longer needed
+	if p.stageVersions == nil || stageVersions[StageCurrent] != p.stageVersions[StageCurrent] {
+		p.activeStage = StageCurrent
+	}
+
+	// Discard any cached values for versions that are no longer staged
+	for versionId := range p.secretsByVersion {
+		if _, ok := output.VersionIdsToStages[versionId]; !ok {
+			delete(p.secretsByVersion, versionId)
+		}
+	}
+
+	p.stageVersions = stageVersions
+	p.lastVersionCheck = now
+	return nil
+}
+
+// activeVersion gets the version ID of the secret that should currently be
+// used. The lock must be held.
+func (p *CredentialsProvider) activeVersion() string {
+	if versionId, ok := p.stageVersions[p.activeStage]; ok {
+		return versionId
+	}
+	// The stage we were using is no longer staged
+	p.activeStage = StageCurrent
+	return p.stageVersions[StageCurrent]
+}
+
+// fallBack switches to the next staged version of the secret after
+// the active version failed authentication. The lock must be held.
+func (p *CredentialsProvider) fallBack(failedVersionId string) {
+	start := 0
+	for idx, stage := range fallbackStages {
+		if stage == p.activeStage {
+			start = idx
+			break
+		}
+	}
+	for offset := 1; offset < len(fallbackStages); offset++ {
+		stage := fallbackStages[(start+offset)%len(fallbackStages)]
+		if versionId, ok := p.stageVersions[stage]; ok && versionId != failedVersionId {
+			p.activeStage = stage
+			return
+		}
+	}
+}
+
+// getSecretValue gets the value of a specific version of the secret,
+// using the cached value if there is one. The lock must be held.
+func (p *CredentialsProvider) getSecretValue(ctx context.Context, versionId string) (*RdsSecret, stackerr.Error) {
+	if secret, ok := p.secretsByVersion[versionId]; ok {
+		return secret, nil
+	}
+
+	client, err := p.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, cerr := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId:  aws.String(p.SecretId),
+		VersionId: aws.String(versionId),
+	})
+	if cerr != nil {
+		return nil, stackerr.Wrap(cerr)
+	}
+	if output.SecretString == nil {
+		return nil, stackerr.Errorf("secret '%s' version '%s' does not have a string value", p.SecretId, versionId)
+	}
+
+	var secret RdsSecret
+	if err := json.Unmarshal([]byte(*output.SecretString), &secret); err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	if p.secretsByVersion == nil {
+		p.secretsByVersion = map[string]*RdsSecret{}
+	}
+	p.secretsByVersion[versionId] = &secret
+	return &secret, nil
+}
+
+// GetSecret gets the secret value that should be used for the next connection,
+// along with its version ID.
+func (p *CredentialsProvider) GetSecret(ctx context.Context) (*RdsSecret, string, stackerr.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// If the previous credentials failed authentication, check for
+	// new versions immediately and fall back to another version.
+	// The version that failed is the one that the connector was
+	// using, which may not be the active version if another
+	// connector has already fallen back. If the connector doesn't
+	// know which version it was using, assume it was the active one.
+	authFailed := connectors.IsAuthFailureRetry(ctx)
+	failedVersionId := connectors.FailedCredentialVersion(ctx)
+	if authFailed && failedVersionId == "" && p.stageVersions != nil {
+		failedVersionId = p.activeVersion()
+	}
+	if err := p.refreshVersions(ctx, authFailed); err != nil {
+		return nil, "", err
+	}
+	if authFailed && failedVersionId == p.activeVersion() {
+		p.fallBack(failedVersionId)
+	}
+
+	versionId := p.activeVersion()
+	secret, err := p.getSecretValue(ctx, versionId)
+	if err != nil {
+		return nil, "", err
+	}
+	return secret, versionId, nil
+}
+
+// GetCredentials gets the username and password that should be used for
+// the next connection. It can be used as the `GetCredentials` callback
+// for authenticators.ConnectionParametersPassword.
+func (p *CredentialsProvider) GetCredentials(ctx context.Context) (authenticators.PasswordCredentials, stackerr.Error) {
+	secret, versionId, err := p.GetSecret(ctx)
+	if err != nil {
+		return authenticators.PasswordCredentials{}, err
+	}
+	return authenticators.PasswordCredentials{
+		Username: secret.Username,
+		Password: secret.Password,
+		Version:  versionId,
+	}, nil
+}
+
+// GetVersion gets the version ID of the secret that should be used for
+// the next connection. It can be used with connectors.NewVersionChangedStrategy.
+func (p *CredentialsProvider) GetVersion(ctx context.Context) (string, stackerr.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refreshVersions(ctx, false); err != nil {
+		return "", err
+	}
+	return p.activeVersion(), nil
+}
+
+// ReconfigureStrategy creates a strategy that requests a reconfiguration
+// whenever the version of the secret that should be used changes.
+func (p *CredentialsProvider) ReconfigureStrategy() connectors.ReconfigureStrategy {
+	return connectors.NewVersionChangedStrategy(p.GetVersion)
+}
+
+// ConnectionParameters creates password authentication parameters using the
+// host, port and database name in the secret, and the credentials from this
+// provider.
+func (p *CredentialsProvider) ConnectionParameters(ctx context.Context) (*authenticators.ConnectionParametersPassword, stackerr.Error) {
+	secret, _, err := p.GetSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &authenticators.ConnectionParametersPassword{
+		Host:           secret.Host,
+		Port:           secret.Port,
+		Schema:         secret.DbName,
+		GetCredentials: p.GetCredentials,
+	}, nil
+}
@@ -0,0 +1,235 @@
+package awssecretsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// fakeSecretsManager is a local stand-in for the Secrets Manager API,
+// which serves the DescribeSecret and GetSecretValue operations.
+type fakeSecretsManager struct {
+	lock sync.Mutex
+	// The staging labels of each version of the secret
+	versionStages map[string][]string
+	// The secret value of each version of the secret
+	values map[string]RdsSecret
+	// The number of calls to each operation
+	calls map[string]int
+}
+
+func newFakeSecretsManager(t *testing.T) (*fakeSecretsManager, *secretsmanager.Client) {
+	fake := &fakeSecretsManager{
+		versionStages: map[string][]string{},
+		values:        map[string]RdsSecret{},
+		calls:         map[string]int{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := secretsmanager.New(secretsmanager.Options{
+		Region:           "us-east-1",
+		EndpointResolver: secretsmanager.EndpointResolverFromURL(server.URL),
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "SECRET",
+			}, nil
+		}),
+	})
+	return fake, client
+}
+
+func (f *fakeSecretsManager) stage(versionId string, password string, stages ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// Each staging label can only be attached to one version
+	for existingId, existingStages := range f.versionStages {
+		remaining := []string{}
+		for _, existing := range existingStages {
+			keep := true
+			for _, stage := range stages {
+				if existing == stage {
+					keep = false
+				}
+			}
+			if keep {
+				remaining = append(remaining, existing)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(f.versionStages, existingId)
+		} else {
+			f.versionStages[existingId] = remaining
+		}
+	}
+	f.versionStages[versionId] = stages
+	f.values[versionId] = RdsSecret{
+		Host:     "db.example.com",
+		Port:     5432,
+		Username: "app",
+		Password: password,
+		DbName:   "app",
+	}
+}
+
+func (f *fakeSecretsManager) getCalls(operation string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[operation]
+}
+
+func (f *fakeSecretsManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SecretId  string
+		VersionId string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var output any
+	switch target := r.Header.Get("X-Amz-Target"); target {
+	case "secretsmanager.DescribeSecret":
+		f.calls["DescribeSecret"]++
+		output = map[string]any{
+			"Name":               input.SecretId,
+			"VersionIdsToStages": f.versionStages,
+		}
+	case "secretsmanager.GetSecretValue":
+		f.calls["GetSecretValue"]++
+		value, ok := f.values[input.VersionId]
+		if !ok {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "ResourceNotFoundException",
+				"message": "version not found",
+			})
+			return
+		}
+		secretString, _ := json.Marshal(value)
+		output = map[string]any{
+			"Name":         input.SecretId,
+			"VersionId":    input.VersionId,
+			"SecretString": string(secretString),
+		}
+	default:
+		http.Error(w, "unknown operation "+target, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(output)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func getSecret(t *testing.T, ctx context.Context, provider *CredentialsProvider) (string, string) {
+	t.Helper()
+	secret, versionId, err := provider.GetSecret(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret.Password, versionId
+}
+
+func TestCredentialsProviderCachesVersions(t *testing.T) {
+	fake, client := newFakeSecretsManager(t)
+	fake.stage("v1", "password-1", StageCurrent)
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	provider := NewCredentialsProvider("db-secret", client)
+	provider.Clock = clock
+
+	for i := 0; i < 3; i++ {
+		if password, versionId := getSecret(t, context.Background(), provider); password != "password-1" || versionId != "v1" {
+			t.Fatalf("expected password-1 from v1, got %s from %s", password, versionId)
+		}
+	}
+	if calls := fake.getCalls("DescribeSecret"); calls != 1 {
+		t.Errorf("expected 1 DescribeSecret call within the version check interval, got %d", calls)
+	}
+	if calls := fake.getCalls("GetSecretValue"); calls != 1 {
+		t.Errorf("expected 1 GetSecretValue call for a single version, got %d", calls)
+	}
+
+	// A rotation is only noticed after the version check interval
+	fake.stage("v2", "password-2", StageCurrent)
+	if _, versionId := getSecret(t, context.Background(), provider); versionId != "v1" {
+		t.Errorf("expected v1 before the version check interval has passed, got %s", versionId)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if password, versionId := getSecret(t, context.Background(), provider); password != "password-2" || versionId != "v2" {
+		t.Errorf("expected password-2 from v2 after the version check interval, got %s from %s", password, versionId)
+	}
+}
+
+func TestCredentialsProviderFallsBackFromTheFailedVersion(t *testing.T) {
+	fake, client := newFakeSecretsManager(t)
+	fake.stage("v0", "password-0", StagePrevious)
+	fake.stage("v1", "password-1", StageCurrent)
+	fake.stage("v2", "password-2", StagePending)
+	provider := NewCredentialsProvider("db-secret", client)
+
+	// The writer and reader connectors both get the current version
+	if _, versionId := getSecret(t, context.Background(), provider); versionId != "v1" {
+		t.Fatalf("expected v1, got %s", versionId)
+	}
+
+	// The writer's credentials fail, so it falls back to the pending version
+	retryCtx := connectors.WithAuthFailureRetry(context.Background(), "v1")
+	if password, versionId := getSecret(t, retryCtx, provider); password != "password-2" || versionId != "v2" {
+		t.Fatalf("expected a fallback to v2, got %s from %s", password, versionId)
+	}
+
+	// The reader's credentials (also v1) fail too, but the provider has
+	// already fallen back, so the pending version is kept
+	if _, versionId := getSecret(t, retryCtx, provider); versionId != "v2" {
+		t.Errorf("expected v2 to be kept after another failure of v1, got %s", versionId)
+	}
+
+	// If the pending version fails, the previous version is tried
+	retryCtx = connectors.WithAuthFailureRetry(context.Background(), "v2")
+	if password, versionId := getSecret(t, retryCtx, provider); password != "password-0" || versionId != "v0" {
+		t.Errorf("expected a fallback to v0 after v2 failed, got %s from %s", password, versionId)
+	}
+
+	// Once the rotation completes, the new current version is used
+	fake.stage("v2", "password-2", StageCurrent)
+	fake.stage("v1", "password-1", StagePrevious)
+	retryCtx = connectors.WithAuthFailureRetry(context.Background(), "v0")
+	if _, versionId := getSecret(t, retryCtx, provider); versionId != "v2" {
+		t.Errorf("expected the new current version v2 after the rotation completed, got %s", versionId)
+	}
+}
+
+func TestCredentialsProviderFallsBackWithoutAFailedVersion(t *testing.T) {
+	fake, client := newFakeSecretsManager(t)
+	fake.stage("v1", "password-1", StageCurrent)
+	fake.stage("v2", "password-2", StagePending)
+	provider := NewCredentialsProvider("db-secret", client)
+
+	if _, versionId := getSecret(t, context.Background(), provider); versionId != "v1" {
+		t.Fatalf("expected v1, got %s", versionId)
+	}
+	// If the failed version isn't known, the active version is assumed to have failed
+	retryCtx := connectors.WithAuthFailureRetry(context.Background(), "")
+	if _, versionId := getSecret(t, retryCtx, provider); versionId != "v2" {
+		t.Errorf("expected a fallback to v2, got %s", versionId)
+	}
+}
@@ -0,0 +1,400 @@
+package awsssm
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const (
+	// The authentication method for username/password authentication
+	AuthMethodPassword string = "password"
+	// The authentication method for AWS RDS IAM authentication
+	AuthMethodIam string = "iam"
+
+	// The default minimum duration between checks for new parameter versions
+	defaultVersionCheckInterval time.Duration = time.Minute
+)
+
+// DatabaseParameters is the JSON structure of the database connection
+// settings stored in the SSM parameter.
+type DatabaseParameters struct {
+	// The host of the primary cluster
+	Host string `json:"host"`
+	// OPTIONAL: The host of the read-only endpoint
+	ReadOnlyHost string `json:"read_only_host"`
+	// The port to connect to
+	Port int `json:"port"`
+	// The name of the database to connect to
+	Database string `json:"database"`
+	// The name of the database to connect to, for parameters that use
+	// `schema` instead of `database`
+	Schema string `json:"schema"`
+	// The username to connect with
+	Username string `json:"username"`
+	// The password to connect with, for password authentication
+	Password string `json:"password"`
+	// OPTIONAL: The region that the database is in, for IAM authentication
+	Region string `json:"region"`
+	// OPTIONAL: The authentication method to use (`password` or `iam`). If
+	// not provided, password authentication is used if a password is
+	// provided, and IAM authentication is used otherwise.
+	AuthMethod string `json:"auth_method"`
+}
+
+// GetAuthMethod gets the authentication method that these parameters specify.
+func (params *DatabaseParameters) GetAuthMethod() string {
+	if params.AuthMethod != "" {
+		return params.AuthMethod
+	}
+	if params.Password != "" {
+		return AuthMethodPassword
+	}
+	return AuthMethodIam
+}
+
+// GetHost gets the host to connect to, either for the primary
+// cluster or for the read-only endpoint. If no read-only host is
+// set, the primary host is used for read-only connections too.
+func (params *DatabaseParameters) GetHost(readOnly bool) string {
+	if readOnly && params.ReadOnlyHost != "" {
+		return params.ReadOnlyHost
+	}
+	return params.Host
+}
+
+// GetDatabase gets the name of the database to connect to.
+func (params *DatabaseParameters) GetDatabase() string {
+	if params.Database != "" {
+		return params.Database
+	}
+	return params.Schema
+}
+
+// SsmClient is the subset of the SSM API that is used by the
+// ConfigProvider. It is satisfied by *ssm.Client.
+type SsmClient interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// ConfigProvider loads database connection settings from a SecureString
+// JSON parameter in SSM Parameter Store, and builds authenticators from
+// them. The parameter is re-read periodically, and the cached settings
+// are replaced whenever the parameter version changes.
+type ConfigProvider struct {
+	// The name or ARN of the parameter
+	ParameterName string
+	// OPTIONAL: The SSM client to use. If not provided, a client
+	// is created using the default AWS config.
+	Client SsmClient
+	// OPTIONAL: The AWS credentials to use for generating IAM
+	// authentication tokens. If not provided, the default AWS
+	// config is used.
+	AwsCredentials aws.CredentialsProvider
+	// OPTIONAL: The minimum duration between checks for new versions
+	// of the parameter. Defaults to 1 minute. Checks are always made
+	// immediately after credentials fail authentication.
+	VersionCheckInterval time.Duration
+	// OPTIONAL: The clock to use for timing version checks. If not
+	// provided, the system clock is used.
+	Clock connectors.Clock
+
+	lock             sync.Mutex
+	parameters       *DatabaseParameters
+	version          int64
+	lastVersionCheck time.Time
+}
+
+// NewConfigProvider creates a new ConfigProvider for the given parameter.
+// If the client is nil, one is created using the default AWS config.
+func NewConfigProvider(parameterName string, client SsmClient) *ConfigProvider {
+	return &ConfigProvider{
+		ParameterName: parameterName,
+		Client:        client,
+	}
+}
+
+func (p *ConfigProvider) getClient(ctx context.Context) (SsmClient, stackerr.Error) {
+	if p.Client == nil {
+		defaultAwsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		p.Client = ssm.NewFromConfig(defaultAwsConfig)
+	}
+	return p.Client, nil
+}
+
+func (p *ConfigProvider) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock.Now()
+	}
+	return time.Now()
+}
+
+// GetParameters gets the latest database connection settings, along with
+// the version of the parameter that they were loaded from.
+func (p *ConfigProvider) GetParameters(ctx context.Context) (*DatabaseParameters, string, stackerr.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	interval := p.VersionCheckInterval
+	if interval <= 0 {
+		interval = defaultVersionCheckInterval
+	}
+	now := p.now()
+	if p.parameters != nil && now.Sub(p.lastVersionCheck) < interval && !connectors.IsAuthFailureRetry(ctx) {
+		return p.parameters, strconv.FormatInt(p.version, 10), nil
+	}
+
+	client, err := p.getClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	output, cerr := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(p.ParameterName),
+		WithDecryption: aws.Bool(true),
+	})
+	if cerr != nil {
+		return nil, "", stackerr.Wrap(cerr)
+	}
+	if output.Parameter == nil || output.Parameter.Value == nil {
+		return nil, "", stackerr.Errorf("parameter '%s' has no value", p.ParameterName)
+	}
+
+	// Only parse the value if it's a new version
+	if p.parameters == nil || output.Parameter.Version != p.version {
+		var parameters DatabaseParameters
+		if err := json.Unmarshal([]byte(*output.Parameter.Value), &parameters); err != nil {
+			return nil, "", stackerr.Wrap(err)
+		}
+		p.parameters = &parameters
+		p.version = output.Parameter.Version
+	}
+	p.lastVersionCheck = now
+
+	return p.parameters, strconv.FormatInt(p.version, 10), nil
+}
+
+// GetVersion gets the latest version of the parameter. It can be used
+// with connectors.NewVersionChangedStrategy.
+func (p *ConfigProvider) GetVersion(ctx context.Context) (string, stackerr.Error) {
+	_, version, err := p.GetParameters(ctx)
+	return version, err
+}
+
+// ReconfigureStrategy creates a strategy that requests a reconfiguration
+// whenever the version of the parameter changes.
+func (p *ConfigProvider) ReconfigureStrategy() connectors.ReconfigureStrategy {
+	return connectors.NewVersionChangedStrategy(p.GetVersion)
+}
+
+// GetCredentials gets the latest username and password from the parameter. It
+// can be used as the `GetCredentials` callback for authenticators.ConnectionParametersPassword.
+func (p *ConfigProvider) GetCredentials(ctx context.Context) (authenticators.PasswordCredentials, stackerr.Error) {
+	parameters, version, err := p.GetParameters(ctx)
+	if err != nil {
+		return authenticators.PasswordCredentials{}, err
+	}
+	return authenticators.PasswordCredentials{
+		Username: parameters.Username,
+		Password: parameters.Password,
+		Version:  version,
+	}, nil
+}
+
+// ConnectionParametersPassword creates password authentication parameters
+// from the latest settings in the parameter. The username and password are
+// re-read from the parameter for each new connection configuration, so
+// rotated passwords are picked up, but the host, port and database are not.
+// Use AuthenticationSettings to pick up changes to those too.
+func (p *ConfigProvider) ConnectionParametersPassword(ctx context.Context, readOnly bool) (*authenticators.ConnectionParametersPassword, stackerr.Error) {
+	parameters, _, err := p.GetParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.newConnectionParametersPassword(parameters, readOnly), nil
+}
+
+// MysqlConnectionParametersPassword creates password authentication parameters
+// from the latest settings in the parameter.
+//
+// Deprecated: Use ConnectionParametersPassword, which works for both MySQL and
+// PostgreSQL.
+func (p *ConfigProvider) MysqlConnectionParametersPassword(ctx context.Context, readOnly bool) (*authenticators.MysqlConnectionParametersPassword, stackerr.Error) {
+	return p.ConnectionParametersPassword(ctx, readOnly)
+}
+
+func (p *ConfigProvider) newConnectionParametersPassword(parameters *DatabaseParameters, readOnly bool) *authenticators.ConnectionParametersPassword {
+	return &authenticators.ConnectionParametersPassword{
+		Host:           parameters.GetHost(readOnly),
+		Port:           parameters.Port,
+		Schema:         parameters.GetDatabase(),
+		GetCredentials: p.GetCredentials,
+	}
+}
+
+// ConnectionParametersAwsIam creates IAM authentication parameters from
+// the latest settings in the parameter. The settings are not re-read, so use
+// AuthenticationSettings to pick up changes to the parameter.
+func (p *ConfigProvider) ConnectionParametersAwsIam(ctx context.Context, readOnly bool) (*authenticators.ConnectionParametersAwsIam, stackerr.Error) {
+	parameters, _, err := p.GetParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.newConnectionParametersAwsIam(parameters, readOnly), nil
+}
+
+// MysqlConnectionParametersAwsIam creates IAM authentication parameters from
+// the latest settings in the parameter.
+//
+// Deprecated: Use ConnectionParametersAwsIam, which works for both MySQL and
+// PostgreSQL.
+func (p *ConfigProvider) MysqlConnectionParametersAwsIam(ctx context.Context, readOnly bool) (*authenticators.MysqlConnectionParametersAwsIam, stackerr.Error) {
+	return p.ConnectionParametersAwsIam(ctx, readOnly)
+}
+
+func (p *ConfigProvider) newConnectionParametersAwsIam(parameters *DatabaseParameters, readOnly bool) *authenticators.ConnectionParametersAwsIam {
+	return &authenticators.ConnectionParametersAwsIam{
+		Host:           parameters.GetHost(readOnly),
+		Port:           parameters.Port,
+		Schema:         parameters.GetDatabase(),
+		Username:       parameters.Username,
+		Region:         parameters.Region,
+		AwsCredentials: p.AwsCredentials,
+	}
+}
+
+// newAuthenticationSettings creates either password or IAM authentication
+// parameters from a version of the settings, depending on the
+// authentication method that it specifies.
+func (p *ConfigProvider) newAuthenticationSettings(parameters *DatabaseParameters, readOnly bool) (authenticators.AuthenticationSettings, stackerr.Error) {
+	switch method := parameters.GetAuthMethod(); method {
+	case AuthMethodPassword:
+		return p.newConnectionParametersPassword(parameters, readOnly), nil
+	case AuthMethodIam:
+		return p.newConnectionParametersAwsIam(parameters, readOnly), nil
+	default:
+		return nil, stackerr.Errorf("unknown authentication method '%s' in parameter '%s'", method, p.ParameterName)
+	}
+}
+
+// AuthenticationSettings creates authentication settings that use either
+// password or IAM authentication, depending on the authentication method
+// that the parameter specifies. Whenever the parameter version changes,
+// the connector is reconfigured, and the settings are re-created from the
+// new version, so that changes to the host, port, database, username,
+// region and authentication method are picked up by new connections.
+func (p *ConfigProvider) AuthenticationSettings(ctx context.Context, readOnly bool) (authenticators.AuthenticationSettings, stackerr.Error) {
+	s := &authenticationSettings{
+		provider: p,
+		readOnly: readOnly,
+	}
+	if _, err := s.resolve(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// authenticationSettings are the authentication settings of a ConfigProvider,
+// which are re-created whenever the parameter version changes.
+type authenticationSettings struct {
+	provider *ConfigProvider
+	readOnly bool
+
+	lock sync.Mutex
+	// The parameter version that the current settings were created from
+	version string
+	// The current settings
+	settings authenticators.AuthenticationSettings
+}
+
+// resolve gets the settings for the latest version of the parameter,
+// re-creating them if the version has changed.
+func (s *authenticationSettings) resolve(ctx context.Context) (authenticators.AuthenticationSettings, stackerr.Error) {
+	parameters, version, err := s.provider.GetParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.settings == nil || version != s.version {
+		settings, err := s.provider.newAuthenticationSettings(parameters, s.readOnly)
+		if err != nil {
+			return nil, err
+		}
+		s.settings = settings
+		s.version = version
+	}
+	return s.settings, nil
+}
+
+func (s *authenticationSettings) GetConnectionCredentials(ctx context.Context) (*authenticators.Credentials, stackerr.Error) {
+	settings, err := s.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return settings.GetConnectionCredentials(ctx)
+}
+
+func (s *authenticationSettings) UpdateDialectorSettings(dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
+	s.lock.Lock()
+	lastVersion := s.version
+	s.lock.Unlock()
+
+	// Each dialector tracks the version that it last saw separately, and
+	// keeps the reconfigure callback that the current settings would set
+	var lock sync.Mutex
+	var settings authenticators.AuthenticationSettings
+	var shouldReconfigure connectors.ShouldReconfigureCallback
+	dialectorInput.ShouldReconfigureCallback = func(ctx context.Context) (bool, stackerr.Error) {
+		current, err := s.resolve(ctx)
+		if err != nil {
+			return false, err
+		}
+		s.lock.Lock()
+		version := s.version
+		s.lock.Unlock()
+
+		lock.Lock()
+		defer lock.Unlock()
+		if version != lastVersion {
+			lastVersion = version
+			// The callback of the new settings is set up once the
+			// connector has been reconfigured with them
+			settings = nil
+			return true, nil
+		}
+		if current != settings {
+			input, err := current.UpdateDialectorSettings(dialectors.DialectorInput{})
+			if err != nil {
+				return false, err
+			}
+			settings = current
+			shouldReconfigure = input.ShouldReconfigureCallback
+			// Let the new callback see the state that the connector was
+			// configured with, so that it only requests reconfigurations
+			// for later changes (e.g. a replaced token)
+			if shouldReconfigure != nil {
+				if _, err := shouldReconfigure(ctx); err != nil {
+					return false, err
+				}
+			}
+		}
+		if shouldReconfigure != nil {
+			return shouldReconfigure(ctx)
+		}
+		return false, nil
+	}
+	return dialectorInput, nil
+}
@@ -0,0 +1,171 @@
+package awsssm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+var testAwsCredentials = aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+	return aws.Credentials{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+	}, nil
+})
+
+// fakeSsm is a local stand-in for the SSM API, which
+// serves the GetParameter operation for a single parameter.
+type fakeSsm struct {
+	lock    sync.Mutex
+	value   DatabaseParameters
+	version int64
+}
+
+func newFakeSsm(t *testing.T) (*fakeSsm, *ssm.Client) {
+	fake := &fakeSsm{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := ssm.New(ssm.Options{
+		Region:           "us-east-1",
+		EndpointResolver: ssm.EndpointResolverFromURL(server.URL),
+		Credentials:      testAwsCredentials,
+	})
+	return fake, client
+}
+
+func (f *fakeSsm) put(value DatabaseParameters) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.value = value
+	f.version++
+}
+
+func (f *fakeSsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if target := r.Header.Get("X-Amz-Target"); target != "AmazonSSM.GetParameter" {
+		http.Error(w, "unknown operation "+target, http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	value, _ := json.Marshal(f.value)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(map[string]any{
+		"Parameter": map[string]any{
+			"Name":    input.Name,
+			"Type":    "SecureString",
+			"Value":   string(value),
+			"Version": f.version,
+		},
+	})
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func getConnectionCredentials(t *testing.T, authSettings authenticators.AuthenticationSettings) *authenticators.Credentials {
+	t.Helper()
+	creds, err := authSettings.GetConnectionCredentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func TestAuthenticationSettingsReResolveNewVersions(t *testing.T) {
+	fake, client := newFakeSsm(t)
+	fake.put(DatabaseParameters{
+		Host:     "db-1.abc.us-east-1.rds.amazonaws.com",
+		Port:     3306,
+		Database: "app",
+		Username: "iam-user-1",
+		Region:   "us-east-1",
+	})
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	provider := NewConfigProvider("/db/config", client)
+	provider.AwsCredentials = testAwsCredentials
+	provider.Clock = clock
+
+	authSettings, err := provider.AuthenticationSettings(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialectorInput, err := authSettings.UpdateDialectorSettings(dialectors.DialectorInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shouldReconfigure := func() bool {
+		t.Helper()
+		reconfigure, err := dialectorInput.ShouldReconfigureCallback(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reconfigure
+	}
+
+	creds := getConnectionCredentials(t, authSettings)
+	if creds.Host != "db-1.abc.us-east-1.rds.amazonaws.com" || creds.Username != "iam-user-1" || !creds.RequireCleartextPassword || creds.Secret == "" {
+		t.Fatalf("expected IAM credentials for the first host and username, got %s", creds)
+	}
+	if shouldReconfigure() {
+		t.Error("expected no reconfiguration before the parameter changed")
+	}
+
+	// The host, database, username and region all change
+	fake.put(DatabaseParameters{
+		Host:     "db-2.abc.us-west-2.rds.amazonaws.com",
+		Port:     3307,
+		Database: "app2",
+		Username: "iam-user-2",
+		Region:   "us-west-2",
+	})
+	clock.now = clock.now.Add(time.Minute)
+	if !shouldReconfigure() {
+		t.Fatal("expected a reconfiguration after the parameter version changed")
+	}
+	creds = getConnectionCredentials(t, authSettings)
+	if creds.Host != "db-2.abc.us-west-2.rds.amazonaws.com" || creds.Port != 3307 || creds.Database != "app2" || creds.Username != "iam-user-2" {
+		t.Errorf("expected IAM credentials for the new settings, got %s", creds)
+	}
+	if shouldReconfigure() {
+		t.Error("expected no further reconfiguration for the same version")
+	}
+
+	// The authentication method changes to password authentication
+	fake.put(DatabaseParameters{
+		Host:     "db-2.abc.us-west-2.rds.amazonaws.com",
+		Port:     3307,
+		Database: "app2",
+		Username: "password-user",
+		Password: "password",
+	})
+	clock.now = clock.now.Add(time.Minute)
+	if !shouldReconfigure() {
+		t.Fatal("expected a reconfiguration after the authentication method changed")
+	}
+	creds = getConnectionCredentials(t, authSettings)
+	if creds.Username != "password-user" || creds.Secret != "password" || creds.RequireCleartextPassword {
+		t.Errorf("expected password credentials, got %s", creds)
+	}
+}
@@ -11,12 +11,49 @@ import (
 // GetTlsConfig will get a *tls.Config that trusts the AWS Root CAs
 // for the given host.
 func GetTlsConfig(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
-	rootCaPool, err := awscerts.GetGlobalRootCertPool(nil)
-	if err != nil {
-		return nil, stackerr.Wrap(err)
+	return NewGetTlsConfigFunc(nil)(ctx, host)
+}
+
+// NewGetTlsConfigFunc creates a function like GetTlsConfig, which loads and
+// refreshes the AWS Root CAs with the given options (e.g. to cache downloaded
+// bundles on disk).
+func NewGetTlsConfigFunc(options *awscerts.BundleOptions) func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+	return func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		rootCaPool, err := awscerts.GetGlobalRootCertPool(options)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		return &tls.Config{
+			RootCAs:    rootCaPool,
+			ServerName: host,
+		}, nil
+	}
+}
+
+// GetRegionalTlsConfig will get a *tls.Config that only trusts the RDS CAs
+// for the region (and partition) that the given host is in. If the host is
+// an RDS Proxy endpoint, the Amazon root CAs are trusted as well, since
+// RDS Proxy uses certificates that are signed by them.
+func GetRegionalTlsConfig(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+	return NewGetRegionalTlsConfigFunc(nil)(ctx, host)
+}
+
+// NewGetRegionalTlsConfigFunc creates a function like GetRegionalTlsConfig,
+// which loads and refreshes the regional CAs with the given options (e.g. to
+// cache downloaded bundles on disk).
+func NewGetRegionalTlsConfigFunc(options *awscerts.BundleOptions) func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+	return func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		region := GetRdsRegion(host)
+		if region == "" {
+			return nil, stackerr.Errorf("could not determine the AWS region from the host name (%s)", host)
+		}
+		rootCaPool, err := awscerts.GetRegionalRootCertPool(region, IsRdsProxyHost(host), options)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			RootCAs:    rootCaPool,
+			ServerName: host,
+		}, nil
 	}
-	return &tls.Config{
-		RootCAs:    rootCaPool,
-		ServerName: host,
-	}, nil
 }
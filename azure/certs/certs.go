@@ -0,0 +1,51 @@
+package azurecerts
+
+import (
+	"crypto/x509"
+	"embed"
+	"fmt"
+	"sync"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// The root CAs that Azure Database for MySQL and PostgreSQL flexible
+// server certificates chain to. Azure is migrating between these roots,
+// so all of them are trusted.
+//
+//go:embed bundles/*
+var azureCertBundles embed.FS
+
+var (
+	rootCertPoolLock sync.Mutex
+	rootCertPool     *x509.CertPool
+)
+
+// GetRootCertPool gets a CertPool that trusts the DigiCert and Microsoft
+// root CAs that are used by Azure Database for MySQL and PostgreSQL. The
+// CAs are included in this package, so no internet access is required.
+func GetRootCertPool() (*x509.CertPool, stackerr.Error) {
+	rootCertPoolLock.Lock()
+	defer rootCertPoolLock.Unlock()
+
+	if rootCertPool != nil {
+		return rootCertPool, nil
+	}
+
+	entries, err := azureCertBundles.ReadDir("bundles")
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	pool := x509.NewCertPool()
+	for _, entry := range entries {
+		pemBytes, err := azureCertBundles.ReadFile(fmt.Sprintf("bundles/%s", entry.Name()))
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		if ok := pool.AppendCertsFromPEM(pemBytes); !ok {
+			return nil, stackerr.Errorf("failed to parse PEM bundle %s", entry.Name())
+		}
+	}
+	rootCertPool = pool
+	return rootCertPool, nil
+}
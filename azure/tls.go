@@ -0,0 +1,24 @@
+package gormauthazure
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	azurecerts "github.com/Invicton-Labs/gorm-auth/azure/certs"
+)
+
+// GetTlsConfig will get a *tls.Config that trusts the Azure Database
+// root CAs for the given host.
+func GetTlsConfig(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+	rootCaPool, err := azurecerts.GetRootCertPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		RootCAs:    rootCaPool,
+		ServerName: host,
+		// Azure Database flexible servers require TLS 1.2 or later
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
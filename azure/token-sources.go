@@ -0,0 +1,278 @@
+package gormauthazure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+const (
+	// The scope of access tokens for Azure Database for MySQL and
+	// PostgreSQL in the Azure public cloud
+	DefaultDatabaseScope string = "https://ossrdbms-aad.database.windows.net/.default"
+
+	// The default endpoint of the Azure Instance Metadata Service (IMDS)
+	// managed identity token API
+	DefaultImdsEndpoint string = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// The IMDS API version to use
+	imdsApiVersion string = "2018-02-01"
+	// The default Entra ID authority host for the Azure public cloud
+	DefaultAuthorityHost string = "https://login.microsoftonline.com/"
+
+	// The environment variables that are set by Azure Workload Identity
+	envTenantId           string = "AZURE_TENANT_ID"
+	envClientId           string = "AZURE_CLIENT_ID"
+	envFederatedTokenFile string = "AZURE_FEDERATED_TOKEN_FILE"
+	envAuthorityHost      string = "AZURE_AUTHORITY_HOST"
+
+	// The timeout for token requests, if no HTTP client is provided
+	defaultRequestTimeout time.Duration = 30 * time.Second
+)
+
+// An Entra ID access token
+type AccessToken struct {
+	// The token itself, which is used as the database password
+	Token string
+	// When the token expires
+	ExpiresAt time.Time
+}
+
+// TokenSource gets Entra ID access tokens. Implementations don't need to
+// cache tokens, since the authenticator caches them until shortly before
+// they expire.
+type TokenSource interface {
+	// GetToken gets a new access token for the given scope
+	GetToken(ctx context.Context, scope string) (AccessToken, stackerr.Error)
+}
+
+// flexibleInt is an integer that may be encoded in JSON as either a
+// number or a string, since IMDS encodes numbers as strings.
+type flexibleInt int64
+
+func (i *flexibleInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = flexibleInt(v)
+	return nil
+}
+
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   flexibleInt `json:"expires_in"`
+	ExpiresOn   flexibleInt `json:"expires_on"`
+	// Error details, which are returned instead of a token on failure
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// requestToken sends a token request and parses the response.
+func requestToken(httpClient *http.Client, req *http.Request) (AccessToken, stackerr.Error) {
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: defaultRequestTimeout,
+		}
+	}
+	requested := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return AccessToken{}, stackerr.Wrap(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return AccessToken{}, stackerr.Wrap(err)
+	}
+
+	var tokenResp tokenResponse
+	jsonErr := json.Unmarshal(body, &tokenResp)
+	if resp.StatusCode != http.StatusOK {
+		// Only the error code and description are included, since the
+		// rest of the response isn't guaranteed to be free of secrets
+		return AccessToken{}, stackerr.Errorf("token request to %s failed with status %d: %s %s", req.URL.Host, resp.StatusCode, tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if jsonErr != nil {
+		return AccessToken{}, stackerr.Wrap(jsonErr)
+	}
+	if tokenResp.AccessToken == "" {
+		return AccessToken{}, stackerr.Errorf("token response from %s did not include an access token", req.URL.Host)
+	}
+
+	token := AccessToken{
+		Token: tokenResp.AccessToken,
+	}
+	if tokenResp.ExpiresOn > 0 {
+		token.ExpiresAt = time.Unix(int64(tokenResp.ExpiresOn), 0)
+	} else if tokenResp.ExpiresIn > 0 {
+		token.ExpiresAt = requested.Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	} else {
+		return AccessToken{}, stackerr.Errorf("token response from %s did not include an expiry", req.URL.Host)
+	}
+	return token, nil
+}
+
+// scopeToResource converts a scope (e.g. `https://example.com/.default`)
+// into a resource (e.g. `https://example.com`), for APIs that use resources.
+func scopeToResource(scope string) string {
+	return strings.TrimSuffix(scope, "/.default")
+}
+
+// ManagedIdentityTokenSource gets tokens for a managed identity from the
+// Azure Instance Metadata Service (IMDS), which is available on Azure VMs,
+// VM scale sets and AKS nodes.
+type ManagedIdentityTokenSource struct {
+	// OPTIONAL: The client ID of a user-assigned managed identity. If not
+	// provided, the system-assigned managed identity is used.
+	ClientId string
+	// OPTIONAL: The IMDS token endpoint. Defaults to DefaultImdsEndpoint,
+	// but can be replaced with a local stand-in for testing.
+	Endpoint string
+	// OPTIONAL: The HTTP client to use for requests. If not
+	// provided, a client with a 30 second timeout is used.
+	HttpClient *http.Client
+}
+
+func (s *ManagedIdentityTokenSource) GetToken(ctx context.Context, scope string) (AccessToken, stackerr.Error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultImdsEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return AccessToken{}, stackerr.Wrap(err)
+	}
+	query := u.Query()
+	query.Set("api-version", imdsApiVersion)
+	query.Set("resource", scopeToResource(scope))
+	if s.ClientId != "" {
+		query.Set("client_id", s.ClientId)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return AccessToken{}, stackerr.Wrap(err)
+	}
+	req.Header.Set("Metadata", "true")
+	return requestToken(s.HttpClient, req)
+}
+
+// getTokenEndpoint gets the Entra ID token endpoint for a tenant.
+func getTokenEndpoint(authorityHost string, tenantId string) string {
+	if authorityHost == "" {
+		authorityHost = DefaultAuthorityHost
+	}
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimRight(authorityHost, "/"), url.PathEscape(tenantId))
+}
+
+// newTokenRequest creates a client credentials token request.
+func newTokenRequest(ctx context.Context, authorityHost string, tenantId string, form url.Values) (*http.Request, stackerr.Error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, getTokenEndpoint(authorityHost, tenantId), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// ClientSecretTokenSource gets tokens for an application (service
+// principal) using a client secret.
+type ClientSecretTokenSource struct {
+	// The ID of the Entra ID tenant
+	TenantId string
+	// The application's client ID
+	ClientId string
+	// The application's client secret
+	ClientSecret string
+	// OPTIONAL: The Entra ID authority host. Defaults to
+	// DefaultAuthorityHost (the Azure public cloud).
+	AuthorityHost string
+	// OPTIONAL: The HTTP client to use for requests. If not
+	// provided, a client with a 30 second timeout is used.
+	HttpClient *http.Client
+}
+
+func (s *ClientSecretTokenSource) GetToken(ctx context.Context, scope string) (AccessToken, stackerr.Error) {
+	req, err := newTokenRequest(ctx, s.AuthorityHost, s.TenantId, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.ClientId},
+		"client_secret": {s.ClientSecret},
+		"scope":         {scope},
+	})
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return requestToken(s.HttpClient, req)
+}
+
+// WorkloadIdentityTokenSource gets tokens using Azure Workload Identity
+// (e.g. on AKS), by exchanging a federated token that is read from a file
+// for an Entra ID access token. Any fields that are not provided are read
+// from the environment variables that Workload Identity sets.
+type WorkloadIdentityTokenSource struct {
+	// OPTIONAL: The ID of the Entra ID tenant. Defaults
+	// to the AZURE_TENANT_ID environment variable.
+	TenantId string
+	// OPTIONAL: The application's client ID. Defaults
+	// to the AZURE_CLIENT_ID environment variable.
+	ClientId string
+	// OPTIONAL: The path of the federated token file. Defaults to
+	// the AZURE_FEDERATED_TOKEN_FILE environment variable. The file
+	// is read for every request, since it's rotated periodically.
+	TokenFile string
+	// OPTIONAL: The Entra ID authority host. Defaults to the
+	// AZURE_AUTHORITY_HOST environment variable, or to
+	// DefaultAuthorityHost if that isn't set.
+	AuthorityHost string
+	// OPTIONAL: The HTTP client to use for requests. If not
+	// provided, a client with a 30 second timeout is used.
+	HttpClient *http.Client
+}
+
+func valueOrEnv(value string, envName string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(envName)
+}
+
+func (s *WorkloadIdentityTokenSource) GetToken(ctx context.Context, scope string) (AccessToken, stackerr.Error) {
+	tenantId := valueOrEnv(s.TenantId, envTenantId)
+	clientId := valueOrEnv(s.ClientId, envClientId)
+	tokenFile := valueOrEnv(s.TokenFile, envFederatedTokenFile)
+	if tenantId == "" || clientId == "" || tokenFile == "" {
+		return AccessToken{}, stackerr.Errorf("workload identity requires a tenant ID, client ID and federated token file")
+	}
+
+	assertion, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return AccessToken{}, stackerr.Wrap(err)
+	}
+
+	req, serr := newTokenRequest(ctx, valueOrEnv(s.AuthorityHost, envAuthorityHost), tenantId, url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientId},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {scope},
+	})
+	if serr != nil {
+		return AccessToken{}, serr
+	}
+	return requestToken(s.HttpClient, req)
+}
@@ -0,0 +1,85 @@
+package gormauthazure
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newFakeImds creates a local stand-in for the IMDS managed identity token
+// API, which checks each request and responds with the given status and body.
+func newFakeImds(t *testing.T, check func(r *http.Request), status int, body any) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		check(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestManagedIdentityTokenSource(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Truncate(time.Second)
+	server := newFakeImds(t, func(r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/metadata/identity/oauth2/token" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Metadata") != "true" {
+			t.Error("expected the Metadata header to be set")
+		}
+		query := r.URL.Query()
+		if query.Get("api-version") != imdsApiVersion {
+			t.Errorf("expected API version %s, got %s", imdsApiVersion, query.Get("api-version"))
+		}
+		if query.Get("resource") != "https://ossrdbms-aad.database.windows.net" {
+			t.Errorf("expected the resource to be derived from the scope, got %s", query.Get("resource"))
+		}
+		if query.Get("client_id") != "client-id" {
+			t.Errorf("expected the user-assigned client ID, got %s", query.Get("client_id"))
+		}
+	}, http.StatusOK, map[string]string{
+		// IMDS encodes numbers as strings
+		"access_token": "token",
+		"expires_in":   "3599",
+		"expires_on":   strconv.FormatInt(expiresOn.Unix(), 10),
+		"token_type":   "Bearer",
+	})
+
+	source := &ManagedIdentityTokenSource{
+		ClientId: "client-id",
+		Endpoint: server.URL + "/metadata/identity/oauth2/token",
+	}
+	token, err := source.GetToken(context.Background(), DefaultDatabaseScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "token" {
+		t.Errorf("expected the access token, got %s", token.Token)
+	}
+	if !token.ExpiresAt.Equal(expiresOn) {
+		t.Errorf("expected the token to expire at %s, got %s", expiresOn, token.ExpiresAt)
+	}
+}
+
+func TestManagedIdentityTokenSourceError(t *testing.T) {
+	server := newFakeImds(t, func(r *http.Request) {
+		if r.URL.Query().Has("client_id") {
+			t.Error("expected no client ID for the system-assigned managed identity")
+		}
+	}, http.StatusBadRequest, map[string]string{
+		"error":             "invalid_request",
+		"error_description": "Identity not found",
+	})
+
+	source := &ManagedIdentityTokenSource{
+		Endpoint: server.URL,
+	}
+	if _, err := source.GetToken(context.Background(), DefaultDatabaseScope); err == nil {
+		t.Error("expected an error when IMDS rejects the request")
+	}
+}
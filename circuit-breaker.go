@@ -0,0 +1,336 @@
+package gormauth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	// The default number of consecutive failures that open a circuit
+	defaultCircuitBreakerFailureThreshold int = 5
+	// The default duration that a circuit stays open for
+	defaultCircuitBreakerCooldown time.Duration = 30 * time.Second
+	// The name of the GORM callbacks that record query results
+	circuitBreakerCallbackName string = "gormauth:circuit_breaker"
+)
+
+// The state of a circuit
+type CircuitState int
+
+const (
+	// The connection pool is used normally
+	CircuitClosed CircuitState = iota
+	// The connection pool has failed too many times, and
+	// isn't used until the cooldown has passed
+	CircuitOpen
+	// The cooldown has passed, and a single probe query is
+	// allowed to determine whether the connection pool has
+	// recovered
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// IsConnectionError returns whether an error means that a database couldn't be
+// connected to or used (e.g. it's unreachable, the connection broke, or the
+// credentials were rejected), as opposed to an error with a query itself.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// A cancelled or expired context is the caller's
+	// problem, not the database's
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	var pgConnectErr *pgconn.ConnectError
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.As(err, &netErr) ||
+		errors.As(err, &pgConnectErr) ||
+		connectors.IsMysqlAuthError(err) ||
+		connectors.IsPostgresAuthError(err)
+}
+
+// The input values for creating a CircuitBreakerPolicy
+type CircuitBreakerPolicyInput struct {
+	// OPTIONAL: The policy to use for choosing between the connection
+	// pools whose circuits aren't open (e.g. a ReplicaLagPolicy). If not
+	// provided, the StrictRoundRobin policy will be used.
+	Policy dbresolver.Policy
+	// OPTIONAL: The number of consecutive failures that open
+	// the circuit of a connection pool. Defaults to 5.
+	FailureThreshold int
+	// OPTIONAL: How long a circuit stays open before a probe
+	// query is allowed. Defaults to 30 seconds.
+	Cooldown time.Duration
+	// OPTIONAL: A function that determines whether an error counts as a
+	// failure. Defaults to IsConnectionError, so that errors with the
+	// queries themselves don't open circuits.
+	IsFailure func(err error) bool
+	// OPTIONAL: If true, reads are sent to all replicas when every
+	// replica's circuit is open, instead of falling back to the writers.
+	DisableWriterFallback bool
+	// OPTIONAL: A function that is called synchronously whenever the
+	// circuit of a connection pool changes state. It must not call
+	// the policy's methods.
+	OnStateChange func(connPool gorm.ConnPool, from CircuitState, to CircuitState)
+}
+
+type circuit struct {
+	state CircuitState
+	// The number of consecutive failures
+	failures int
+	// When the circuit was opened, or when the probe was sent
+	// if the circuit is half-open
+	changedAt time.Time
+	// Whether a probe query has been sent through the half-open circuit
+	probing bool
+}
+
+// CircuitBreakerPolicy is a DBResolver policy that wraps another policy, and
+// stops sending queries to connection pools (e.g. replicas) that are failing.
+// After a number of consecutive connection or query failures, the circuit of
+// a connection pool is opened, and it's skipped for a cooldown. After the
+// cooldown, the circuit is half-open, and a single query is sent to probe
+// whether it has recovered. If it succeeds, the circuit is closed again, and
+// if it fails, the circuit is opened for another cooldown. If every replica's
+// circuit is open, reads fall back to the writers.
+//
+// It must be used as the ReplicaPolicy of GetMysqlGormInput or
+// GetPostgresGormInput, which registers GORM callbacks for tracking the result
+// of each query. Queries in transactions aren't tracked. A policy should only
+// be used for a single GORM DB handle.
+type CircuitBreakerPolicy struct {
+	input  CircuitBreakerPolicyInput
+	policy dbresolver.Policy
+
+	lock     sync.Mutex
+	writers  []gorm.ConnPool
+	circuits map[gorm.ConnPool]*circuit
+	getNow   func() time.Time
+}
+
+// NewCircuitBreakerPolicy creates a new CircuitBreakerPolicy.
+func NewCircuitBreakerPolicy(input CircuitBreakerPolicyInput) *CircuitBreakerPolicy {
+	if input.FailureThreshold <= 0 {
+		input.FailureThreshold = defaultCircuitBreakerFailureThreshold
+	}
+	if input.Cooldown <= 0 {
+		input.Cooldown = defaultCircuitBreakerCooldown
+	}
+	if input.IsFailure == nil {
+		input.IsFailure = IsConnectionError
+	}
+	policy := input.Policy
+	if policy == nil {
+		policy = dbresolver.StrictRoundRobinPolicy()
+	}
+	return &CircuitBreakerPolicy{
+		input:    input,
+		policy:   policy,
+		circuits: map[gorm.ConnPool]*circuit{},
+		getNow:   time.Now,
+	}
+}
+
+func (p *CircuitBreakerPolicy) bindEndpoints(writers []*sql.DB, readers []*sql.DB) {
+	p.lock.Lock()
+	p.writers = make([]gorm.ConnPool, len(writers))
+	for idx, writer := range writers {
+		p.writers[idx] = writer
+	}
+	p.lock.Unlock()
+
+	// The wrapped policy may need to know about the endpoints too
+	if wrapped, ok := p.policy.(endpointAwarePolicy); ok {
+		wrapped.bindEndpoints(writers, readers)
+	}
+}
+
+// State gets the state of the circuit of a connection pool.
+func (p *CircuitBreakerPolicy) State(connPool *sql.DB) CircuitState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if c, ok := p.circuits[connPool]; ok {
+		p.updateState(connPool, c)
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// setState changes the state of a circuit. The lock must be held.
+func (p *CircuitBreakerPolicy) setState(connPool gorm.ConnPool, c *circuit, state CircuitState) {
+	from := c.state
+	c.state = state
+	c.changedAt = p.getNow()
+	c.probing = false
+	if from != state && p.input.OnStateChange != nil {
+		p.input.OnStateChange(connPool, from, state)
+	}
+}
+
+// updateState moves an open circuit to half-open once the cooldown has
+// passed. If a probe was sent through a half-open circuit but its result
+// was never recorded (e.g. because it was in a transaction), another probe
+// is allowed after the cooldown. The lock must be held.
+func (p *CircuitBreakerPolicy) updateState(connPool gorm.ConnPool, c *circuit) {
+	if p.getNow().Sub(c.changedAt) < p.input.Cooldown {
+		return
+	}
+	switch c.state {
+	case CircuitOpen:
+		p.setState(connPool, c, CircuitHalfOpen)
+	case CircuitHalfOpen:
+		if c.probing {
+			c.changedAt = p.getNow()
+			c.probing = false
+		}
+	}
+}
+
+// recordResult records the result of a query that was sent to a connection pool.
+func (p *CircuitBreakerPolicy) recordResult(connPool gorm.ConnPool, err error) {
+	failed := p.input.IsFailure(err)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	c, ok := p.circuits[connPool]
+	if !ok {
+		if !failed {
+			return
+		}
+		c = &circuit{}
+		p.circuits[connPool] = c
+	}
+
+	if !failed {
+		c.failures = 0
+		if c.state != CircuitClosed {
+			p.setState(connPool, c, CircuitClosed)
+		}
+		return
+	}
+
+	c.failures++
+	switch c.state {
+	case CircuitClosed:
+		if c.failures >= p.input.FailureThreshold {
+			p.setState(connPool, c, CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		// The probe failed, so start another cooldown
+		p.setState(connPool, c, CircuitOpen)
+	}
+}
+
+func (p *CircuitBreakerPolicy) Resolve(connPools []gorm.ConnPool) gorm.ConnPool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	candidates := make([]gorm.ConnPool, 0, len(connPools))
+	for _, connPool := range connPools {
+		c, ok := p.circuits[connPool]
+		if !ok {
+			candidates = append(candidates, connPool)
+			continue
+		}
+		p.updateState(connPool, c)
+		if c.state == CircuitClosed || (c.state == CircuitHalfOpen && !c.probing) {
+			candidates = append(candidates, connPool)
+		}
+	}
+
+	var resolved gorm.ConnPool
+	if len(candidates) > 0 {
+		resolved = p.policy.Resolve(candidates)
+	} else if !p.input.DisableWriterFallback && len(p.writers) > 0 {
+		resolved = p.policy.Resolve(p.writers)
+	} else {
+		resolved = p.policy.Resolve(connPools)
+	}
+
+	// If the query is being sent through a half-open
+	// circuit, it's the probe
+	if c, ok := p.circuits[resolved]; ok && c.state == CircuitHalfOpen {
+		c.probing = true
+		c.changedAt = p.getNow()
+	}
+	return resolved
+}
+
+// registerCallbacks registers GORM callbacks that record the
+// result of each query that was routed by the policy.
+func (p *CircuitBreakerPolicy) registerCallbacks(db *gorm.DB) error {
+	record := func(db *gorm.DB, err error) {
+		connPool := db.Statement.ConnPool
+		if preparedStmtDb, ok := connPool.(*gorm.PreparedStmtDB); ok {
+			connPool = preparedStmtDb.ConnPool
+		}
+		// Transactions aren't tracked, since their connection
+		// pool can't be matched to a connection pool that the
+		// policy routed to
+		if _, ok := connPool.(*sql.DB); !ok {
+			return
+		}
+		p.recordResult(connPool, err)
+	}
+	recordError := func(db *gorm.DB) {
+		record(db, db.Error)
+	}
+	// Single row queries don't set the error on the GORM DB handle,
+	// so it's taken from the row instead. If there's no row (e.g.
+	// for dry runs), the result is unknown, so it isn't recorded.
+	recordRowError := func(db *gorm.DB) {
+		if db.Error != nil {
+			record(db, db.Error)
+			return
+		}
+		switch dest := db.Statement.Dest.(type) {
+		case *sql.Row:
+			record(db, dest.Err())
+		case *sql.Rows:
+			record(db, nil)
+		}
+	}
+
+	callbacks := db.Callback()
+	if err := callbacks.Query().After("gorm:query").Register(circuitBreakerCallbackName, recordError); err != nil {
+		return err
+	}
+	if err := callbacks.Row().After("gorm:row").Register(circuitBreakerCallbackName, recordRowError); err != nil {
+		return err
+	}
+	if err := callbacks.Raw().After("gorm:raw").Register(circuitBreakerCallbackName, recordError); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("gorm:create").Register(circuitBreakerCallbackName, recordError); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register(circuitBreakerCallbackName, recordError); err != nil {
+		return err
+	}
+	return callbacks.Delete().After("gorm:delete").Register(circuitBreakerCallbackName, recordError)
+}
@@ -0,0 +1,156 @@
+package gormauth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// newTestCircuitBreakerPolicy creates a policy with a writer and two
+// readers, and a clock that can be advanced.
+func newTestCircuitBreakerPolicy(t *testing.T, input CircuitBreakerPolicyInput) (*CircuitBreakerPolicy, *sql.DB, []*sql.DB, func(d time.Duration)) {
+	writer := newUnusedSqlDb(t)
+	readers := []*sql.DB{newUnusedSqlDb(t), newUnusedSqlDb(t)}
+	policy := NewCircuitBreakerPolicy(input)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy.getNow = func() time.Time {
+		return now
+	}
+	policy.bindEndpoints([]*sql.DB{writer}, readers)
+	return policy, writer, readers, func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestCircuitBreakerPolicy(t *testing.T) {
+	policy, _, readers, advance := newTestCircuitBreakerPolicy(t, CircuitBreakerPolicyInput{
+		FailureThreshold: 3,
+		Cooldown:         time.Minute,
+	})
+	failing, healthy := readers[0], readers[1]
+	resolveAll := func() map[gorm.ConnPool]int {
+		resolved := map[gorm.ConnPool]int{}
+		for i := 0; i < 4; i++ {
+			resolved[policy.Resolve(connPools(readers...))]++
+		}
+		return resolved
+	}
+
+	// The circuit opens after the threshold of consecutive failures
+	for i := 0; i < 2; i++ {
+		policy.recordResult(failing, driver.ErrBadConn)
+	}
+	if state := policy.State(failing); state != CircuitClosed {
+		t.Fatalf("expected the circuit to be closed below the threshold, got %s", state)
+	}
+	policy.recordResult(failing, driver.ErrBadConn)
+	if state := policy.State(failing); state != CircuitOpen {
+		t.Fatalf("expected the circuit to open at the threshold, got %s", state)
+	}
+	if resolved := resolveAll(); resolved[failing] != 0 || resolved[healthy] != 4 {
+		t.Fatalf("expected queries to skip the open circuit, got %v", resolved)
+	}
+
+	// Once the cooldown has passed, a single probe is allowed
+	advance(59 * time.Second)
+	if state := policy.State(failing); state != CircuitOpen {
+		t.Fatalf("expected the circuit to stay open during the cooldown, got %s", state)
+	}
+	advance(time.Second)
+	if state := policy.State(failing); state != CircuitHalfOpen {
+		t.Fatalf("expected the circuit to be half-open after the cooldown, got %s", state)
+	}
+	if resolved := policy.Resolve(connPools(failing)); resolved != failing {
+		t.Fatal("expected the probe to be sent through the half-open circuit")
+	}
+	if resolved := resolveAll(); resolved[failing] != 0 {
+		t.Fatalf("expected only a single probe, got %v", resolved)
+	}
+
+	// A failed probe opens the circuit for another cooldown
+	policy.recordResult(failing, driver.ErrBadConn)
+	if state := policy.State(failing); state != CircuitOpen {
+		t.Fatalf("expected a failed probe to re-open the circuit, got %s", state)
+	}
+	advance(time.Minute)
+	if resolved := policy.Resolve(connPools(failing)); resolved != failing {
+		t.Fatal("expected another probe after the cooldown")
+	}
+
+	// A successful probe closes it
+	policy.recordResult(failing, nil)
+	if state := policy.State(failing); state != CircuitClosed {
+		t.Fatalf("expected a successful probe to close the circuit, got %s", state)
+	}
+	if resolved := resolveAll(); resolved[failing] == 0 {
+		t.Errorf("expected queries to be sent through the closed circuit, got %v", resolved)
+	}
+}
+
+func TestCircuitBreakerPolicyFallsBackToTheWriter(t *testing.T) {
+	for _, disableWriterFallback := range []bool{false, true} {
+		policy, writer, readers, _ := newTestCircuitBreakerPolicy(t, CircuitBreakerPolicyInput{
+			FailureThreshold:      1,
+			DisableWriterFallback: disableWriterFallback,
+		})
+		for _, reader := range readers {
+			policy.recordResult(reader, driver.ErrBadConn)
+		}
+		resolved := policy.Resolve(connPools(readers...))
+		if !disableWriterFallback && resolved != writer {
+			t.Error("expected reads to fall back to the writer when every circuit is open")
+		}
+		if disableWriterFallback && resolved == writer {
+			t.Error("expected reads not to fall back to the writer when the fallback is disabled")
+		}
+	}
+}
+
+func TestCircuitBreakerPolicyRecordsRowErrors(t *testing.T) {
+	writer := newFakePostgresServer(t, "writer")
+	reader := newFakePostgresServer(t, "reader")
+	policy := NewCircuitBreakerPolicy(CircuitBreakerPolicyInput{
+		FailureThreshold: 2,
+	})
+
+	db, err := GetPostgresGorm(context.Background(), GetPostgresGormInput{
+		WriteConnectionParameters: []*PostgresConnectionParameters{newFakePostgresConnectionParameters(writer, staticPasswordCredentials)},
+		ReadConnectionParameters:  []*PostgresConnectionParameters{newFakePostgresConnectionParameters(reader, staticPasswordCredentials)},
+		GormOptions:               []gorm.Option{quietGormConfig},
+		ReplicaPolicy:             policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerDb := getSqlDb(db.Config.Plugins[healthCheckPluginName].(*healthCheckPlugin).endpoints[1].dialector)
+
+	// The reader starts rejecting every connection, which only
+	// the row itself reports for single row queries
+	reader.lock.Lock()
+	reader.rejectPassword = func(password string) bool {
+		return true
+	}
+	reader.lock.Unlock()
+	for i := 0; i < 2; i++ {
+		var name string
+		if err := db.Raw("SELECT name FROM servers").Row().Scan(&name); err == nil {
+			t.Fatal("expected the reader to fail")
+		}
+	}
+	if state := policy.State(readerDb); state != CircuitOpen {
+		t.Fatalf("expected the reader's circuit to be open, got %s", state)
+	}
+
+	// Reads now fall back to the writer
+	var name string
+	if err := db.Raw("SELECT name FROM servers").Row().Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "writer" {
+		t.Errorf("expected the read to fall back to the writer, got %s", name)
+	}
+}
@@ -0,0 +1,137 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// A function signature for a callback function that gets the client
+// certificate to present for mutual TLS authentication. It is called
+// for every TLS handshake, so it should cache the certificate if
+// loading it is expensive.
+type GetClientCertificateCallback func(ctx context.Context) (*tls.Certificate, stackerr.Error)
+
+// ClientCertificateFiles loads a client certificate and private key from
+// PEM-encoded files. The files are checked for changes on each TLS
+// handshake, and are reloaded if they have been modified, so certificates
+// that are rotated on disk are picked up without reconfiguring anything.
+type ClientCertificateFiles struct {
+	// The path of the PEM-encoded client certificate (and,
+	// optionally, any intermediate certificates)
+	CertFile string
+	// The path of the PEM-encoded private key
+	KeyFile string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// GetClientCertificate gets the client certificate, reloading it if either
+// file has changed since it was last loaded. If a reload fails (e.g. because
+// the certificate has been replaced but the key has not been yet), the
+// previously loaded certificate continues to be used.
+func (f *ClientCertificateFiles) GetClientCertificate(ctx context.Context) (*tls.Certificate, stackerr.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	certInfo, err := os.Stat(f.CertFile)
+	if err != nil {
+		if f.certificate != nil {
+			return f.certificate, nil
+		}
+		return nil, stackerr.Wrap(err)
+	}
+	keyInfo, err := os.Stat(f.KeyFile)
+	if err != nil {
+		if f.certificate != nil {
+			return f.certificate, nil
+		}
+		return nil, stackerr.Wrap(err)
+	}
+
+	if f.certificate != nil && certInfo.ModTime().Equal(f.certModTime) && keyInfo.ModTime().Equal(f.keyModTime) {
+		return f.certificate, nil
+	}
+
+	certificate, serr := loadClientCertificate(f.CertFile, f.KeyFile)
+	if serr != nil {
+		if f.certificate != nil {
+			return f.certificate, nil
+		}
+		return nil, serr
+	}
+	f.certificate = certificate
+	f.certModTime = certInfo.ModTime()
+	f.keyModTime = keyInfo.ModTime()
+	return f.certificate, nil
+}
+
+// loadClientCertificate loads a certificate and key pair from files.
+func loadClientCertificate(certFile string, keyFile string) (*tls.Certificate, stackerr.Error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	// Parse the leaf certificate now, so that it doesn't
+	// need to be parsed again for every handshake
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return &certificate, nil
+}
+
+// WithClientCertificate returns a copy of the given TLS config that presents
+// the client certificate returned by the callback whenever the server
+// requests one. If the TLS config is nil, a new one is created.
+func WithClientCertificate(tlsConfig *tls.Config, getClientCertificate GetClientCertificateCallback) *tls.Config {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		ctx := info.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		certificate, err := getClientCertificate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return certificate, nil
+	}
+	return tlsConfig
+}
+
+// WrapTlsConfigCallbackWithClientCertificate wraps a GetTlsConfigCallback so
+// that the TLS configs it returns present the client certificate returned by
+// getClientCertificate, for databases that require x509 client authentication.
+// It can be used for both MySQL and PostgreSQL connections. If the callback is
+// nil, a default TLS config that verifies the server against the system's
+// root CAs is used.
+func WrapTlsConfigCallbackWithClientCertificate(callback GetTlsConfigCallback, getClientCertificate GetClientCertificateCallback) GetTlsConfigCallback {
+	return func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		var tlsConfig *tls.Config
+		if callback != nil {
+			var err stackerr.Error
+			tlsConfig, err = callback(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			tlsConfig = &tls.Config{
+				ServerName: host,
+			}
+		}
+		return WithClientCertificate(tlsConfig, getClientCertificate), nil
+	}
+}
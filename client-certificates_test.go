@@ -0,0 +1,169 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// newTestCertificate creates a self-signed certificate with the given
+// common name, and returns the PEM-encoded certificate and private key.
+func newTestCertificate(t *testing.T, commonName string, isCa bool) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeTestFile writes a file and sets its modification time, so
+// that changes are detected regardless of the filesystem's precision.
+func writeTestFile(t *testing.T, path string, contents []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, contents, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificateFilesReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := &ClientCertificateFiles{
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	modTime := time.Now().Add(-time.Hour)
+	certPem, keyPem := newTestCertificate(t, "first", false)
+	writeTestFile(t, files.CertFile, certPem, modTime)
+	writeTestFile(t, files.KeyFile, keyPem, modTime)
+
+	first, err := files.GetClientCertificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Leaf == nil || first.Leaf.Subject.CommonName != "first" {
+		t.Fatalf("expected the first certificate, got %+v", first.Leaf)
+	}
+	if unchanged, err := files.GetClientCertificate(context.Background()); err != nil || unchanged != first {
+		t.Errorf("expected the loaded certificate to be reused while the files are unchanged, got %v", err)
+	}
+
+	// The certificate is rotated on disk
+	certPem, keyPem = newTestCertificate(t, "second", false)
+	writeTestFile(t, files.CertFile, certPem, modTime.Add(time.Minute))
+	writeTestFile(t, files.KeyFile, keyPem, modTime.Add(time.Minute))
+	second, err := files.GetClientCertificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Leaf == nil || second.Leaf.Subject.CommonName != "second" {
+		t.Errorf("expected the rotated certificate to be loaded, got %+v", second.Leaf)
+	}
+}
+
+func TestClientCertificateFilesKeepsTheCertificateWhenReloadsFail(t *testing.T) {
+	dir := t.TempDir()
+	files := &ClientCertificateFiles{
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	modTime := time.Now().Add(-time.Hour)
+	certPem, keyPem := newTestCertificate(t, "first", false)
+	writeTestFile(t, files.CertFile, certPem, modTime)
+	writeTestFile(t, files.KeyFile, keyPem, modTime)
+
+	first, err := files.GetClientCertificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate has been replaced, but the key hasn't been yet
+	certPem, _ = newTestCertificate(t, "second", false)
+	writeTestFile(t, files.CertFile, certPem, modTime.Add(time.Minute))
+	if current, err := files.GetClientCertificate(context.Background()); err != nil || current != first {
+		t.Errorf("expected the previous certificate to be kept while the key doesn't match, got %v", err)
+	}
+	// The certificate isn't valid PEM
+	writeTestFile(t, files.CertFile, []byte("not a certificate"), modTime.Add(2*time.Minute))
+	if current, err := files.GetClientCertificate(context.Background()); err != nil || current != first {
+		t.Errorf("expected the previous certificate to be kept while the certificate is invalid, got %v", err)
+	}
+
+	// Without a previous certificate, the error is returned
+	invalid := &ClientCertificateFiles{
+		CertFile: files.CertFile,
+		KeyFile:  files.KeyFile,
+	}
+	if _, err := invalid.GetClientCertificate(context.Background()); err == nil {
+		t.Error("expected an error for an invalid certificate")
+	}
+}
+
+func TestWrapTlsConfigCallbackWithClientCertificate(t *testing.T) {
+	certPem, keyPem := newTestCertificate(t, "client", false)
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	wrapped := &tls.Config{
+		ServerName: "db.example.com",
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS13,
+	}
+	callback := WrapTlsConfigCallbackWithClientCertificate(func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		return wrapped, nil
+	}, func(ctx context.Context) (*tls.Certificate, stackerr.Error) {
+		return &certificate, nil
+	})
+
+	tlsConfig, serr := callback(context.Background(), "db.example.com")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if tlsConfig == wrapped || wrapped.GetClientCertificate != nil {
+		t.Error("expected the wrapped TLS config not to be modified")
+	}
+	if tlsConfig.ServerName != wrapped.ServerName || tlsConfig.RootCAs != roots || tlsConfig.MinVersion != wrapped.MinVersion {
+		t.Errorf("expected the wrapped TLS config's settings to be kept, got %+v", tlsConfig)
+	}
+	presented, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presented != &certificate {
+		t.Error("expected the client certificate to be presented")
+	}
+}
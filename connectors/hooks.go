@@ -0,0 +1,209 @@
+package connectors
+
+import (
+	"context"
+	"time"
+)
+
+// Hooks are callbacks that are run when connector lifecycle events happen,
+// e.g. for alerting on repeated authentication failures or invalidating
+// caches when credentials rotate. All callbacks are optional, and are run
+// synchronously in the goroutine that is opening the connection, so they
+// should return quickly. They're never run while the connector is locked,
+// so they can safely use the connector (or the sql.DB that uses it).
+// Events never include credential values.
+type Hooks struct {
+	// OPTIONAL: Called after the connector has been reconfigured (i.e. a
+	// new config has been fetched), whether it succeeded or failed.
+	OnReconfigure func(ctx context.Context, event ReconfigureEvent)
+	// OPTIONAL: Called when an authenticator has fetched the credentials
+	// for a new connector config.
+	OnCredentialFetched func(ctx context.Context, event CredentialFetchedEvent)
+	// OPTIONAL: Called after a connection has been opened successfully.
+	OnConnect func(ctx context.Context, event ConnectEvent)
+	// OPTIONAL: Called after a connection attempt has failed.
+	OnConnectError func(ctx context.Context, event ConnectErrorEvent)
+	// OPTIONAL: Called when the TLS config for a host has been loaded
+	// for a new connector config.
+	OnTlsConfigLoaded func(ctx context.Context, event TlsConfigLoadedEvent)
+}
+
+// ReconfigureEvent describes a reconfiguration of a connector.
+type ReconfigureEvent struct {
+	// The role of the connector (e.g. writer or reader)
+	Role string
+	// The endpoint (host and port) of the new config. If the
+	// reconfiguration failed, this is the previous endpoint.
+	Endpoint string
+	// The endpoint of the previous config, or an empty
+	// string if this is the first configuration
+	PreviousEndpoint string
+	// Whether the reconfiguration was forced because the previous
+	// credentials failed authentication
+	AuthFailureRetry bool
+	// How long it took to get the new config
+	Duration time.Duration
+	// The error, if the reconfiguration failed
+	Err error
+}
+
+// CredentialFetchedEvent describes credentials that were fetched for a new
+// connector config. The secret itself is never included.
+type CredentialFetchedEvent struct {
+	// The role of the connector (e.g. writer or reader)
+	Role string
+	// The host that the credentials are for
+	Host string
+	// The port that the credentials are for
+	Port int
+	// The username of the credentials
+	Username string
+	// The database that the credentials are for
+	Database string
+	// The version of the credentials, if the authenticator provides one
+	Version string
+	// When the credentials expire, or the zero time if they don't
+	ExpiresAt time.Time
+}
+
+// ConnectEvent describes a connection that was opened successfully.
+type ConnectEvent struct {
+	// The role of the connector (e.g. writer or reader)
+	Role string
+	// The endpoint (host and port) that was connected to
+	Endpoint string
+	// The attempt number, starting at 1, which is greater
+	// than 1 if earlier attempts failed authentication
+	Attempt int
+	// How long it took to open the connection
+	Duration time.Duration
+}
+
+// ConnectErrorEvent describes a connection attempt that failed.
+type ConnectErrorEvent struct {
+	// The role of the connector (e.g. writer or reader)
+	Role string
+	// The endpoint (host and port) that the connection was attempted to
+	Endpoint string
+	// The attempt number, starting at 1
+	Attempt int
+	// How long the attempt took
+	Duration time.Duration
+	// Whether the error was an authentication failure
+	AuthFailure bool
+	// The error that the driver returned
+	Err error
+}
+
+// TlsConfigLoadedEvent describes a TLS config that was loaded for a host.
+type TlsConfigLoadedEvent struct {
+	// The role of the connector (e.g. writer or reader)
+	Role string
+	// The host that the TLS config is for
+	Host string
+	// The server name that certificates are verified against
+	ServerName string
+	// The minimum TLS version that the config allows
+	MinVersion uint16
+	// Whether the config presents a client certificate
+	HasClientCertificate bool
+}
+
+// WithHooks sets the lifecycle hooks for a connector.
+func WithHooks(hooks Hooks) ConnectorOption {
+	return func(c *connector) {
+		c.hooks = hooks
+	}
+}
+
+// empty returns whether none of the hooks are set.
+func (h Hooks) empty() bool {
+	return h.OnReconfigure == nil && h.OnCredentialFetched == nil && h.OnConnect == nil && h.OnConnectError == nil && h.OnTlsConfigLoaded == nil
+}
+
+type hooksContextKey struct{}
+
+type hooksContextValue struct {
+	hooks Hooks
+	role  string
+}
+
+// withHooks adds a connector's hooks to a context, so that the config
+// callbacks and authenticators can report their own events.
+func withHooks(ctx context.Context, hooks Hooks, role string) context.Context {
+	if hooks.empty() {
+		return ctx
+	}
+	return context.WithValue(ctx, hooksContextKey{}, hooksContextValue{
+		hooks: hooks,
+		role:  role,
+	})
+}
+
+func hooksFromContext(ctx context.Context) (hooksContextValue, bool) {
+	value, ok := ctx.Value(hooksContextKey{}).(hooksContextValue)
+	return value, ok
+}
+
+// NotifyCredentialFetched runs the OnCredentialFetched hook of the connector
+// that the context came from, if there is one. It's used by authenticators,
+// and the role of the connector is filled in automatically.
+func NotifyCredentialFetched(ctx context.Context, event CredentialFetchedEvent) {
+	if value, ok := hooksFromContext(ctx); ok && value.hooks.OnCredentialFetched != nil {
+		event.Role = value.role
+		runHook(ctx, func() {
+			value.hooks.OnCredentialFetched(ctx, event)
+		})
+	}
+}
+
+// NotifyTlsConfigLoaded runs the OnTlsConfigLoaded hook of the connector
+// that the context came from, if there is one. It's used by config callbacks
+// that load TLS configs, and the role of the connector is filled in
+// automatically.
+func NotifyTlsConfigLoaded(ctx context.Context, event TlsConfigLoadedEvent) {
+	if value, ok := hooksFromContext(ctx); ok && value.hooks.OnTlsConfigLoaded != nil {
+		event.Role = value.role
+		runHook(ctx, func() {
+			value.hooks.OnTlsConfigLoaded(ctx, event)
+		})
+	}
+}
+
+type pendingHooksContextKey struct{}
+
+// pendingHooks collects the hooks for events that happen while a
+// connector is locked, so that they can be run once it's unlocked.
+type pendingHooks struct {
+	hooks []func()
+}
+
+// withPendingHooks adds a value to a context that collects the
+// hooks for events, instead of them being run immediately.
+func withPendingHooks(ctx context.Context) (context.Context, *pendingHooks) {
+	pending := &pendingHooks{}
+	return context.WithValue(ctx, pendingHooksContextKey{}, pending), pending
+}
+
+// runHook runs a hook, or adds it to the pending
+// hooks if the context is collecting them.
+func runHook(ctx context.Context, hook func()) {
+	if pending, ok := ctx.Value(pendingHooksContextKey{}).(*pendingHooks); ok {
+		pending.add(hook)
+		return
+	}
+	hook()
+}
+
+func (p *pendingHooks) add(hook func()) {
+	p.hooks = append(p.hooks, hook)
+}
+
+// run runs the pending hooks, in the order that their events happened.
+func (p *pendingHooks) run() {
+	for len(p.hooks) > 0 {
+		hook := p.hooks[0]
+		p.hooks = p.hooks[1:]
+		hook()
+	}
+}
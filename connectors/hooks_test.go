@@ -0,0 +1,63 @@
+package connectors
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+func TestHooksCanUseTheConnector(t *testing.T) {
+	var c *connector
+	events := []string{}
+	hooks := Hooks{
+		// Each hook locks the connector, which would deadlock
+		// if the hooks were run while it was locked
+		OnCredentialFetched: func(ctx context.Context, event CredentialFetchedEvent) {
+			events = append(events, "credential fetched for "+event.Role+" "+c.Endpoint())
+		},
+		OnTlsConfigLoaded: func(ctx context.Context, event TlsConfigLoadedEvent) {
+			events = append(events, "TLS config loaded for "+event.Host+" "+c.Endpoint())
+		},
+		OnReconfigure: func(ctx context.Context, event ReconfigureEvent) {
+			events = append(events, "reconfigured to "+event.Endpoint+" "+c.Endpoint())
+		},
+	}
+	c = newConnector(func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
+		NotifyCredentialFetched(ctx, CredentialFetchedEvent{
+			Host: "localhost",
+		})
+		NotifyTlsConfigLoaded(ctx, TlsConfigLoadedEvent{
+			Host: "localhost",
+		})
+		return &fakeDriverConnector{}, "localhost:5432", nil
+	}, nil, nil, []ConnectorOption{WithHooks(hooks), WithRole(RoleWriter)})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The fake connector can't open connections
+		c.Connect(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hooks deadlocked")
+	}
+
+	expected := []string{
+		"credential fetched for writer localhost:5432",
+		"TLS config loaded for localhost localhost:5432",
+		"reconfigured to localhost:5432 localhost:5432",
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("expected event %d to be %q, got %q", i, expected[i], events[i])
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package connectors
+
+import (
+	"context"
+)
+
+// Logger is the interface that is used for structured logging. It is
+// satisfied by *slog.Logger. Arguments are alternating keys and values.
+// Passwords, tokens and other secrets are never included in log messages.
+type Logger interface {
+	DebugContext(ctx context.Context, msg string, args ...any)
+	InfoContext(ctx context.Context, msg string, args ...any)
+	WarnContext(ctx context.Context, msg string, args ...any)
+	ErrorContext(ctx context.Context, msg string, args ...any)
+}
+
+type noopLogger struct{}
+
+func (noopLogger) DebugContext(ctx context.Context, msg string, args ...any) {}
+func (noopLogger) InfoContext(ctx context.Context, msg string, args ...any)  {}
+func (noopLogger) WarnContext(ctx context.Context, msg string, args ...any)  {}
+func (noopLogger) ErrorContext(ctx context.Context, msg string, args ...any) {}
+
+// WithLogger enables structured logging for a connector. Reconfigurations,
+// credential fetches, TLS config loads and connection failures are logged
+// with the endpoint and role of the connector.
+func WithLogger(logger Logger) ConnectorOption {
+	return func(c *connector) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+type loggerContextKey struct{}
+
+// withLogger adds a logger to a context, so that the config
+// callbacks and authenticators can log their own events.
+func withLogger(ctx context.Context, logger Logger) context.Context {
+	if _, ok := logger.(noopLogger); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFromContext gets the logger of the connector that the context came
+// from. If logging isn't enabled for the connector, a no-op logger is returned.
+func LoggerFromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(Logger); ok {
+		return logger
+	}
+	return noopLogger{}
+}
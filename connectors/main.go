@@ -4,9 +4,12 @@ import (
 	"context"
 	"database/sql/driver"
 	"sync"
+	"time"
 
 	"github.com/Invicton-Labs/go-stackerr"
 	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/stdlib"
@@ -26,7 +29,49 @@ type connector struct {
 	reconfigureLock       sync.Mutex
 	connector             driver.Connector
 	shouldReconfigureFunc ShouldReconfigureCallback
-	getConnector          func(ctx context.Context) (driver.Connector, stackerr.Error)
+	// OPTIONAL: A strategy that is checked along with the reconfigure
+	// callback, and is told about every reconfiguration
+	reconfigureStrategy ReconfigureStrategy
+	getConnector        func(ctx context.Context) (driver.Connector, string, stackerr.Error)
+	// The endpoint (host and port) of the current connector
+	endpoint string
+	// The version of the credentials that the current connector uses,
+	// if the authenticator reported one
+	credentialVersion string
+	// The role of the connector (e.g. writer or reader), for telemetry
+	role string
+	// A function that determines whether an error returned
+	// when connecting is an authentication failure
+	isAuthError func(err error) bool
+	// The policy for retrying connections that fail authentication
+	authRetryPolicy AuthRetryPolicy
+	// OPTIONAL: The instruments for recording metrics
+	metrics *connectorMetrics
+	// OPTIONAL: The tracer for creating spans
+	tracer trace.Tracer
+	// The logger for logging events
+	logger Logger
+	// OPTIONAL: The lifecycle hooks
+	hooks Hooks
+}
+
+// A function that sets optional configuration values on a connector.
+type ConnectorOption func(c *connector)
+
+// newConnector creates a connector. The getConnector function creates a new
+// underlying connector, and returns it along with the endpoint it connects to.
+func newConnector(getConnector func(ctx context.Context) (driver.Connector, string, stackerr.Error), shouldReconfigureCallback ShouldReconfigureCallback, isAuthError func(err error) bool, options []ConnectorOption) *connector {
+	c := &connector{
+		shouldReconfigureFunc: shouldReconfigureCallback,
+		getConnector:          getConnector,
+		isAuthError:           isAuthError,
+		authRetryPolicy:       DefaultAuthRetryPolicy,
+		logger:                noopLogger{},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
 }
 
 func (c *connector) Driver() driver.Driver {
@@ -37,42 +82,207 @@ func (c *connector) Open(name string) (driver.Conn, error) {
 	return nil, stackerr.Errorf("open is not supported")
 }
 
-func (c *connector) prepareConnector(ctx context.Context) stackerr.Error {
+// Endpoint returns the endpoint (host and port) that the connector
+// currently connects to, or an empty string if it hasn't been
+// configured yet. It can be reached through the Driver method of
+// the sql.DB that uses the connector.
+func (c *connector) Endpoint() string {
+	c.reconfigureLock.Lock()
+	defer c.reconfigureLock.Unlock()
+	return c.endpoint
+}
+
+// shouldReconfigure determines whether the connector should be reconfigured
+// before the next connection, which it should be if either the callback or
+// the strategy requests it. Both are always checked, since strategies may
+// need to observe every connection.
+func (c *connector) shouldReconfigure(ctx context.Context) (bool, stackerr.Error) {
+	reconfigure := false
+	if c.shouldReconfigureFunc != nil {
+		var err stackerr.Error
+		reconfigure, err = c.shouldReconfigureFunc(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+	if c.reconfigureStrategy != nil {
+		strategyReconfigure, err := c.reconfigureStrategy.ShouldReconfigure(ctx)
+		if err != nil {
+			return false, err
+		}
+		reconfigure = reconfigure || strategyReconfigure
+	}
+	return reconfigure, nil
+}
+
+// prepareConnector gets the connector to use for the next connection,
+// reconfiguring it first if required. If `failed` is not nil, it is a
+// connector that just failed authentication, and a reconfiguration is
+// forced unless another caller has already replaced it.
+func (c *connector) prepareConnector(ctx context.Context, failed driver.Connector) (driver.Connector, string, stackerr.Error) {
+	// Hooks for the events that happen while the connector is locked
+	// are run once it's unlocked, so that they can't deadlock by using
+	// the connector themselves
+	ctx, pending := withPendingHooks(ctx)
+	defer pending.run()
+
 	// Ensure that the connector callbacks are thread-safe
 	c.reconfigureLock.Lock()
 	defer c.reconfigureLock.Unlock()
 
 	// Check whether we should reconfigure the connector
 	var reconfigure bool
-	// If there's no connector yet, or there's no callback provided
-	// for determining whent to reconfigure, then reconfigure.
-	if c.connector == nil || c.shouldReconfigureFunc == nil {
+	// If there's no connector yet, or there's no callback or strategy
+	// provided for determining whent to reconfigure, then reconfigure.
+	if c.connector == nil || (c.shouldReconfigureFunc == nil && c.reconfigureStrategy == nil) {
 		reconfigure = true
+	} else if failed != nil {
+		// If another connection attempt has already replaced the
+		// connector that failed, use the replacement. Otherwise,
+		// the credentials must be stale, so force a reconfigure.
+		reconfigure = c.connector == failed
 	} else {
 		// Otherwise, run the callback to determine if we should reconfigure.
+		spanCtx, span := StartSpan(ctx, "gormauth.ShouldReconfigure")
 		var err stackerr.Error
-		reconfigure, err = c.shouldReconfigureFunc(ctx)
+		reconfigure, err = c.shouldReconfigure(spanCtx)
+		span.SetAttributes(attribute.Bool("reconfigure", reconfigure))
+		EndSpan(span, err)
 		if err != nil {
-			return err
+			c.logger.ErrorContext(ctx, "failed to check whether the connector should be reconfigured", "endpoint", c.endpoint, "role", c.role, "error", err)
+			return nil, "", err
 		}
 	}
 
 	if reconfigure {
+		if failed != nil {
+			// Let the config callbacks know that the previous
+			// credentials failed, so they can bypass any caches
+			ctx = WithAuthFailureRetry(ctx, c.credentialVersion)
+		}
+		ctx, credentialVersion := withCredentialVersion(ctx)
+		ctx, credentialFetch := withCredentialFetch(ctx)
 		// Create a new connector
-		connector, err := c.getConnector(ctx)
+		spanCtx, span := StartSpan(ctx, "gormauth.GetCredentials", attribute.Bool("auth_failure_retry", failed != nil))
+		start := time.Now()
+		connector, endpoint, err := c.getConnector(spanCtx)
+		duration := time.Since(start)
 		if err != nil {
-			return err
+			c.metrics.recordReconfigure(ctx, c.endpoint, c.role, credentialFetch, false)
+			EndSpan(span, err)
+			c.logger.ErrorContext(ctx, "failed to reconfigure connector", "endpoint", c.endpoint, "role", c.role, "auth_failure_retry", failed != nil, "error", err)
+			if c.hooks.OnReconfigure != nil {
+				event := ReconfigureEvent{
+					Role:             c.role,
+					Endpoint:         c.endpoint,
+					PreviousEndpoint: c.endpoint,
+					AuthFailureRetry: failed != nil,
+					Duration:         duration,
+					Err:              err,
+				}
+				pending.add(func() {
+					c.hooks.OnReconfigure(ctx, event)
+				})
+			}
+			return nil, "", err
+		}
+		c.metrics.recordReconfigure(ctx, endpoint, c.role, credentialFetch, true)
+		span.SetAttributes(attribute.String("endpoint", endpoint))
+		EndSpan(span, nil)
+		c.logger.InfoContext(ctx, "reconfigured connector", "endpoint", endpoint, "role", c.role, "credential_version", *credentialVersion, "auth_failure_retry", failed != nil, "duration", duration)
+		if c.hooks.OnReconfigure != nil {
+			event := ReconfigureEvent{
+				Role:             c.role,
+				Endpoint:         endpoint,
+				PreviousEndpoint: c.endpoint,
+				AuthFailureRetry: failed != nil,
+				Duration:         duration,
+			}
+			pending.add(func() {
+				c.hooks.OnReconfigure(ctx, event)
+			})
 		}
 		c.connector = connector
+		c.endpoint = endpoint
+		c.credentialVersion = *credentialVersion
+		if c.reconfigureStrategy != nil {
+			c.reconfigureStrategy.Reconfigured(ctx, *credentialVersion)
+		}
 	}
 
-	return nil
+	return c.connector, c.endpoint, nil
+}
+
+// connect opens a connection with the given underlying connector.
+func (c *connector) connect(ctx context.Context, connector driver.Connector, endpoint string, attempt int) (driver.Conn, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("endpoint", endpoint))
+	start := time.Now()
+	conn, err := connector.Connect(ctx)
+	duration := time.Since(start)
+	authFailure := err != nil && c.isAuthError != nil && c.isAuthError(err)
+	c.metrics.recordConnect(ctx, endpoint, c.role, start, err == nil, authFailure)
+	if err != nil {
+		c.logger.WarnContext(ctx, "failed to connect", "endpoint", endpoint, "role", c.role, "attempt", attempt, "auth_failure", authFailure, "error", err)
+		if c.hooks.OnConnectError != nil {
+			c.hooks.OnConnectError(ctx, ConnectErrorEvent{
+				Role:        c.role,
+				Endpoint:    endpoint,
+				Attempt:     attempt,
+				Duration:    duration,
+				AuthFailure: authFailure,
+				Err:         err,
+			})
+		}
+		return conn, err
+	}
+	if c.hooks.OnConnect != nil {
+		c.hooks.OnConnect(ctx, ConnectEvent{
+			Role:     c.role,
+			Endpoint: endpoint,
+			Attempt:  attempt,
+			Duration: duration,
+		})
+	}
+	return conn, nil
 }
 
 func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
-	if err := c.prepareConnector(ctx); err != nil {
+	// Make the tracer, logger and hooks available to the config callbacks
+	// and dial functions, so they can create their own child spans, logs
+	// and events
+	ctx = withTracer(ctx, c.tracer)
+	ctx = withLogger(ctx, c.logger)
+	ctx = withHooks(ctx, c.hooks, c.role)
+	ctx, span := StartSpan(ctx, "gormauth.Connect", attribute.String("role", c.role))
+	conn, err := c.connectWithRetries(ctx)
+	EndSpan(span, err)
+	return conn, err
+}
+
+// connectWithRetries opens a connection, reconfiguring the connector and
+// retrying if the connection fails authentication.
+func (c *connector) connectWithRetries(ctx context.Context) (driver.Conn, error) {
+	connector, endpoint, err := c.prepareConnector(ctx, nil)
+	if err != nil {
 		return nil, err
 	}
-	conn, err := c.connector.Connect(ctx)
-	return conn, stackerr.Wrap(err)
+	conn, cerr := c.connect(ctx, connector, endpoint, 1)
+
+	// If authentication failed, the credentials may have been
+	// rotated since the connector was configured, so reconfigure
+	// it and try again.
+	for attempt := 1; cerr != nil && c.isAuthError != nil && c.isAuthError(cerr) && attempt <= c.authRetryPolicy.MaxRetries; attempt++ {
+		trace.SpanFromContext(ctx).AddEvent("auth_retry", trace.WithAttributes(attribute.Int("attempt", attempt)))
+		c.logger.InfoContext(ctx, "retrying connection after authentication failure", "endpoint", endpoint, "role", c.role, "attempt", attempt)
+		if err := c.authRetryPolicy.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+		connector, endpoint, err = c.prepareConnector(ctx, connector)
+		if err != nil {
+			return nil, err
+		}
+		conn, cerr = c.connect(ctx, connector, endpoint, attempt+1)
+	}
+
+	return conn, stackerr.Wrap(cerr)
 }
@@ -0,0 +1,160 @@
+package connectors
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// The name of this library, as reported to OpenTelemetry
+	instrumentationName string = "github.com/Invicton-Labs/gorm-auth"
+
+	// The role of a connector that connects to a writer (primary) endpoint
+	RoleWriter string = "writer"
+	// The role of a connector that connects to a reader (replica) endpoint
+	RoleReader string = "reader"
+)
+
+// connectorMetrics holds the OpenTelemetry instruments for a connector.
+// A nil *connectorMetrics records nothing.
+type connectorMetrics struct {
+	connects                metric.Int64Counter
+	reconfigures            metric.Int64Counter
+	authFailures            metric.Int64Counter
+	credentialFetchDuration metric.Float64Histogram
+	connectDuration         metric.Float64Histogram
+}
+
+func newConnectorMetrics(meterProvider metric.MeterProvider) *connectorMetrics {
+	meter := meterProvider.Meter(instrumentationName)
+	m := &connectorMetrics{}
+	var err error
+	// If an instrument can't be created, the meter returns a no-op
+	// instrument along with the error, so the error is only reported
+	m.connects, err = meter.Int64Counter(
+		"gormauth.connector.connects",
+		metric.WithDescription("The number of connection attempts"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	m.reconfigures, err = meter.Int64Counter(
+		"gormauth.connector.reconfigures",
+		metric.WithDescription("The number of times a connector was reconfigured with new credentials"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	m.authFailures, err = meter.Int64Counter(
+		"gormauth.connector.auth_failures",
+		metric.WithDescription("The number of connection attempts that failed authentication"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	m.credentialFetchDuration, err = meter.Float64Histogram(
+		"gormauth.connector.credential_fetch.duration",
+		metric.WithDescription("The time taken by authenticators to get the credentials for a connector"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	m.connectDuration, err = meter.Float64Histogram(
+		"gormauth.connector.connect.duration",
+		metric.WithDescription("The time taken to open a connection"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	return m
+}
+
+// WithMeterProvider enables OpenTelemetry metrics for a connector, using the
+// given meter provider. Metrics are labelled with the endpoint (host and port)
+// and the role of the connector (see WithRole).
+func WithMeterProvider(meterProvider metric.MeterProvider) ConnectorOption {
+	return func(c *connector) {
+		if meterProvider != nil {
+			c.metrics = newConnectorMetrics(meterProvider)
+		}
+	}
+}
+
+// WithRole sets the role of a connector (e.g. RoleWriter or RoleReader),
+// which is used to label its telemetry.
+func WithRole(role string) ConnectorOption {
+	return func(c *connector) {
+		c.role = role
+	}
+}
+
+func metricAttributes(endpoint string, role string, extra ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributes(append([]attribute.KeyValue{
+		attribute.String("endpoint", endpoint),
+		attribute.String("role", role),
+	}, extra...)...)
+}
+
+func (m *connectorMetrics) recordReconfigure(ctx context.Context, endpoint string, role string, fetch *credentialFetch, success bool) {
+	if m == nil {
+		return
+	}
+	// Only the time taken by authenticators is recorded, since config
+	// callbacks that don't use one (e.g. with static credentials) don't
+	// fetch any credentials
+	if fetch.fetched {
+		m.credentialFetchDuration.Record(ctx, fetch.duration.Seconds(), metricAttributes(endpoint, role, attribute.Bool("success", fetch.success)))
+	}
+	if success {
+		m.reconfigures.Add(ctx, 1, metricAttributes(endpoint, role))
+	}
+}
+
+func (m *connectorMetrics) recordConnect(ctx context.Context, endpoint string, role string, start time.Time, success bool, authFailure bool) {
+	if m == nil {
+		return
+	}
+	m.connectDuration.Record(ctx, time.Since(start).Seconds(), metricAttributes(endpoint, role, attribute.Bool("success", success)))
+	m.connects.Add(ctx, 1, metricAttributes(endpoint, role, attribute.Bool("success", success)))
+	if authFailure {
+		m.authFailures.Add(ctx, 1, metricAttributes(endpoint, role))
+	}
+}
+
+type credentialFetchKey struct{}
+
+// credentialFetch records how long authenticators took
+// to get the credentials for a new config.
+type credentialFetch struct {
+	duration time.Duration
+	fetched  bool
+	success  bool
+}
+
+// withCredentialFetch adds a value to a context that records how long
+// authenticators take to get the credentials for a new config.
+func withCredentialFetch(ctx context.Context) (context.Context, *credentialFetch) {
+	fetch := &credentialFetch{
+		success: true,
+	}
+	return context.WithValue(ctx, credentialFetchKey{}, fetch), fetch
+}
+
+// RecordCredentialFetch records how long an authenticator took to get
+// credentials for the connector that the context came from, which is
+// reported in the connector's credential fetch duration metric. It's
+// used by authenticators, and does nothing if the context didn't come
+// from a connector.
+func RecordCredentialFetch(ctx context.Context, duration time.Duration, success bool) {
+	if fetch, ok := ctx.Value(credentialFetchKey{}).(*credentialFetch); ok {
+		fetch.duration += duration
+		fetch.fetched = true
+		fetch.success = fetch.success && success
+	}
+}
@@ -3,22 +3,35 @@ package connectors
 import (
 	"context"
 	"database/sql/driver"
+	"net"
 
 	"github.com/Invicton-Labs/go-stackerr"
 	"github.com/go-sql-driver/mysql"
 )
 
 // NewMysqlConnector will create a new driver.Connector for a MySQL database
-func NewMysqlConnector(getConfigFunc GetMysqlConfigCallback, shouldReconfigureCallback ShouldReconfigureCallback) driver.Connector {
-	return &connector{
-		shouldReconfigureFunc: shouldReconfigureCallback,
-		getConnector: func(ctx context.Context) (driver.Connector, stackerr.Error) {
+func NewMysqlConnector(getConfigFunc GetMysqlConfigCallback, shouldReconfigureCallback ShouldReconfigureCallback, options ...ConnectorOption) driver.Connector {
+	return newConnector(
+		func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
 			cfg, err := getConfigFunc(ctx)
 			if err != nil {
-				return nil, err
+				return nil, "", err
+			}
+			if tracerFromContext(ctx) != nil && (cfg.Net == "" || cfg.Net == "tcp") {
+				// Use a network that traces TLS handshakes. The driver only
+				// applies its default address to the "tcp" network.
+				registerTracedMysqlNetwork()
+				cfg = cfg.Clone()
+				cfg.Net = tracedMysqlNetwork
+				if cfg.Addr == "" {
+					cfg.Addr = net.JoinHostPort("127.0.0.1", defaultMysqlPort)
+				}
 			}
 			conn, cerr := mysql.NewConnector(cfg)
-			return conn, stackerr.Wrap(cerr)
+			return conn, cfg.Addr, stackerr.Wrap(cerr)
 		},
-	}
+		shouldReconfigureCallback,
+		IsMysqlAuthError,
+		options,
+	)
 }
@@ -3,21 +3,26 @@ package connectors
 import (
 	"context"
 	"database/sql/driver"
+	"fmt"
 
 	"github.com/Invicton-Labs/go-stackerr"
 	"github.com/jackc/pgx/v5/stdlib"
 )
 
 // NewPostgresConnector will create a new driver.Connector for PostgreSQL
-func NewPostgresConnector(getConfigFunc GetPostgresConfigCallback, shouldReconfigureCallback ShouldReconfigureCallback) driver.Connector {
-	return &connector{
-		shouldReconfigureFunc: shouldReconfigureCallback,
-		getConnector: func(ctx context.Context) (driver.Connector, stackerr.Error) {
+func NewPostgresConnector(getConfigFunc GetPostgresConfigCallback, shouldReconfigureCallback ShouldReconfigureCallback, options ...ConnectorOption) driver.Connector {
+	return newConnector(
+		func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
 			cfg, opts, err := getConfigFunc(ctx)
 			if err != nil {
-				return nil, err
+				return nil, "", err
 			}
-			return stdlib.GetConnector(cfg, opts...), nil
+			// Trace TLS handshakes, if tracing is enabled when connecting
+			cfg.DialFunc = tracePostgresDials(cfg.DialFunc)
+			return stdlib.GetConnector(cfg, opts...), fmt.Sprintf("%s:%d", cfg.Host, cfg.Port), nil
 		},
-	}
+		shouldReconfigureCallback,
+		IsPostgresAuthError,
+		options,
+	)
 }
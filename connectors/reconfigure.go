@@ -0,0 +1,290 @@
+package connectors
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// Clock provides the current time. It can be replaced for testing.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is a Clock that uses the system time.
+var SystemClock Clock = systemClock{}
+
+func clockOrDefault(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+// ReconfigureStrategy is a composable strategy for determining whether a
+// connector should be reconfigured before the next connection. Strategies
+// are used by a connector with WithReconfigureStrategy (or the
+// ReconfigureStrategy field of a dialector input), or are converted into a
+// ShouldReconfigureCallback with NewShouldReconfigureCallback.
+type ReconfigureStrategy interface {
+	// ShouldReconfigure is called once for each new connection, and
+	// determines whether this strategy wants the connector to be
+	// reconfigured before it is made.
+	ShouldReconfigure(ctx context.Context) (bool, stackerr.Error)
+	// Reconfigured is called whenever the connector has been reconfigured,
+	// including when it's first configured and when a reconfiguration is
+	// forced by an authentication failure, regardless of which strategy
+	// requested it. The version is the version of the credentials that the
+	// new config uses, or an empty string if the authenticator didn't
+	// report one. It's called while the connector is locked, so it must
+	// not block.
+	Reconfigured(ctx context.Context, credentialVersion string)
+}
+
+// WithReconfigureStrategy sets the strategy for determining whether a
+// connector should be reconfigured before the next connection. If the
+// connector also has a ShouldReconfigureCallback (e.g. one that was set
+// by an authenticator), it's reconfigured whenever either of them
+// requests it. A nil strategy is ignored.
+func WithReconfigureStrategy(strategy ReconfigureStrategy) ConnectorOption {
+	return func(c *connector) {
+		if strategy != nil {
+			c.reconfigureStrategy = strategy
+		}
+	}
+}
+
+// NewShouldReconfigureCallback creates a ShouldReconfigureCallback from a
+// ReconfigureStrategy, for places that take a callback rather than a strategy.
+// The strategy is only told about the reconfigurations that it requests
+// (without a credential version), and it assumes that the connector was
+// configured when the callback is first called, so WithReconfigureStrategy
+// should be used instead wherever possible.
+func NewShouldReconfigureCallback(strategy ReconfigureStrategy) ShouldReconfigureCallback {
+	var configured sync.Once
+	return func(ctx context.Context) (bool, stackerr.Error) {
+		// The callback is first called once the connector
+		// has been configured and has made a connection
+		configured.Do(func() {
+			strategy.Reconfigured(ctx, "")
+		})
+		reconfigure, err := strategy.ShouldReconfigure(ctx)
+		if err != nil {
+			return false, err
+		}
+		if reconfigure {
+			strategy.Reconfigured(ctx, "")
+		}
+		return reconfigure, nil
+	}
+}
+
+type credentialVersionKey struct{}
+
+// withCredentialVersion adds a value to a context that records the version
+// of the credentials that an authenticator fetches for a new config.
+func withCredentialVersion(ctx context.Context) (context.Context, *string) {
+	version := new(string)
+	return context.WithValue(ctx, credentialVersionKey{}, version), version
+}
+
+// RecordCredentialVersion records the version of the credentials that were
+// fetched for a new connector config, so that the connector can pass it to
+// its reconfigure strategy. It's used by authenticators, and does nothing if
+// the context didn't come from a connector that is being reconfigured.
+func RecordCredentialVersion(ctx context.Context, version string) {
+	if recorded, ok := ctx.Value(credentialVersionKey{}).(*string); ok {
+		*recorded = version
+	}
+}
+
+type ttlStrategy struct {
+	lock     sync.Mutex
+	clock    Clock
+	ttl      time.Duration
+	jitter   time.Duration
+	deadline time.Time
+}
+
+func (s *ttlStrategy) resetDeadline() {
+	ttl := s.ttl
+	if s.jitter > 0 {
+		ttl += time.Duration(rand.Int63n(int64(s.jitter)))
+	}
+	s.deadline = s.clock.Now().Add(ttl)
+}
+
+func (s *ttlStrategy) ShouldReconfigure(ctx context.Context) (bool, stackerr.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// The TTL starts when the connector is first configured
+	if s.deadline.IsZero() {
+		return false, nil
+	}
+	return !s.clock.Now().Before(s.deadline), nil
+}
+
+func (s *ttlStrategy) Reconfigured(ctx context.Context, credentialVersion string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.resetDeadline()
+}
+
+// NewTtlStrategy creates a strategy that requests a reconfiguration once
+// the given TTL has passed since the last reconfiguration. If the clock
+// is nil, the system clock is used.
+func NewTtlStrategy(ttl time.Duration, clock Clock) ReconfigureStrategy {
+	return &ttlStrategy{
+		clock: clockOrDefault(clock),
+		ttl:   ttl,
+	}
+}
+
+// NewJitteredTtlStrategy creates a strategy that requests a reconfiguration
+// once a TTL has passed since the last reconfiguration, where the TTL is
+// randomly chosen between `ttl` and `ttl + jitter` each time. This prevents
+// many connectors from reconfiguring at the same time. If the clock is nil,
+// the system clock is used.
+func NewJitteredTtlStrategy(ttl time.Duration, jitter time.Duration, clock Clock) ReconfigureStrategy {
+	return &ttlStrategy{
+		clock:  clockOrDefault(clock),
+		ttl:    ttl,
+		jitter: jitter,
+	}
+}
+
+type connectionCountStrategy struct {
+	lock  sync.Mutex
+	n     int
+	count int
+}
+
+func (s *connectionCountStrategy) ShouldReconfigure(ctx context.Context) (bool, stackerr.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.count++
+	return s.count > s.n, nil
+}
+
+func (s *connectionCountStrategy) Reconfigured(ctx context.Context, credentialVersion string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// The connection that is about to be made is the
+	// first one using the new configuration
+	s.count = 1
+}
+
+// NewConnectionCountStrategy creates a strategy that requests a reconfiguration
+// every `n` connections, so that each configuration is used for at most `n`
+// connections.
+func NewConnectionCountStrategy(n int) ReconfigureStrategy {
+	return &connectionCountStrategy{
+		n: n,
+	}
+}
+
+// A function signature for a function that gets the current version
+// of a set of credentials (or any other configuration value).
+type GetVersionCallback func(ctx context.Context) (version string, err stackerr.Error)
+
+type versionChangedStrategy struct {
+	lock           sync.Mutex
+	getVersion     GetVersionCallback
+	currentVersion string
+	initialized    bool
+}
+
+func (s *versionChangedStrategy) ShouldReconfigure(ctx context.Context) (bool, stackerr.Error) {
+	version, err := s.getVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// If the authenticator didn't report the version that the connector
+	// was configured with, the first version that is seen is assumed to
+	// be the one that the connector is using
+	if !s.initialized {
+		s.initialized = true
+		s.currentVersion = version
+		return false, nil
+	}
+	return version != s.currentVersion, nil
+}
+
+func (s *versionChangedStrategy) Reconfigured(ctx context.Context, credentialVersion string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.initialized = credentialVersion != ""
+	s.currentVersion = credentialVersion
+}
+
+// NewVersionChangedStrategy creates a strategy that requests a reconfiguration
+// whenever the version returned by the callback differs from the version of the
+// credentials that the connector was last configured with. The callback must
+// return versions in the same form as the authenticator reports them for its
+// credentials, e.g. by using the GetVersion method of the provider whose
+// GetCredentials method the authenticator uses.
+func NewVersionChangedStrategy(getVersion GetVersionCallback) ReconfigureStrategy {
+	return &versionChangedStrategy{
+		getVersion: getVersion,
+	}
+}
+
+type combinedStrategy struct {
+	strategies []ReconfigureStrategy
+	all        bool
+}
+
+func (s *combinedStrategy) ShouldReconfigure(ctx context.Context) (bool, stackerr.Error) {
+	// With no strategies, there's nothing to request a reconfiguration
+	result := s.all && len(s.strategies) > 0
+	// Every strategy is evaluated (no short-circuiting), since
+	// strategies may need to observe every connection
+	for _, strategy := range s.strategies {
+		reconfigure, err := strategy.ShouldReconfigure(ctx)
+		if err != nil {
+			return false, err
+		}
+		if s.all {
+			result = result && reconfigure
+		} else {
+			result = result || reconfigure
+		}
+	}
+	return result, nil
+}
+
+func (s *combinedStrategy) Reconfigured(ctx context.Context, credentialVersion string) {
+	for _, strategy := range s.strategies {
+		strategy.Reconfigured(ctx, credentialVersion)
+	}
+}
+
+// AllStrategies creates a strategy that requests a reconfiguration only
+// when all of the given strategies request one. If no strategies are
+// given, it never requests a reconfiguration.
+func AllStrategies(strategies ...ReconfigureStrategy) ReconfigureStrategy {
+	return &combinedStrategy{
+		strategies: strategies,
+		all:        true,
+	}
+}
+
+// AnyStrategy creates a strategy that requests a reconfiguration when
+// any of the given strategies requests one.
+func AnyStrategy(strategies ...ReconfigureStrategy) ReconfigureStrategy {
+	return &combinedStrategy{
+		strategies: strategies,
+		all:        false,
+	}
+}
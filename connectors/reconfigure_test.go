@@ -0,0 +1,324 @@
+package connectors
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func shouldReconfigure(t *testing.T, strategy ReconfigureStrategy) bool {
+	t.Helper()
+	reconfigure, err := strategy.ShouldReconfigure(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reconfigure
+}
+
+func TestTtlStrategy(t *testing.T) {
+	clock := newFakeClock()
+	strategy := NewTtlStrategy(time.Minute, clock)
+
+	// The connector is configured when it's created
+	strategy.Reconfigured(context.Background(), "")
+	clock.Advance(59 * time.Second)
+	if shouldReconfigure(t, strategy) {
+		t.Error("expected no reconfiguration before the TTL has passed")
+	}
+	// The TTL starts when the connector was configured, not when
+	// the strategy was first checked
+	clock.Advance(time.Second)
+	if !shouldReconfigure(t, strategy) {
+		t.Error("expected a reconfiguration once the TTL has passed")
+	}
+
+	strategy.Reconfigured(context.Background(), "")
+	if shouldReconfigure(t, strategy) {
+		t.Error("expected the TTL to restart after a reconfiguration")
+	}
+	clock.Advance(time.Minute)
+	if !shouldReconfigure(t, strategy) {
+		t.Error("expected a reconfiguration once the restarted TTL has passed")
+	}
+}
+
+func TestJitteredTtlStrategy(t *testing.T) {
+	clock := newFakeClock()
+	strategy := NewJitteredTtlStrategy(time.Minute, 30*time.Second, clock)
+
+	strategy.Reconfigured(context.Background(), "")
+	clock.Advance(59 * time.Second)
+	if shouldReconfigure(t, strategy) {
+		t.Error("expected no reconfiguration before the TTL has passed")
+	}
+	clock.Advance(31 * time.Second)
+	if !shouldReconfigure(t, strategy) {
+		t.Error("expected a reconfiguration once the TTL and jitter have passed")
+	}
+}
+
+func TestConnectionCountStrategy(t *testing.T) {
+	strategy := NewConnectionCountStrategy(3)
+
+	// The first connection is made with the initial configuration
+	strategy.Reconfigured(context.Background(), "")
+	for i := 2; i <= 3; i++ {
+		if shouldReconfigure(t, strategy) {
+			t.Errorf("expected no reconfiguration for connection %d", i)
+		}
+	}
+	if !shouldReconfigure(t, strategy) {
+		t.Error("expected a reconfiguration for connection 4")
+	}
+	strategy.Reconfigured(context.Background(), "")
+	if shouldReconfigure(t, strategy) {
+		t.Error("expected the count to restart after a reconfiguration")
+	}
+}
+
+func TestVersionChangedStrategy(t *testing.T) {
+	version := "1"
+	checks := 0
+	strategy := NewVersionChangedStrategy(func(ctx context.Context) (string, stackerr.Error) {
+		checks++
+		return version, nil
+	})
+
+	// The connector is configured with version 1, and the version
+	// changes before the strategy is first checked
+	strategy.Reconfigured(context.Background(), "1")
+	version = "2"
+	if !shouldReconfigure(t, strategy) {
+		t.Error("expected a reconfiguration when the version changed after the connector was configured")
+	}
+	strategy.Reconfigured(context.Background(), "2")
+	if shouldReconfigure(t, strategy) {
+		t.Error("expected no reconfiguration when the version hasn't changed")
+	}
+	// The version is only fetched when the strategy is checked
+	if checks != 2 {
+		t.Errorf("expected 2 version checks, got %d", checks)
+	}
+}
+
+func TestVersionChangedStrategyWithoutACredentialVersion(t *testing.T) {
+	version := "1"
+	strategy := NewVersionChangedStrategy(func(ctx context.Context) (string, stackerr.Error) {
+		return version, nil
+	})
+
+	// If the authenticator doesn't report a version, the first
+	// version that is seen is assumed to be in use
+	strategy.Reconfigured(context.Background(), "")
+	if shouldReconfigure(t, strategy) {
+		t.Error("expected no reconfiguration for the first version that is seen")
+	}
+	version = "2"
+	if !shouldReconfigure(t, strategy) {
+		t.Error("expected a reconfiguration when the version changed")
+	}
+}
+
+func TestCombinedStrategies(t *testing.T) {
+	clock := newFakeClock()
+	ttl := NewTtlStrategy(time.Minute, clock)
+	count := NewConnectionCountStrategy(1)
+
+	all := AllStrategies(ttl, count)
+	all.Reconfigured(context.Background(), "")
+	if shouldReconfigure(t, all) {
+		t.Error("expected AllStrategies not to reconfigure when only some strategies request it")
+	}
+	clock.Advance(time.Minute)
+	if !shouldReconfigure(t, all) {
+		t.Error("expected AllStrategies to reconfigure when every strategy requests it")
+	}
+
+	if shouldReconfigure(t, AllStrategies()) {
+		t.Error("expected AllStrategies with no strategies never to reconfigure")
+	}
+	if shouldReconfigure(t, AnyStrategy()) {
+		t.Error("expected AnyStrategy with no strategies never to reconfigure")
+	}
+}
+
+type fakeDriverConnector struct {
+	id int
+}
+
+func (c *fakeDriverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return nil, stackerr.Errorf("not implemented")
+}
+
+func (c *fakeDriverConnector) Driver() driver.Driver {
+	return nil
+}
+
+func TestShouldReconfigureCallback(t *testing.T) {
+	clock := newFakeClock()
+	callback := NewShouldReconfigureCallback(AnyStrategy(NewTtlStrategy(time.Minute, clock), NewConnectionCountStrategy(3)))
+	check := func() bool {
+		t.Helper()
+		reconfigure, err := callback(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reconfigure
+	}
+
+	// The callback is first called for the second connection
+	// made with the initial configuration
+	if check() || check() {
+		t.Error("expected no reconfiguration for connections 2 and 3")
+	}
+	if !check() {
+		t.Error("expected a reconfiguration for connection 4")
+	}
+	// The strategy is told about the reconfiguration that it requested
+	if check() {
+		t.Error("expected the count to restart after the requested reconfiguration")
+	}
+	clock.Advance(time.Minute)
+	if !check() {
+		t.Error("expected a reconfiguration once the TTL has passed")
+	}
+	if check() {
+		t.Error("expected the TTL to restart after the requested reconfiguration")
+	}
+}
+
+func TestConnectorNotifiesStrategyOfEveryReconfiguration(t *testing.T) {
+	clock := newFakeClock()
+	strategy := NewTtlStrategy(time.Minute, clock)
+	configs := 0
+	c := newConnector(func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
+		configs++
+		return &fakeDriverConnector{id: configs}, "localhost:5432", nil
+	}, nil, nil, []ConnectorOption{WithReconfigureStrategy(strategy)})
+
+	// The TTL starts when the connector is first configured
+	first, _, err := c.prepareConnector(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	second, _, err := c.prepareConnector(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("expected the connector to be reconfigured once the TTL passed")
+	}
+
+	// A forced reconfiguration restarts the TTL too
+	clock.Advance(59 * time.Second)
+	third, _, err := c.prepareConnector(context.Background(), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == second {
+		t.Fatal("expected the connector to be reconfigured after an authentication failure")
+	}
+	clock.Advance(59 * time.Second)
+	fourth, _, err := c.prepareConnector(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fourth != third {
+		t.Error("expected the TTL to restart after the forced reconfiguration")
+	}
+	if configs != 3 {
+		t.Errorf("expected 3 configurations, got %d", configs)
+	}
+}
+
+func TestConnectorPassesTheCredentialVersionToTheStrategy(t *testing.T) {
+	version := "v1"
+	configs := 0
+	strategy := NewVersionChangedStrategy(func(ctx context.Context) (string, stackerr.Error) {
+		return version, nil
+	})
+	c := newConnector(func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
+		configs++
+		RecordCredentialVersion(ctx, version)
+		return &fakeDriverConnector{id: configs}, "localhost:5432", nil
+	}, nil, nil, []ConnectorOption{WithReconfigureStrategy(strategy)})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.prepareConnector(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version = "v2"
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.prepareConnector(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if configs != 2 {
+		t.Errorf("expected 2 configurations, got %d", configs)
+	}
+}
+
+func TestConnectorCombinesTheStrategyWithTheCallback(t *testing.T) {
+	callbackReconfigure := false
+	configs := 0
+	c := newConnector(func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
+		configs++
+		return &fakeDriverConnector{id: configs}, "localhost:5432", nil
+	}, func(ctx context.Context) (bool, stackerr.Error) {
+		return callbackReconfigure, nil
+	}, nil, []ConnectorOption{
+		WithReconfigureStrategy(NewConnectionCountStrategy(2)),
+		// A nil strategy doesn't replace the previous one
+		WithReconfigureStrategy(nil),
+	})
+
+	prepare := func() {
+		t.Helper()
+		if _, _, err := c.prepareConnector(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first connection configures the connector, and the
+	// count strategy requests a reconfiguration for the third
+	for i := 0; i < 3; i++ {
+		prepare()
+	}
+	if configs != 2 {
+		t.Fatalf("expected the strategy to request a reconfiguration, got %d configurations", configs)
+	}
+	// The callback can request a reconfiguration too
+	callbackReconfigure = true
+	prepare()
+	if configs != 3 {
+		t.Errorf("expected the callback to request a reconfiguration, got %d configurations", configs)
+	}
+}
@@ -0,0 +1,127 @@
+package connectors
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// The MySQL error number for "access denied"
+	mysqlErrorAccessDenied uint16 = 1045
+	// The PostgreSQL SQLSTATE for "invalid password"
+	postgresErrorInvalidPassword string = "28P01"
+)
+
+// AuthRetryPolicy determines how connections that fail authentication
+// are retried. Before each retry, the connector is reconfigured so
+// that fresh credentials are used.
+type AuthRetryPolicy struct {
+	// The maximum number of times to retry a connection that
+	// failed authentication. Zero disables retries.
+	MaxRetries int
+	// OPTIONAL: The duration to wait before the first retry.
+	// If zero, the first retry is made immediately.
+	InitialBackoff time.Duration
+	// OPTIONAL: The maximum duration to wait before any retry. The
+	// backoff doubles after each retry until it reaches this value.
+	// If zero, the backoff is not capped.
+	MaxBackoff time.Duration
+}
+
+// DefaultAuthRetryPolicy is the policy used if no other policy is set. It
+// retries a connection that failed authentication once, immediately.
+var DefaultAuthRetryPolicy AuthRetryPolicy = AuthRetryPolicy{
+	MaxRetries: 1,
+}
+
+// WithAuthRetryPolicy sets the policy for retrying connections that fail
+// authentication.
+func WithAuthRetryPolicy(policy AuthRetryPolicy) ConnectorOption {
+	return func(c *connector) {
+		c.authRetryPolicy = policy
+	}
+}
+
+// backoff returns the duration to wait before the given retry attempt (starting at 1).
+func (p AuthRetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff > 0; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+func (p AuthRetryPolicy) wait(ctx context.Context, attempt int) stackerr.Error {
+	backoff := p.backoff(attempt)
+	if backoff <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return stackerr.Wrap(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// IsMysqlAuthError determines whether an error returned when connecting
+// to a MySQL database is an authentication failure.
+func IsMysqlAuthError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrorAccessDenied
+}
+
+// IsPostgresAuthError determines whether an error returned when connecting
+// to a PostgreSQL database is an authentication failure.
+func IsPostgresAuthError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == postgresErrorInvalidPassword
+}
+
+type authFailureRetryKey struct{}
+
+type authFailureRetryValue struct {
+	failedCredentialVersion string
+}
+
+// WithAuthFailureRetry marks a context as being used to get a new connection
+// configuration because a connection using the previous configuration failed
+// authentication. The failed credential version is the version that the
+// authenticator reported for the previous configuration, if any. It's used by
+// connectors, and can be used for testing config callbacks.
+func WithAuthFailureRetry(ctx context.Context, failedCredentialVersion string) context.Context {
+	return context.WithValue(ctx, authFailureRetryKey{}, authFailureRetryValue{
+		failedCredentialVersion: failedCredentialVersion,
+	})
+}
+
+// IsAuthFailureRetry determines whether the connection configuration is being
+// requested because a connection using the previous configuration failed
+// authentication. Config callbacks and authenticators can use this to bypass
+// any cached credentials.
+func IsAuthFailureRetry(ctx context.Context) bool {
+	_, retry := ctx.Value(authFailureRetryKey{}).(authFailureRetryValue)
+	return retry
+}
+
+// FailedCredentialVersion gets the version of the credentials that failed
+// authentication, if the connection configuration is being requested because
+// of an authentication failure and the authenticator reported a version for
+// the failed credentials. Otherwise, an empty string is returned.
+func FailedCredentialVersion(ctx context.Context) string {
+	value, _ := ctx.Value(authFailureRetryKey{}).(authFailureRetryValue)
+	return value.failedCredentialVersion
+}
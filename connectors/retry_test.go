@@ -0,0 +1,45 @@
+package connectors
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+func TestConnectorReportsTheFailedCredentialVersion(t *testing.T) {
+	configs := 0
+	failedVersions := []string{}
+	c := newConnector(func(ctx context.Context) (driver.Connector, string, stackerr.Error) {
+		if IsAuthFailureRetry(ctx) {
+			failedVersions = append(failedVersions, FailedCredentialVersion(ctx))
+		}
+		configs++
+		RecordCredentialVersion(ctx, fmt.Sprintf("v%d", configs))
+		return &fakeDriverConnector{id: configs}, "localhost:5432", nil
+	}, func(ctx context.Context) (bool, stackerr.Error) {
+		return false, nil
+	}, nil, nil)
+
+	first, _, err := c.prepareConnector(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := c.prepareConnector(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A connector that was already replaced doesn't cause another reconfiguration
+	if _, _, err := c.prepareConnector(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.prepareConnector(context.Background(), second); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failedVersions) != 2 || failedVersions[0] != "v1" || failedVersions[1] != "v2" {
+		t.Errorf("expected the failed versions to be [v1 v2], got %v", failedVersions)
+	}
+}
@@ -0,0 +1,232 @@
+package connectors
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// The name of the MySQL network that traces TLS handshakes. It's
+	// only registered once a MySQL connector has tracing enabled, and
+	// only used for connections made while tracing is enabled.
+	tracedMysqlNetwork string = "gormauth-traced-tcp"
+	// The port that the MySQL driver uses for TCP addresses without one
+	defaultMysqlPort string = "3306"
+
+	// TLS record types, which are used to detect the
+	// start and end of a TLS handshake
+	tlsRecordTypeHandshake       byte = 0x16
+	tlsRecordTypeApplicationData byte = 0x17
+	// The major version of all TLS record versions
+	tlsRecordVersionMajor byte = 0x03
+)
+
+var registerTracedMysqlNetworkOnce sync.Once
+
+// registerTracedMysqlNetwork registers the MySQL network that traces
+// TLS handshakes, the first time that it's needed.
+func registerTracedMysqlNetwork() {
+	registerTracedMysqlNetworkOnce.Do(func() {
+		mysql.RegisterDialContext(tracedMysqlNetwork, dialTracedMysql)
+	})
+}
+
+// dialTracedMysql dials a MySQL server over TCP the same way that the
+// driver does for the "tcp" network, and traces the TLS handshake.
+func dialTracedMysql(ctx context.Context, addr string) (net.Conn, error) {
+	// The driver only adds the default port for the "tcp" network
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultMysqlPort)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The driver only enables keepalives for *net.TCPConn
+	// connections, which the tracing wrapper hides
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return withTlsHandshakeTracing(ctx, conn), nil
+}
+
+// tracePostgresDials wraps a pgx dial function so that it traces the TLS
+// handshakes of the connections that it dials. If the dial function is nil
+// (e.g. because the config wasn't created by pgx.ParseConfig), pgx's default
+// dialer is used.
+func tracePostgresDials(dial pgconn.DialFunc) pgconn.DialFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return withTlsHandshakeTracing(ctx, conn), nil
+	}
+}
+
+// WithTracerProvider enables OpenTelemetry tracing for a connector, using the
+// given tracer provider. Spans are created for each connection, reconfiguration
+// check, credential fetch and TLS handshake, as children of the span in the
+// context that database/sql passes to Connect. Credential values are never
+// recorded.
+func WithTracerProvider(tracerProvider trace.TracerProvider) ConnectorOption {
+	return func(c *connector) {
+		if tracerProvider != nil {
+			c.tracer = tracerProvider.Tracer(instrumentationName)
+		}
+	}
+}
+
+type tracerContextKey struct{}
+
+// withTracer adds a tracer to a context, so that the config
+// callbacks and dial functions can create child spans.
+func withTracer(ctx context.Context, tracer trace.Tracer) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerContextKey{}, tracer)
+}
+
+func tracerFromContext(ctx context.Context) trace.Tracer {
+	tracer, _ := ctx.Value(tracerContextKey{}).(trace.Tracer)
+	return tracer
+}
+
+// StartSpan starts a span if tracing is enabled for the connector that the
+// context came from. If it isn't, a no-op span is returned. This allows
+// config callbacks and authenticators to add their own spans (e.g. for
+// signing tokens). Attributes must never include credential values.
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := tracerFromContext(ctx)
+	if tracer == nil {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan ends a span, recording the error (if any) on it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tlsHandshakeTracingConn is a network connection that creates a span
+// for the TLS handshake, if there is one. The database drivers perform
+// the handshake internally, so it's detected from the TLS records that
+// are written: the handshake starts when the first handshake record
+// (the ClientHello) is written, and is complete when the first
+// application data record is written.
+type tlsHandshakeTracingConn struct {
+	net.Conn
+	ctx  context.Context
+	lock sync.Mutex
+	span trace.Span
+	// Set once the handshake span has ended, after which
+	// writes are no longer inspected or locked
+	done atomic.Bool
+}
+
+// tlsHandshakeTracingSyscallConn is a tlsHandshakeTracingConn for a
+// connection that exposes its file descriptor, which drivers use to
+// check whether pooled connections are still alive.
+type tlsHandshakeTracingSyscallConn struct {
+	*tlsHandshakeTracingConn
+	syscallConn syscall.Conn
+}
+
+func (c *tlsHandshakeTracingSyscallConn) SyscallConn() (syscall.RawConn, error) {
+	return c.syscallConn.SyscallConn()
+}
+
+// withTlsHandshakeTracing wraps a network connection so that TLS handshakes
+// are traced, if tracing is enabled for the connector that the context came from.
+func withTlsHandshakeTracing(ctx context.Context, conn net.Conn) net.Conn {
+	if tracerFromContext(ctx) == nil {
+		return conn
+	}
+	tracingConn := &tlsHandshakeTracingConn{
+		Conn: conn,
+		ctx:  ctx,
+	}
+	if syscallConn, ok := conn.(syscall.Conn); ok {
+		return &tlsHandshakeTracingSyscallConn{
+			tlsHandshakeTracingConn: tracingConn,
+			syscallConn:             syscallConn,
+		}
+	}
+	return tracingConn
+}
+
+func (c *tlsHandshakeTracingConn) Write(b []byte) (int, error) {
+	if !c.done.Load() {
+		c.inspectWrite(b)
+	}
+	return c.Conn.Write(b)
+}
+
+// inspectWrite starts or ends the handshake span if the data
+// being written is the first handshake or application data record.
+func (c *tlsHandshakeTracingConn) inspectWrite(b []byte) {
+	if len(b) < 3 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done.Load() {
+		return
+	}
+	// Only TLS 1.0 to 1.3 record versions (0x0301 to 0x0304) are
+	// recognized, so other data is less likely to be mistaken for
+	// a TLS record
+	if b[1] != tlsRecordVersionMajor || b[2] < 0x01 || b[2] > 0x04 {
+		return
+	}
+	if c.span == nil && b[0] == tlsRecordTypeHandshake {
+		_, c.span = StartSpan(c.ctx, "gormauth.TlsHandshake", attribute.String("server.address", c.RemoteAddr().String()))
+	} else if c.span != nil && b[0] == tlsRecordTypeApplicationData {
+		c.span.End()
+		c.done.Store(true)
+	}
+}
+
+func (c *tlsHandshakeTracingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && !c.done.Load() {
+		c.finish(err)
+	}
+	return n, err
+}
+
+func (c *tlsHandshakeTracingConn) Close() error {
+	c.finish(nil)
+	return c.Conn.Close()
+}
+
+// finish ends the handshake span if the handshake didn't complete.
+func (c *tlsHandshakeTracingConn) finish(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.span != nil && !c.done.Load() {
+		EndSpan(c.span, err)
+		c.done.Store(true)
+	}
+}
@@ -0,0 +1,169 @@
+package connectors
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeTracer records the spans that are started and ended.
+type fakeTracer struct {
+	trace.Tracer
+	lock  sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	trace.Span
+	name  string
+	ended bool
+}
+
+func newFakeTracer() *fakeTracer {
+	return &fakeTracer{
+		Tracer: trace.NewNoopTracerProvider().Tracer(""),
+	}
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	ctx, span := t.Tracer.Start(ctx, name, opts...)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	fake := &fakeSpan{
+		Span: span,
+		name: name,
+	}
+	t.spans = append(t.spans, fake)
+	return ctx, fake
+}
+
+func (s *fakeSpan) End(options ...trace.SpanEndOption) {
+	s.ended = true
+}
+
+// listen starts a TCP listener that discards everything written to it.
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTracedMysqlConnectionsTraceTlsHandshakes(t *testing.T) {
+	listener := listen(t)
+	tracer := newFakeTracer()
+	ctx := withTracer(context.Background(), tracer)
+
+	conn, err := dialTracedMysql(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The driver checks whether pooled connections are alive using their file descriptors
+	if _, ok := conn.(syscall.Conn); !ok {
+		t.Error("expected the traced connection to expose its file descriptor")
+	}
+
+	write := func(b ...byte) {
+		t.Helper()
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A MySQL packet that happens to start with the handshake record type isn't a TLS record
+	write(tlsRecordTypeHandshake, 0x00, 0x00, 0x01)
+	if len(tracer.spans) != 0 {
+		t.Fatalf("expected no span for a non-TLS packet, got %d", len(tracer.spans))
+	}
+	// The ClientHello starts the handshake span
+	write(tlsRecordTypeHandshake, tlsRecordVersionMajor, 0x01, 0x00)
+	if len(tracer.spans) != 1 || tracer.spans[0].name != "gormauth.TlsHandshake" || tracer.spans[0].ended {
+		t.Fatalf("expected a started handshake span, got %+v", tracer.spans)
+	}
+	// The first application data record ends it
+	write(tlsRecordTypeApplicationData, tlsRecordVersionMajor, 0x03, 0x00)
+	if !tracer.spans[0].ended {
+		t.Error("expected the handshake span to end once application data was written")
+	}
+	write(tlsRecordTypeHandshake, tlsRecordVersionMajor, 0x03, 0x00)
+	if len(tracer.spans) != 1 {
+		t.Errorf("expected only one handshake span, got %d", len(tracer.spans))
+	}
+}
+
+func TestTracedMysqlConnectionsUseTheDefaultPort(t *testing.T) {
+	ctx := withTracer(context.Background(), newFakeTracer())
+	conn, err := dialTracedMysql(ctx, "127.0.0.1")
+	if err == nil {
+		// Something is listening on the default port
+		conn.Close()
+		return
+	}
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Addr == nil || opErr.Addr.String() != net.JoinHostPort("127.0.0.1", defaultMysqlPort) {
+		t.Errorf("expected the default port to be dialed, got %v", err)
+	}
+}
+
+func TestTracedPostgresDialsUseTheDefaultDialer(t *testing.T) {
+	listener := listen(t)
+	tracer := newFakeTracer()
+	ctx := withTracer(context.Background(), tracer)
+
+	// Configs that aren't created by pgx.ParseConfig have no dial function
+	conn, err := tracePostgresDials(nil)(ctx, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{tlsRecordTypeHandshake, tlsRecordVersionMajor, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.spans) != 1 || tracer.spans[0].name != "gormauth.TlsHandshake" {
+		t.Errorf("expected a handshake span, got %+v", tracer.spans)
+	}
+}
+
+func TestTracedPostgresDialsUseTheConfiguredDialer(t *testing.T) {
+	listener := listen(t)
+	tracer := newFakeTracer()
+	ctx := withTracer(context.Background(), tracer)
+
+	dialed := []string{}
+	dial := tracePostgresDials(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+	})
+	conn, err := dial(ctx, "tcp", "db.example.com:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(dialed) != 1 || dialed[0] != "db.example.com:5432" {
+		t.Fatalf("expected the configured dialer to be used, got %v", dialed)
+	}
+	if _, err := conn.Write([]byte{tlsRecordTypeHandshake, tlsRecordVersionMajor, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.spans) != 1 || tracer.spans[0].name != "gormauth.TlsHandshake" {
+		t.Errorf("expected a handshake span, got %+v", tracer.spans)
+	}
+}
@@ -15,6 +15,11 @@ type DialectorInput struct {
 	// A function that determines whether a new configuration should be used
 	// for the next connection
 	ShouldReconfigureCallback connectors.ShouldReconfigureCallback
+	// OPTIONAL: A strategy that determines whether a new configuration should
+	// be used for the next connection, which is told about every
+	// reconfiguration. If both this and the ShouldReconfigureCallback are
+	// provided, a new configuration is used when either of them requests it.
+	ReconfigureStrategy connectors.ReconfigureStrategy
 	// The maximum duration to allow a connection to remain idle before closing it
 	ConnMaxIdleTime *time.Duration
 	// The maximum duration to allow a connection to remain open (regardless of
@@ -25,6 +30,25 @@ type DialectorInput struct {
 	// The maximum number of connections (regardless of whether they are idle)
 	// that can be open at any given time.
 	MaxOpenConns *int
+	// OPTIONAL: The policy for retrying connections that fail authentication
+	// (e.g. because the credentials were rotated). If not provided,
+	// connectors.DefaultAuthRetryPolicy is used.
+	AuthRetryPolicy *connectors.AuthRetryPolicy
+	// OPTIONAL: Additional options for the connector (e.g. for telemetry)
+	ConnectorOptions []connectors.ConnectorOption
+}
+
+// connectorOptions gets the options to use when creating a connector.
+func (input DialectorInput) connectorOptions() []connectors.ConnectorOption {
+	options := []connectors.ConnectorOption{}
+	if input.AuthRetryPolicy != nil {
+		options = append(options, connectors.WithAuthRetryPolicy(*input.AuthRetryPolicy))
+	}
+	if input.ReconfigureStrategy != nil {
+		options = append(options, connectors.WithReconfigureStrategy(input.ReconfigureStrategy))
+	}
+	options = append(options, input.ConnectorOptions...)
+	return options
 }
 
 type dialectorInputType interface {
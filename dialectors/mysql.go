@@ -32,7 +32,7 @@ func newMysqlDialector(input MysqlDialectorInput) gorm.Dialector {
 		panic("the `input.GetMysqlConfigCallback` field must not be nil")
 	}
 
-	connector := connectors.NewMysqlConnector(input.GetMysqlConfigCallback, input.ShouldReconfigureCallback)
+	connector := connectors.NewMysqlConnector(input.GetMysqlConfigCallback, input.ShouldReconfigureCallback, input.connectorOptions()...)
 
 	input.GormMysqlConfig.Conn = getBaseDb(input.DialectorInput, connector)
 	input.GormMysqlConfig.DSN = ""
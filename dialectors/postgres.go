@@ -33,7 +33,7 @@ func newPostgresDialector(input PostgresDialectorInput) gorm.Dialector {
 		panic("the `input.GetPostgresConfigCallback` field must not be nil")
 	}
 
-	connector := connectors.NewPostgresConnector(input.GetPostgresConfigCallback, input.ShouldReconfigureCallback)
+	connector := connectors.NewPostgresConnector(input.GetPostgresConfigCallback, input.ShouldReconfigureCallback, input.connectorOptions()...)
 
 	input.GormPostgresConfig.Conn = getBaseDb(input.DialectorInput, connector)
 	input.GormPostgresConfig.DSN = ""
@@ -0,0 +1,92 @@
+package examples
+
+import (
+	"context"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	gormauth "github.com/Invicton-Labs/gorm-auth"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	gormauthaws "github.com/Invicton-Labs/gorm-auth/aws"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	gormpostgres "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func AwsRdsPostgresPasswordAuth(ctx context.Context) (*gorm.DB, stackerr.Error) {
+
+	gormConfig := &gorm.Config{
+		// Insert GORM general settings here
+		CreateBatchSize: 1000,
+		// ... many other settings available
+	}
+
+	gormPostgresConfig := gormpostgres.Config{
+		// Insert PostgreSQL-specific GORM settings here
+		PreferSimpleProtocol: false,
+		// ... many other settings available
+	}
+
+	// This is a configuration for PostgreSQL connections. It relates
+	// to settings used by the pgx driver, not GORM. pgx requires
+	// that the config be created by pgx.ParseConfig.
+	pgConfig, cerr := pgx.ParseConfig("sslmode=verify-full application_name=my-api")
+	if cerr != nil {
+		return nil, stackerr.Wrap(cerr)
+	}
+
+	// Load the database secret
+	secret, err := getSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a password-based authentication object. The same
+	// authenticator type is used for both MySQL and PostgreSQL.
+	authenticator := &authenticators.PostgresConnectionParametersPassword{
+		Host:           secret.Host,
+		Port:           secret.Port,
+		Schema:         secret.Database,
+		GetCredentials: getCredentials,
+	}
+
+	// The maximum number of connections we can have open to the
+	// write host.
+	writeMaxOpenConnections := 3
+	writeInputs := []*gormauth.PostgresConnectionParameters{
+		{
+			DialectorInput: dialectors.PostgresDialectorInput{
+				DialectorInput: dialectors.DialectorInput{
+					// Set the function that checks if new credentials should be loaded
+					ShouldReconfigureCallback: checkIfNewCredentialsNeeded,
+
+					// Some general GORM settings for the connection management
+					MaxOpenConns: &writeMaxOpenConnections,
+					// ...several other settings available
+				},
+
+				// Set the GORM-specific PostgreSQL settings to use for this dialector
+				GormPostgresConfig: gormPostgresConfig,
+
+				// Set a function that returns the PostgreSQL config to use. This
+				// allows changing parameters for each new connection, if desired.
+				// The host/port/user/password fields don't need to be provided
+				// because they are overwritten by the password authentication system.
+				GetPostgresConfigCallback: func(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+					return *pgConfig, nil, nil
+				},
+			},
+			// Use the AWS TLS configuration (change if you're connecting elsewhere)
+			GetTlsConfigFunc: gormauthaws.GetTlsConfig,
+			AuthSettings:     authenticator,
+		},
+	}
+
+	return gormauth.GetPostgresGorm(ctx, gormauth.GetPostgresGormInput{
+		WriteConnectionParameters: writeInputs,
+		GormOptions: []gorm.Option{
+			gormConfig,
+		},
+	})
+}
@@ -0,0 +1,145 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	gormmysql "gorm.io/driver/mysql"
+	gormpostgres "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// A function signature for a callback function that gets the TLS configuration
+// to use for a specific host.
+type GetTlsConfigCallback func(ctx context.Context, host string) (*tls.Config, stackerr.Error)
+
+// getTlsConfig gets the TLS config for a host, logging the result
+// and running the connector's OnTlsConfigLoaded hook.
+func getTlsConfig(ctx context.Context, getTlsFunc GetTlsConfigCallback, host string) (*tls.Config, stackerr.Error) {
+	logger := connectors.LoggerFromContext(ctx)
+	tlsConfig, err := getTlsFunc(ctx, host)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to load TLS config", "host", host, "error", err)
+		return nil, err
+	}
+	serverName := host
+	if tlsConfig != nil && tlsConfig.ServerName != "" {
+		serverName = tlsConfig.ServerName
+	}
+	logger.DebugContext(ctx, "loaded TLS config", "host", host, "server_name", serverName)
+	event := connectors.TlsConfigLoadedEvent{
+		Host:       host,
+		ServerName: serverName,
+	}
+	if tlsConfig != nil {
+		event.MinVersion = tlsConfig.MinVersion
+		event.HasClientCertificate = len(tlsConfig.Certificates) > 0 || tlsConfig.GetClientCertificate != nil
+	}
+	connectors.NotifyTlsConfigLoaded(ctx, event)
+	return tlsConfig, nil
+}
+
+// endpointAwarePolicy is a replica policy that needs to know which
+// connection pools belong to the writers and which belong to the readers.
+type endpointAwarePolicy interface {
+	dbresolver.Policy
+	bindEndpoints(writers []*sql.DB, readers []*sql.DB)
+}
+
+// callbackPolicy is a replica policy that needs to register
+// GORM callbacks (e.g. to track the result of each query).
+type callbackPolicy interface {
+	dbresolver.Policy
+	registerCallbacks(db *gorm.DB) error
+}
+
+// getSqlDb gets the connection pool of a dialector that was created by
+// the dialectors package, or nil if it's not a supported dialector.
+func getSqlDb(dialector gorm.Dialector) *sql.DB {
+	var sqlDb *sql.DB
+	switch d := dialector.(type) {
+	case *gormmysql.Dialector:
+		sqlDb, _ = d.Conn.(*sql.DB)
+	case *gormpostgres.Dialector:
+		sqlDb, _ = d.Conn.(*sql.DB)
+	}
+	return sqlDb
+}
+
+// getSqlDbs gets the connection pools of a set of dialectors.
+func getSqlDbs(dialectors []gorm.Dialector) []*sql.DB {
+	sqlDbs := make([]*sql.DB, 0, len(dialectors))
+	for _, dialector := range dialectors {
+		if sqlDb := getSqlDb(dialector); sqlDb != nil {
+			sqlDbs = append(sqlDbs, sqlDb)
+		}
+	}
+	return sqlDbs
+}
+
+// openGorm creates a GORM DB handle from a set of writer and reader dialectors,
+// registering a DBResolver if there is more than one dialector.
+func openGorm(writerDialectors []gorm.Dialector, readerDialectors []gorm.Dialector, gormOptions []gorm.Option, replicaPolicy dbresolver.Policy) (*gorm.DB, stackerr.Error) {
+	// We need to select a primary dialector for things
+	var mainConnection gorm.Dialector
+	if len(writerDialectors) > 0 {
+		mainConnection = writerDialectors[0]
+		// TODO: it's unclear if the default should still be included in the Sources list (https://github.com/go-gorm/gorm/issues/7145)
+		//writerDialectors = writerDialectors[1:]
+	} else if len(readerDialectors) > 0 {
+		mainConnection = readerDialectors[0]
+		// TODO: it's unclear if the default should still be included in the Replica list (https://github.com/go-gorm/gorm/issues/7145)
+		//readerDialectors = readerDialectors[1:]
+	}
+
+	// Create the database without a dialector, so
+	// no connection is opened automatically. We do this
+	// because we don't want a write connection to be opened
+	// if we end up only needing a read connection, and
+	// vice-versa.
+	db, cerr := gorm.Open(mainConnection, gormOptions...)
+	if cerr != nil {
+		return nil, stackerr.Wrap(cerr)
+	}
+
+	// Keep track of the dialectors, so they can be health checked
+	if err := db.Use(newHealthCheckPlugin(writerDialectors, readerDialectors)); err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	// If there are multiple dialectors, we need a DBResolver.
+	// If not, we can just use the default dialector for everything.
+	if len(writerDialectors)+len(readerDialectors) > 1 {
+		policy := replicaPolicy
+		if policy == nil {
+			policy = dbresolver.StrictRoundRobinPolicy()
+		}
+		if p, ok := policy.(endpointAwarePolicy); ok {
+			p.bindEndpoints(getSqlDbs(writerDialectors), getSqlDbs(readerDialectors))
+			// The DBResolver doesn't use the policy if there's only one
+			// replica, so list it twice to allow the policy to skip it
+			if len(readerDialectors) == 1 {
+				readerDialectors = []gorm.Dialector{readerDialectors[0], readerDialectors[0]}
+			}
+		}
+		// Register the dialectors
+		if err := db.Use(dbresolver.Register(dbresolver.Config{
+			Sources:  writerDialectors,
+			Replicas: readerDialectors,
+			Policy:   policy,
+		})); err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		if p, ok := policy.(callbackPolicy); ok {
+			if err := p.registerCallbacks(db); err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+		}
+	}
+
+	return db, nil
+}
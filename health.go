@@ -0,0 +1,298 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	gormmysql "gorm.io/driver/mysql"
+	gormpostgres "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	// The name of the GORM plugin that keeps track of
+	// the endpoints to include in health checks
+	healthCheckPluginName string = "gormauth:healthcheck"
+	// The timeout for health checks made by the HTTP
+	// handler, if no timeout is provided
+	defaultHealthCheckTimeout time.Duration = 5 * time.Second
+)
+
+// The health of a single writer or reader endpoint
+type EndpointHealth struct {
+	// The role of the endpoint (writer or reader)
+	Role string `json:"role"`
+	// The index of the endpoint in the WriteConnectionParameters
+	// or ReadConnectionParameters that it came from
+	Index int `json:"index"`
+	// The endpoint (host and port) that was connected to, if known
+	Endpoint string `json:"endpoint,omitempty"`
+	// Whether the database server could be reached (i.e. it
+	// responded, even if it rejected the connection)
+	Reachable bool `json:"reachable"`
+	// Whether the connection was authenticated
+	AuthOk bool `json:"auth_ok"`
+	// The TLS version of the connection (e.g. `TLSv1.3`), or an
+	// empty string if the connection doesn't use TLS
+	TlsVersion string `json:"tls_version,omitempty"`
+	// How long it took to get a connection and ping it
+	Latency time.Duration `json:"latency_ns"`
+	// The error, if the endpoint isn't healthy
+	Error string `json:"error,omitempty"`
+}
+
+// Healthy returns whether the endpoint could be connected to.
+func (h EndpointHealth) Healthy() bool {
+	return h.Reachable && h.AuthOk && h.Error == ""
+}
+
+// The result of a health check
+type HealthReport struct {
+	// Whether the database is healthy, which is the case if every writer
+	// endpoint is healthy, and at least one reader endpoint is healthy
+	// (if there are any reader endpoints).
+	Healthy bool `json:"healthy"`
+	// The health of each writer and reader endpoint
+	Endpoints []EndpointHealth `json:"endpoints"`
+}
+
+type healthCheckEndpoint struct {
+	role      string
+	index     int
+	dialector gorm.Dialector
+}
+
+// healthCheckPlugin is a GORM plugin that keeps track of the writer and
+// reader dialectors, which are otherwise hidden inside the DBResolver.
+type healthCheckPlugin struct {
+	endpoints []healthCheckEndpoint
+}
+
+func (p *healthCheckPlugin) Name() string {
+	return healthCheckPluginName
+}
+
+func (p *healthCheckPlugin) Initialize(db *gorm.DB) error {
+	return nil
+}
+
+func newHealthCheckPlugin(writerDialectors []gorm.Dialector, readerDialectors []gorm.Dialector) *healthCheckPlugin {
+	p := &healthCheckPlugin{}
+	for idx, dialector := range writerDialectors {
+		p.endpoints = append(p.endpoints, healthCheckEndpoint{
+			role:      connectors.RoleWriter,
+			index:     idx,
+			dialector: dialector,
+		})
+	}
+	for idx, dialector := range readerDialectors {
+		p.endpoints = append(p.endpoints, healthCheckEndpoint{
+			role:      connectors.RoleReader,
+			index:     idx,
+			dialector: dialector,
+		})
+	}
+	return p
+}
+
+// HealthCheck connects to and pings every writer and reader endpoint of a
+// GORM DB handle that was created by GetMysqlGorm or GetPostgresGorm, and
+// reports on the health of each of them. The endpoints are checked
+// concurrently. A new connection is opened for each endpoint, rather than
+// using an idle one from its pool, so that authentication is exercised with
+// the credentials that new connections would currently use. Only dialectors
+// that don't use a connector from this library (e.g. those opened from a DSN)
+// are checked with a connection from their pool.
+func HealthCheck(ctx context.Context, db *gorm.DB) (HealthReport, stackerr.Error) {
+	plugin, ok := db.Config.Plugins[healthCheckPluginName].(*healthCheckPlugin)
+	if !ok {
+		return HealthReport{}, stackerr.Errorf("the GORM DB handle was not created by GetMysqlGorm or GetPostgresGorm")
+	}
+
+	report := HealthReport{
+		Endpoints: make([]EndpointHealth, len(plugin.endpoints)),
+	}
+	wg := sync.WaitGroup{}
+	for idx, endpoint := range plugin.endpoints {
+		wg.Add(1)
+		go func(idx int, endpoint healthCheckEndpoint) {
+			defer wg.Done()
+			report.Endpoints[idx] = checkEndpoint(ctx, endpoint)
+		}(idx, endpoint)
+	}
+	wg.Wait()
+
+	report.Healthy = true
+	readers, healthyReaders := 0, 0
+	for _, endpoint := range report.Endpoints {
+		if endpoint.Role == connectors.RoleReader {
+			readers++
+			if endpoint.Healthy() {
+				healthyReaders++
+			}
+		} else if !endpoint.Healthy() {
+			report.Healthy = false
+		}
+	}
+	if readers > 0 && healthyReaders == 0 {
+		report.Healthy = false
+	}
+	return report, nil
+}
+
+// checkEndpoint checks the health of a single endpoint.
+func checkEndpoint(ctx context.Context, endpoint healthCheckEndpoint) EndpointHealth {
+	result := EndpointHealth{
+		Role:  endpoint.role,
+		Index: endpoint.index,
+	}
+
+	sqlDb := getSqlDb(endpoint.dialector)
+	var isServerError func(err error) bool
+	var getTlsVersion func(ctx context.Context, conn *sql.Conn) (string, error)
+	switch endpoint.dialector.(type) {
+	case *gormmysql.Dialector:
+		isServerError = isMysqlServerError
+		getTlsVersion = getMysqlTlsVersion
+	case *gormpostgres.Dialector:
+		isServerError = isPostgresServerError
+		getTlsVersion = getPostgresTlsVersion
+	}
+	if sqlDb == nil {
+		result.Error = "unsupported dialector"
+		return result
+	}
+
+	// Open a new pool that shares the endpoint's connector, so that a
+	// new connection is made (and authenticated) instead of an idle
+	// connection being reused
+	if connector, ok := sqlDb.Driver().(driver.Connector); ok {
+		sqlDb = sql.OpenDB(connector)
+		defer sqlDb.Close()
+	}
+
+	start := time.Now()
+	conn, err := sqlDb.Conn(ctx)
+	if err == nil {
+		defer conn.Close()
+		err = conn.PingContext(ctx)
+	}
+	result.Latency = time.Since(start)
+	if connector, ok := sqlDb.Driver().(interface{ Endpoint() string }); ok {
+		result.Endpoint = connector.Endpoint()
+	}
+	if err != nil {
+		// If the server responded with an error, it's reachable
+		// even though the connection failed
+		result.Reachable = isServerError(err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Reachable = true
+	result.AuthOk = true
+
+	tlsVersion, err := getTlsVersion(ctx, conn)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.TlsVersion = tlsVersion
+	return result
+}
+
+// isMysqlServerError returns whether an error was returned by a MySQL server.
+func isMysqlServerError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr)
+}
+
+// isPostgresServerError returns whether an error was returned by a PostgreSQL server.
+func isPostgresServerError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr)
+}
+
+// getMysqlTlsVersion gets the TLS version of a MySQL connection from the server.
+func getMysqlTlsVersion(ctx context.Context, conn *sql.Conn) (string, error) {
+	var name, version string
+	if err := conn.QueryRowContext(ctx, "SHOW SESSION STATUS LIKE 'Ssl_version'").Scan(&name, &version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return version, nil
+}
+
+// getPostgresTlsVersion gets the TLS version of a PostgreSQL connection
+// from the underlying network connection.
+func getPostgresTlsVersion(ctx context.Context, conn *sql.Conn) (string, error) {
+	var version string
+	err := conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return nil
+		}
+		if tlsConn, ok := stdlibConn.Conn().PgConn().Conn().(*tls.Conn); ok {
+			version = getTlsVersionName(tlsConn.ConnectionState().Version)
+		}
+		return nil
+	})
+	return version, err
+}
+
+// getTlsVersionName gets the name of a TLS version, in
+// the same format that MySQL uses (e.g. `TLSv1.3`).
+func getTlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return "unknown"
+}
+
+// NewHealthCheckHandler creates an HTTP handler that runs a health check
+// (e.g. for Kubernetes readiness probes). It responds with the health report
+// as JSON, with a 200 status if the database is healthy, or a 503 status if
+// it isn't. If the timeout is zero, a timeout of 5 seconds is used.
+func NewHealthCheckHandler(db *gorm.DB, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		report, err := HealthCheck(ctx, db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	})
+}
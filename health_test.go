@@ -0,0 +1,57 @@
+package gormauth
+
+import (
+	"context"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestHealthCheckAuthenticatesANewConnection(t *testing.T) {
+	server := newFakePostgresServer(t, "writer")
+	params := newFakePostgresConnectionParameters(server, staticPasswordCredentials)
+	// Keep idle connections, so that a pooled connection is available
+	params.DialectorInput.MaxIdleConns = nil
+
+	db, err := GetPostgresGorm(context.Background(), GetPostgresGormInput{
+		WriteConnectionParameters: []*PostgresConnectionParameters{params},
+		GormOptions:               []gorm.Option{quietGormConfig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := db.Raw("SELECT name FROM servers").Scan(&name).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := HealthCheck(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy || len(report.Endpoints) != 1 || !report.Endpoints[0].AuthOk {
+		t.Fatalf("expected a healthy report, got %+v", report)
+	}
+
+	// The server starts rejecting the credentials, which the
+	// idle connection in the pool wouldn't have noticed
+	server.lock.Lock()
+	server.rejectPassword = func(password string) bool {
+		return true
+	}
+	server.lock.Unlock()
+	report, err = HealthCheck(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy {
+		t.Fatal("expected an unhealthy report once the credentials were rejected")
+	}
+	endpoint := report.Endpoints[0]
+	if !endpoint.Reachable || endpoint.AuthOk || endpoint.Error == "" {
+		t.Errorf("expected the endpoint to be reachable but fail authentication, got %+v", endpoint)
+	}
+	if endpoint.Endpoint != server.listener.Addr().String() {
+		t.Errorf("expected the endpoint %s, got %s", server.listener.Addr(), endpoint.Endpoint)
+	}
+}
@@ -2,7 +2,6 @@ package gormauth
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"net/url"
 	"strings"
@@ -18,10 +17,6 @@ import (
 
 var defaultMysqlConfig mysql.Config = *(mysql.NewConfig())
 
-// A function signature for a callback function that gets the TLS configuration
-// to use for a specific host.
-type GetTlsConfigCallback func(ctx context.Context, host string) (*tls.Config, stackerr.Error)
-
 type ConnectionParameters struct {
 	DialectorInput dialectors.MysqlDialectorInput
 	// OPTIONAL: A function that gets the TLS config to use for a
@@ -64,18 +59,17 @@ func wrapMysqlConfigWithTls(sourceFunc connectors.GetMysqlConfigCallback, getTls
 		hostWithoutPort := strings.SplitN(u.Host, ":", 2)[0]
 
 		// Get the TLS config
-		tlsConfig, err := getTlsFunc(ctx, hostWithoutPort)
+		tlsConfig, err := getTlsConfig(ctx, getTlsFunc, hostWithoutPort)
 		if err != nil {
 			return nil, err
 		}
 
-		// Register the TLS config for this host
-		if err := mysql.RegisterTLSConfig(u.Host, tlsConfig); err != nil {
-			return nil, stackerr.Wrap(err)
-		}
-
-		// Ensure the MySQL config specifies the right TLS config
-		mysqlConfig.TLSConfig = u.Host
+		// Set the TLS config on this MySQL config directly, rather than
+		// registering it in the driver's process-wide registry, so that
+		// connectors with different TLS policies for the same host don't
+		// overwrite each other. The TLS field takes priority over the
+		// TLSConfig name.
+		mysqlConfig.TLS = tlsConfig
 		return mysqlConfig, nil
 	}
 }
@@ -89,8 +83,14 @@ type GetMysqlGormInput struct {
 	// OPTIONAL: A set of GORM options to use for all connections
 	GormOptions []gorm.Option
 	// OPTIONAL: The policy to use for connecting to read replicas.
-	// If not provided, the Random policy will be used.
+	// If not provided, the StrictRoundRobin policy will be used. Use
+	// NewReplicaLagPolicy to skip replicas that are lagging, or
+	// NewCircuitBreakerPolicy to skip replicas that are failing.
 	ReplicaPolicy dbresolver.Policy
+	// OPTIONAL: Telemetry settings for all connections
+	Telemetry TelemetrySettings
+	// OPTIONAL: Lifecycle hooks for all connections
+	Hooks connectors.Hooks
 }
 
 func wrapConfigCallback(callback connectors.GetMysqlConfigCallback, authSettings authenticators.AuthenticationSettings, getTlsConfigFunc GetTlsConfigCallback) connectors.GetMysqlConfigCallback {
@@ -107,7 +107,7 @@ func wrapConfigCallback(callback connectors.GetMysqlConfigCallback, authSettings
 		}
 
 		// Get the authentication parameters
-		config, err := authSettings.UpdateConfigWithAuth(ctx, *config)
+		config, err := authenticators.UpdateMysqlConfigWithAuth(ctx, authSettings, *config)
 		if err != nil {
 			return nil, err
 		}
@@ -122,78 +122,36 @@ func wrapConfigCallback(callback connectors.GetMysqlConfigCallback, authSettings
 	return f
 }
 
+func getMysqlDialectors(parameters []*ConnectionParameters, connectorOptions []connectors.ConnectorOption) ([]gorm.Dialector, stackerr.Error) {
+	dialectorList := make([]gorm.Dialector, len(parameters))
+	for idx, params := range parameters {
+		// If the authenticator also needs to make changes to the dialector input, make those changes
+		var err stackerr.Error
+		params.DialectorInput.DialectorInput, err = params.AuthSettings.UpdateDialectorSettings(params.DialectorInput.DialectorInput)
+		if err != nil {
+			return nil, err
+		}
+		// Wrap the config callback to apply the authentication parameters and TLS config
+		params.DialectorInput.GetMysqlConfigCallback = wrapConfigCallback(params.DialectorInput.GetMysqlConfigCallback, params.AuthSettings, params.GetTlsConfigFunc)
+		params.DialectorInput.DialectorInput = withConnectorOptions(params.DialectorInput.DialectorInput, connectorOptions)
+		dialectorList[idx] = dialectors.NewDialector(params.DialectorInput)
+	}
+	return dialectorList, nil
+}
+
 func GetMysqlGorm(
 	ctx context.Context,
 	input GetMysqlGormInput,
 ) (*gorm.DB, stackerr.Error) {
-	writerDialectors := make([]gorm.Dialector, len(input.WriteConnectionParameters))
-	if len(input.WriteConnectionParameters) > 0 {
-		for idx := range input.WriteConnectionParameters {
-			// If the authenticator also needs to make changes to the dialector input, make those changes
-			var err stackerr.Error
-			input.WriteConnectionParameters[idx].DialectorInput, err = input.WriteConnectionParameters[idx].AuthSettings.UpdateDialectorSettings(input.WriteConnectionParameters[idx].DialectorInput)
-			if err != nil {
-				return nil, err
-			}
-			// Wrap the config callback to apply the authentication parameters and TLS config
-			input.WriteConnectionParameters[idx].DialectorInput.GetMysqlConfigCallback = wrapConfigCallback(input.WriteConnectionParameters[idx].DialectorInput.GetMysqlConfigCallback, input.WriteConnectionParameters[idx].AuthSettings, input.WriteConnectionParameters[idx].GetTlsConfigFunc)
-			writerDialectors[idx] = dialectors.NewDialector(input.WriteConnectionParameters[idx].DialectorInput)
-		}
+	writerDialectors, err := getMysqlDialectors(input.WriteConnectionParameters, getConnectorOptions(input.Telemetry, input.Hooks, connectors.RoleWriter))
+	if err != nil {
+		return nil, err
 	}
 
-	readerDialectors := make([]gorm.Dialector, len(input.ReadConnectionParameters))
-	if len(input.ReadConnectionParameters) > 0 {
-		for idx := range input.ReadConnectionParameters {
-			// If the authenticator also needs to make changes to the dialector input, make those changes
-			var err stackerr.Error
-			input.ReadConnectionParameters[idx].DialectorInput, err = input.ReadConnectionParameters[idx].AuthSettings.UpdateDialectorSettings(input.ReadConnectionParameters[idx].DialectorInput)
-			if err != nil {
-				return nil, err
-			}
-			// Wrap the config callback to apply the authentication parameters and TLS config
-			input.ReadConnectionParameters[idx].DialectorInput.GetMysqlConfigCallback = wrapConfigCallback(input.ReadConnectionParameters[idx].DialectorInput.GetMysqlConfigCallback, input.ReadConnectionParameters[idx].AuthSettings, input.ReadConnectionParameters[idx].GetTlsConfigFunc)
-			readerDialectors[idx] = dialectors.NewDialector(input.ReadConnectionParameters[idx].DialectorInput)
-		}
-	}
-
-	// We need to select a primary dialector for things
-	var mainConnection gorm.Dialector
-	if len(writerDialectors) > 0 {
-		mainConnection = writerDialectors[0]
-		// TODO: it's unclear if the default should still be included in the Sources list (https://github.com/go-gorm/gorm/issues/7145)
-		//writerDialectors = writerDialectors[1:]
-	} else if len(readerDialectors) > 0 {
-		mainConnection = readerDialectors[0]
-		// TODO: it's unclear if the default should still be included in the Replica list (https://github.com/go-gorm/gorm/issues/7145)
-		//readerDialectors = readerDialectors[1:]
-	}
-
-	// Create the database without a dialector, so
-	// no connection is opened automatically. We do this
-	// because we don't want a write connection to be opened
-	// if we end up only needing a read connection, and
-	// vice-versa.
-	db, cerr := gorm.Open(mainConnection, input.GormOptions...)
-	if cerr != nil {
-		return nil, stackerr.Wrap(cerr)
-	}
-
-	// If there are multiple dialectors, we need a DBResolver.
-	// If not, we can just use the default dialector for everything.
-	if len(writerDialectors)+len(readerDialectors) > 1 {
-		policy := input.ReplicaPolicy
-		if policy == nil {
-			policy = dbresolver.StrictRoundRobinPolicy()
-		}
-		// Register the dialectors
-		if err := db.Use(dbresolver.Register(dbresolver.Config{
-			Sources:  writerDialectors,
-			Replicas: readerDialectors,
-			Policy:   policy,
-		})); err != nil {
-			return nil, stackerr.Wrap(err)
-		}
+	readerDialectors, err := getMysqlDialectors(input.ReadConnectionParameters, getConnectorOptions(input.Telemetry, input.Hooks, connectors.RoleReader))
+	if err != nil {
+		return nil, err
 	}
 
-	return db, nil
+	return openGorm(writerDialectors, readerDialectors, input.GormOptions, input.ReplicaPolicy)
 }
@@ -0,0 +1,62 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+)
+
+func TestGetMysqlDialectorsSetTlsPerConnector(t *testing.T) {
+	newParameters := func(serverName string) (*ConnectionParameters, *tls.Config) {
+		tlsConfig := &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		}
+		return &ConnectionParameters{
+			GetTlsConfigFunc: func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+				if host != "db.example.com" {
+					t.Errorf("expected the TLS config to be requested for db.example.com, got %s", host)
+				}
+				return tlsConfig, nil
+			},
+			AuthSettings: &authenticators.ConnectionParametersPassword{
+				Host:           "db.example.com",
+				Port:           3306,
+				Schema:         "app",
+				GetCredentials: staticPasswordCredentials,
+			},
+		}, tlsConfig
+	}
+	// Two connectors for the same host have different TLS policies
+	first, firstTlsConfig := newParameters("first.example.com")
+	second, secondTlsConfig := newParameters("second.example.com")
+
+	if _, err := getMysqlDialectors([]*ConnectionParameters{first, second}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		params    *ConnectionParameters
+		tlsConfig *tls.Config
+	}{
+		{first, firstTlsConfig},
+		{second, secondTlsConfig},
+	} {
+		config, err := test.params.DialectorInput.GetMysqlConfigCallback(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.TLS != test.tlsConfig {
+			t.Errorf("expected the connector for %s to use its own TLS config, got %+v", test.tlsConfig.ServerName, config.TLS)
+		}
+		// The config isn't registered in the driver's process-wide registry,
+		// which would require it to be referenced by a custom name
+		switch config.TLSConfig {
+		case "", "true", "false", "skip-verify", "preferred":
+		default:
+			t.Errorf("expected no registered TLS config to be referenced, got %s", config.TLSConfig)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package gormauth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+type PostgresConnectionParameters struct {
+	DialectorInput dialectors.PostgresDialectorInput
+	// OPTIONAL: A function that gets the TLS config to use for a
+	// connection based on the given host name
+	GetTlsConfigFunc GetTlsConfigCallback
+	// OPTIONAL: The authentication settings to apply to each new
+	// connection. If not provided, the config returned by the
+	// dialector input's config callback is used as-is.
+	AuthSettings authenticators.AuthenticationSettings
+}
+
+func wrapPostgresConfigWithTls(sourceFunc connectors.GetPostgresConfigCallback, getTlsFunc GetTlsConfigCallback) connectors.GetPostgresConfigCallback {
+	return func(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+		// Get the base config
+		pgConfig, opts, err := sourceFunc(ctx)
+		if err != nil {
+			return pgConfig, nil, err
+		}
+
+		if pgConfig.Host == "" {
+			return pgConfig, nil, stackerr.Errorf("failed to get host from PostgreSQL config")
+		}
+
+		// Make a copy of it so we don't mess with any values
+		// in the original value, since the fallbacks are pointers
+		pgConfig = *pgConfig.Copy()
+
+		// Get the TLS config for the primary host
+		tlsConfig, err := getTlsConfig(ctx, getTlsFunc, pgConfig.Host)
+		if err != nil {
+			return pgConfig, nil, err
+		}
+		pgConfig.TLSConfig = tlsConfig
+
+		// Each fallback may be a different host, so each needs its
+		// own TLS config. Fallbacks that only existed to try the same
+		// host without TLS (e.g. from `sslmode=prefer`) are dropped,
+		// since every connection must now use TLS.
+		seen := map[string]struct{}{
+			fmt.Sprintf("%s:%d", pgConfig.Host, pgConfig.Port): {},
+		}
+		fallbacks := make([]*pgconn.FallbackConfig, 0, len(pgConfig.Fallbacks))
+		for _, fallback := range pgConfig.Fallbacks {
+			addr := fmt.Sprintf("%s:%d", fallback.Host, fallback.Port)
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+			seen[addr] = struct{}{}
+			fallbackTlsConfig, err := getTlsConfig(ctx, getTlsFunc, fallback.Host)
+			if err != nil {
+				return pgConfig, nil, err
+			}
+			fallbacks = append(fallbacks, &pgconn.FallbackConfig{
+				Host:      fallback.Host,
+				Port:      fallback.Port,
+				TLSConfig: fallbackTlsConfig,
+			})
+		}
+		pgConfig.Fallbacks = fallbacks
+
+		return pgConfig, opts, nil
+	}
+}
+
+// The input values for getting a standard PostgreSQL GORM DB handle
+type GetPostgresGormInput struct {
+	// Input values for write connections
+	WriteConnectionParameters []*PostgresConnectionParameters
+	// Input values for read connections
+	ReadConnectionParameters []*PostgresConnectionParameters
+	// OPTIONAL: A set of GORM options to use for all connections
+	GormOptions []gorm.Option
+	// OPTIONAL: The policy to use for connecting to read replicas.
+	// If not provided, the StrictRoundRobin policy will be used. Use
+	// NewReplicaLagPolicy to skip replicas that are lagging, or
+	// NewCircuitBreakerPolicy to skip replicas that are failing.
+	ReplicaPolicy dbresolver.Policy
+	// OPTIONAL: Telemetry settings for all connections
+	Telemetry TelemetrySettings
+	// OPTIONAL: Lifecycle hooks for all connections
+	Hooks connectors.Hooks
+}
+
+func wrapPostgresConfigCallback(callback connectors.GetPostgresConfigCallback, authSettings authenticators.AuthenticationSettings, getTlsConfigFunc GetTlsConfigCallback) connectors.GetPostgresConfigCallback {
+	f := authenticators.PostgresConfigCallbackWithAuth(authSettings, callback)
+
+	if getTlsConfigFunc != nil {
+		f = wrapPostgresConfigWithTls(f, getTlsConfigFunc)
+	}
+
+	return f
+}
+
+func getPostgresDialectors(parameters []*PostgresConnectionParameters, connectorOptions []connectors.ConnectorOption) ([]gorm.Dialector, stackerr.Error) {
+	dialectorList := make([]gorm.Dialector, len(parameters))
+	for idx, params := range parameters {
+		// If the authenticator also needs to make changes to the dialector input, make those changes
+		if params.AuthSettings != nil {
+			var err stackerr.Error
+			params.DialectorInput.DialectorInput, err = params.AuthSettings.UpdateDialectorSettings(params.DialectorInput.DialectorInput)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Wrap the config callback to apply the authentication parameters and TLS config
+		params.DialectorInput.GetPostgresConfigCallback = wrapPostgresConfigCallback(params.DialectorInput.GetPostgresConfigCallback, params.AuthSettings, params.GetTlsConfigFunc)
+		params.DialectorInput.DialectorInput = withConnectorOptions(params.DialectorInput.DialectorInput, connectorOptions)
+		dialectorList[idx] = dialectors.NewDialector(params.DialectorInput)
+	}
+	return dialectorList, nil
+}
+
+// GetPostgresGorm creates a GORM DB handle for PostgreSQL, with a DBResolver
+// for routing between the writer and reader connections if more than one
+// is provided.
+func GetPostgresGorm(
+	ctx context.Context,
+	input GetPostgresGormInput,
+) (*gorm.DB, stackerr.Error) {
+	writerDialectors, err := getPostgresDialectors(input.WriteConnectionParameters, getConnectorOptions(input.Telemetry, input.Hooks, connectors.RoleWriter))
+	if err != nil {
+		return nil, err
+	}
+
+	readerDialectors, err := getPostgresDialectors(input.ReadConnectionParameters, getConnectorOptions(input.Telemetry, input.Hooks, connectors.RoleReader))
+	if err != nil {
+		return nil, err
+	}
+
+	return openGorm(writerDialectors, readerDialectors, input.GormOptions, input.ReplicaPolicy)
+}
@@ -0,0 +1,349 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakePostgresServer is an in-process stand-in for a PostgreSQL server. It
+// answers startup and cleartext password authentication, and responds to
+// every simple query with a single row containing the server's name.
+type fakePostgresServer struct {
+	name     string
+	listener net.Listener
+
+	lock sync.Mutex
+	// The passwords of each connection, in order
+	passwords []string
+	// The queries that were received, in order
+	queries []string
+	// OPTIONAL: A function that determines whether a password is rejected
+	rejectPassword func(password string) bool
+}
+
+func newFakePostgresServer(t *testing.T, name string) *fakePostgresServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakePostgresServer{
+		name:     name,
+		listener: listener,
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakePostgresServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakePostgresServer) getPasswords() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.passwords...)
+}
+
+func (s *fakePostgresServer) getQueries() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.queries...)
+}
+
+func (s *fakePostgresServer) serve(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+
+	// Refuse TLS, and wait for the real startup message
+	for {
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*pgproto3.SSLRequest); ok {
+			if _, err := conn.Write([]byte("N")); err != nil {
+				return
+			}
+			continue
+		}
+		if _, ok := msg.(*pgproto3.StartupMessage); !ok {
+			return
+		}
+		break
+	}
+
+	backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+	if err := backend.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+		return
+	}
+	msg, err := backend.Receive()
+	if err != nil {
+		return
+	}
+	passwordMsg, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	s.passwords = append(s.passwords, passwordMsg.Password)
+	reject := s.rejectPassword != nil && s.rejectPassword(passwordMsg.Password)
+	s.lock.Unlock()
+	if reject {
+		backend.Send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28P01",
+			Message:  "password authentication failed",
+		})
+		backend.Flush()
+		return
+	}
+
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "16.0"})
+	backend.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
+	backend.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			s.lock.Lock()
+			s.queries = append(s.queries, m.String)
+			s.lock.Unlock()
+			backend.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{
+				Name:         []byte("name"),
+				DataTypeOID:  25,
+				DataTypeSize: -1,
+				TypeModifier: -1,
+			}}})
+			backend.Send(&pgproto3.DataRow{Values: [][]byte{[]byte(s.name)}})
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			if err := backend.Flush(); err != nil {
+				return
+			}
+		case *pgproto3.Terminate:
+			return
+		default:
+			return
+		}
+	}
+}
+
+// getFakePostgresConfig is a config callback for connecting to a fake server
+// without TLS, using the simple protocol that the fake server understands.
+func getFakePostgresConfig(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+	config, err := pgx.ParseConfig("sslmode=disable")
+	if err != nil {
+		return pgx.ConnConfig{}, nil, stackerr.Wrap(err)
+	}
+	config.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	return *config, nil, nil
+}
+
+// newFakePostgresConnectionParameters creates connection parameters for
+// a fake server, that don't keep any idle connections, so that every
+// query opens a new connection.
+func newFakePostgresConnectionParameters(server *fakePostgresServer, getCredentials func(ctx context.Context) (authenticators.PasswordCredentials, stackerr.Error)) *PostgresConnectionParameters {
+	maxIdleConns := 0
+	return &PostgresConnectionParameters{
+		DialectorInput: dialectors.PostgresDialectorInput{
+			DialectorInput: dialectors.DialectorInput{
+				MaxIdleConns: &maxIdleConns,
+			},
+			GetPostgresConfigCallback: getFakePostgresConfig,
+		},
+		AuthSettings: &authenticators.ConnectionParametersPassword{
+			Host:           "127.0.0.1",
+			Port:           server.port(),
+			Schema:         "app",
+			GetCredentials: getCredentials,
+		},
+	}
+}
+
+func staticPasswordCredentials(ctx context.Context) (authenticators.PasswordCredentials, stackerr.Error) {
+	return authenticators.PasswordCredentials{
+		Username: "app",
+		Password: "password",
+	}, nil
+}
+
+var quietGormConfig = &gorm.Config{
+	Logger: logger.Discard,
+}
+
+func TestGetPostgresGormWriterReaderSplit(t *testing.T) {
+	writer := newFakePostgresServer(t, "writer")
+	reader := newFakePostgresServer(t, "reader")
+
+	db, err := GetPostgresGorm(context.Background(), GetPostgresGormInput{
+		WriteConnectionParameters: []*PostgresConnectionParameters{newFakePostgresConnectionParameters(writer, staticPasswordCredentials)},
+		ReadConnectionParameters:  []*PostgresConnectionParameters{newFakePostgresConnectionParameters(reader, staticPasswordCredentials)},
+		GormOptions:               []gorm.Option{quietGormConfig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var name string
+	if err := db.Raw("SELECT name FROM servers").Scan(&name).Error; err != nil {
+		t.Fatal(err)
+	}
+	if name != "reader" {
+		t.Errorf("expected the read to be sent to the reader, but it was sent to the %s", name)
+	}
+
+	if err := db.Exec("UPDATE servers SET name = 'updated'").Error; err != nil {
+		t.Fatal(err)
+	}
+	contains := func(queries []string, query string) bool {
+		for _, q := range queries {
+			if q == query {
+				return true
+			}
+		}
+		return false
+	}
+	if !contains(writer.getQueries(), "UPDATE servers SET name = 'updated'") {
+		t.Errorf("expected the write to be sent to the writer, got writer queries %v", writer.getQueries())
+	}
+	if contains(reader.getQueries(), "UPDATE servers SET name = 'updated'") {
+		t.Errorf("expected the write not to be sent to the reader")
+	}
+}
+
+func TestGetPostgresGormRefreshesCredentialsPerConnection(t *testing.T) {
+	server := newFakePostgresServer(t, "writer")
+
+	lock := sync.Mutex{}
+	fetches := 0
+	getCredentials := func(ctx context.Context) (authenticators.PasswordCredentials, stackerr.Error) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		return authenticators.PasswordCredentials{
+			Username: "app",
+			Password: fmt.Sprintf("password-%d", fetches),
+		}, nil
+	}
+
+	db, err := GetPostgresGorm(context.Background(), GetPostgresGormInput{
+		WriteConnectionParameters: []*PostgresConnectionParameters{newFakePostgresConnectionParameters(server, getCredentials)},
+		GormOptions:               []gorm.Option{quietGormConfig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		var name string
+		if err := db.Raw("SELECT name FROM servers").Scan(&name).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each connection should have fetched, and used, new credentials
+	passwords := server.getPasswords()
+	if len(passwords) < 3 {
+		t.Fatalf("expected at least 3 connections, got %d", len(passwords))
+	}
+	for idx, password := range passwords {
+		if expected := fmt.Sprintf("password-%d", idx+1); password != expected {
+			t.Errorf("expected connection %d to use %q, got %q", idx, expected, password)
+		}
+	}
+}
+
+func TestWrapPostgresConfigWithTlsRewritesFallbacks(t *testing.T) {
+	hosts := []string{}
+	getTlsFunc := func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		hosts = append(hosts, host)
+		return &tls.Config{
+			ServerName: host,
+			MinVersion: tls.VersionTLS12,
+		}, nil
+	}
+	source := func(ctx context.Context) (pgx.ConnConfig, []stdlib.OptionOpenDB, stackerr.Error) {
+		// With `sslmode=prefer`, each host has a TLS and a non-TLS fallback
+		config, err := pgx.ParseConfig("host=primary.example.com,replica.example.com,primary.example.com port=5432,5433,5432 sslmode=prefer")
+		if err != nil {
+			return pgx.ConnConfig{}, nil, stackerr.Wrap(err)
+		}
+		return *config, nil, nil
+	}
+
+	original, _, err := source(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, _, err := wrapPostgresConfigWithTls(source, getTlsFunc)(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Host != "primary.example.com" || config.TLSConfig == nil || config.TLSConfig.ServerName != "primary.example.com" {
+		t.Fatalf("expected the primary host to use its own TLS config, got host %s and TLS config %+v", config.Host, config.TLSConfig)
+	}
+	// The non-TLS fallbacks and the duplicate primary host are dropped
+	if len(config.Fallbacks) != 1 {
+		t.Fatalf("expected 1 fallback, got %d", len(config.Fallbacks))
+	}
+	fallback := config.Fallbacks[0]
+	if fallback.Host != "replica.example.com" || fallback.Port != 5433 {
+		t.Errorf("expected the fallback to be replica.example.com:5433, got %s:%d", fallback.Host, fallback.Port)
+	}
+	if fallback.TLSConfig == nil || fallback.TLSConfig.ServerName != "replica.example.com" {
+		t.Errorf("expected the fallback to use the TLS config for its own host, got %+v", fallback.TLSConfig)
+	}
+	if len(hosts) != 2 || hosts[0] != "primary.example.com" || hosts[1] != "replica.example.com" {
+		t.Errorf("expected TLS configs to be loaded once per host, got %v", hosts)
+	}
+
+	// The original config must not have been modified
+	if len(original.Fallbacks) == 0 {
+		t.Fatal("expected the original config to have fallbacks")
+	}
+	for _, f := range original.Fallbacks {
+		if f.TLSConfig != nil && f.TLSConfig.MinVersion == tls.VersionTLS12 {
+			t.Errorf("expected the original fallbacks not to be modified")
+		}
+	}
+}
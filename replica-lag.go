@@ -0,0 +1,331 @@
+package gormauth
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	// The default interval between replica lag samples
+	defaultReplicaLagSampleInterval time.Duration = 5 * time.Second
+)
+
+// A function signature for a callback function that gets the replication lag
+// of a replica, using the replica's connection pool.
+type GetReplicaLagCallback func(ctx context.Context, db *sql.DB) (time.Duration, stackerr.Error)
+
+// GetMysqlReplicaLag gets the replication lag of a MySQL replica, from the
+// `Seconds_Behind_Source` (or `Seconds_Behind_Master`, for older versions)
+// column of `SHOW REPLICA STATUS`. If the replica has multiple replication
+// channels, the largest lag is used. An error is returned if the server
+// isn't a replica, or if replication isn't running. Requires MySQL 8.0.22
+// or later, or MariaDB 10.5.1 or later.
+func GetMysqlReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, stackerr.Error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	lagIdx := -1
+	for idx, column := range columns {
+		if column == "Seconds_Behind_Source" || column == "Seconds_Behind_Master" {
+			lagIdx = idx
+			break
+		}
+	}
+	if lagIdx < 0 {
+		return 0, stackerr.Errorf("replica status did not include the seconds behind the source")
+	}
+
+	var lag time.Duration
+	found := false
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for idx := range values {
+		dest[idx] = &values[idx]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return 0, stackerr.Wrap(err)
+		}
+		// The lag is NULL if replication isn't running
+		if !values[lagIdx].Valid {
+			return 0, stackerr.Errorf("replication is not running")
+		}
+		seconds, err := strconv.ParseInt(values[lagIdx].String, 10, 64)
+		if err != nil {
+			return 0, stackerr.Wrap(err)
+		}
+		if channelLag := time.Duration(seconds) * time.Second; channelLag > lag {
+			lag = channelLag
+		}
+		found = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	if !found {
+		return 0, stackerr.Errorf("the server is not a replica")
+	}
+	return lag, nil
+}
+
+// GetAuroraMysqlReplicaLag gets the replication lag of an Aurora MySQL
+// instance from `information_schema.replica_host_status`. It works with
+// instance endpoints and with the cluster reader endpoint, since the lag
+// of whichever instance is connected to is used. The writer instance
+// always has a lag of zero.
+func GetAuroraMysqlReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, stackerr.Error) {
+	var lagMs sql.NullFloat64
+	err := db.QueryRowContext(ctx, "SELECT replica_lag_in_milliseconds FROM information_schema.replica_host_status WHERE server_id = @@aurora_server_id").Scan(&lagMs)
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	if !lagMs.Valid {
+		return 0, stackerr.Errorf("the replica lag is unknown")
+	}
+	return time.Duration(lagMs.Float64 * float64(time.Millisecond)), nil
+}
+
+// GetPostgresReplicaLag gets the replication lag of a PostgreSQL standby,
+// from the time since the last transaction that was replayed
+// (`pg_last_xact_replay_timestamp`). If the standby is streaming from the
+// primary and has replayed everything that it has received, the lag is zero,
+// so that standbys of an idle primary aren't considered to be lagging. A
+// standby whose WAL receiver isn't streaming (e.g. because it lost its
+// connection to the primary) may not have received recent changes, so the
+// time since the last replayed transaction is always used for it. Users
+// without the privileges of `pg_read_all_stats` can't see the status of the
+// WAL receiver, so for them, any running WAL receiver is treated as streaming.
+// Servers that aren't in recovery (i.e. primaries) always have a lag of zero.
+func GetPostgresReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, stackerr.Error) {
+	var lagSeconds sql.NullFloat64
+	err := db.QueryRowContext(ctx, `SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn()
+			AND EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status IS NULL OR status = 'streaming') THEN 0
+		ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+	END`).Scan(&lagSeconds)
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	// The lag is NULL if the standby hasn't replayed any transactions yet
+	if !lagSeconds.Valid {
+		return 0, stackerr.Errorf("the replica lag is unknown")
+	}
+	return time.Duration(math.Max(lagSeconds.Float64, 0) * float64(time.Second)), nil
+}
+
+// The input values for creating a ReplicaLagPolicy
+type ReplicaLagPolicyInput struct {
+	// A function that gets the replication lag of a replica,
+	// e.g. GetMysqlReplicaLag, GetAuroraMysqlReplicaLag or
+	// GetPostgresReplicaLag
+	GetReplicaLag GetReplicaLagCallback
+	// The maximum replication lag that a replica can have
+	// for reads to be sent to it
+	MaxLag time.Duration
+	// OPTIONAL: How often to sample the lag of each replica.
+	// Defaults to 5 seconds.
+	SampleInterval time.Duration
+	// OPTIONAL: The timeout for sampling the lag of a replica.
+	// Defaults to the sample interval.
+	SampleTimeout time.Duration
+	// OPTIONAL: The policy to use for choosing between the replicas
+	// that aren't lagging. If not provided, the StrictRoundRobin
+	// policy will be used.
+	Policy dbresolver.Policy
+	// OPTIONAL: If true, reads are sent to all replicas when every
+	// replica is lagging, instead of falling back to the writers.
+	DisableWriterFallback bool
+}
+
+type replicaLagSample struct {
+	lag time.Duration
+	err stackerr.Error
+}
+
+// ReplicaLagPolicy is a DBResolver policy that skips replicas that are too far
+// behind the writer. The lag of each replica is sampled in the background,
+// and reads are sent to the replicas whose lag is under the threshold. If the
+// lag of a replica couldn't be sampled, it's treated as lagging. If every
+// replica is lagging, reads fall back to the writers.
+//
+// It must be used as the ReplicaPolicy of GetMysqlGormInput or
+// GetPostgresGormInput, which tells it which connections belong to the
+// replicas and starts the sampling. Until the first samples are taken, every
+// replica is used. A policy should only be used for a single GORM DB handle.
+type ReplicaLagPolicy struct {
+	input  ReplicaLagPolicyInput
+	policy dbresolver.Policy
+
+	lock     sync.RWMutex
+	writers  []gorm.ConnPool
+	replicas map[gorm.ConnPool]*sql.DB
+	samples  map[gorm.ConnPool]replicaLagSample
+	started  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewReplicaLagPolicy creates a new ReplicaLagPolicy.
+func NewReplicaLagPolicy(input ReplicaLagPolicyInput) *ReplicaLagPolicy {
+	if input.GetReplicaLag == nil {
+		panic("the `input.GetReplicaLag` field must not be nil")
+	}
+	if input.SampleInterval <= 0 {
+		input.SampleInterval = defaultReplicaLagSampleInterval
+	}
+	if input.SampleTimeout <= 0 {
+		input.SampleTimeout = input.SampleInterval
+	}
+	policy := input.Policy
+	if policy == nil {
+		policy = dbresolver.StrictRoundRobinPolicy()
+	}
+	return &ReplicaLagPolicy{
+		input:    input,
+		policy:   policy,
+		replicas: map[gorm.ConnPool]*sql.DB{},
+		samples:  map[gorm.ConnPool]replicaLagSample{},
+		stop:     make(chan struct{}),
+	}
+}
+
+func (p *ReplicaLagPolicy) bindEndpoints(writers []*sql.DB, readers []*sql.DB) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.writers = make([]gorm.ConnPool, len(writers))
+	for idx, writer := range writers {
+		p.writers[idx] = writer
+	}
+	p.replicas = make(map[gorm.ConnPool]*sql.DB, len(readers))
+	for _, reader := range readers {
+		p.replicas[reader] = reader
+	}
+	p.samples = map[gorm.ConnPool]replicaLagSample{}
+	if !p.started {
+		p.started = true
+		go p.sampleInBackground()
+	}
+
+	// The wrapped policy may need to know about the endpoints too
+	if wrapped, ok := p.policy.(endpointAwarePolicy); ok {
+		wrapped.bindEndpoints(writers, readers)
+	}
+}
+
+func (p *ReplicaLagPolicy) registerCallbacks(db *gorm.DB) error {
+	// The wrapped policy may need to register callbacks
+	if wrapped, ok := p.policy.(callbackPolicy); ok {
+		return wrapped.registerCallbacks(db)
+	}
+	return nil
+}
+
+// Close stops sampling the replica lag.
+func (p *ReplicaLagPolicy) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// Lag gets the most recently sampled lag of a replica's connection
+// pool, along with the error if the lag couldn't be sampled.
+func (p *ReplicaLagPolicy) Lag(replica *sql.DB) (time.Duration, stackerr.Error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	sample, ok := p.samples[replica]
+	if !ok {
+		return 0, stackerr.Errorf("the replica lag has not been sampled")
+	}
+	return sample.lag, sample.err
+}
+
+func (p *ReplicaLagPolicy) sampleInBackground() {
+	ticker := time.NewTicker(p.input.SampleInterval)
+	defer ticker.Stop()
+	for {
+		p.sample()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample samples the lag of every replica concurrently.
+func (p *ReplicaLagPolicy) sample() {
+	p.lock.RLock()
+	replicas := make([]*sql.DB, 0, len(p.replicas))
+	for _, replica := range p.replicas {
+		replicas = append(replicas, replica)
+	}
+	p.lock.RUnlock()
+
+	wg := sync.WaitGroup{}
+	for _, replica := range replicas {
+		wg.Add(1)
+		go func(replica *sql.DB) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), p.input.SampleTimeout)
+			defer cancel()
+			lag, err := p.input.GetReplicaLag(ctx, replica)
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			if _, ok := p.replicas[replica]; ok {
+				p.samples[replica] = replicaLagSample{
+					lag: lag,
+					err: err,
+				}
+			}
+		}(replica)
+	}
+	wg.Wait()
+}
+
+// isLagging returns whether a replica's lag is over the threshold. The
+// lock must be held.
+func (p *ReplicaLagPolicy) isLagging(replica gorm.ConnPool) bool {
+	sample, ok := p.samples[replica]
+	if !ok {
+		return false
+	}
+	return sample.err != nil || sample.lag > p.input.MaxLag
+}
+
+func (p *ReplicaLagPolicy) Resolve(connPools []gorm.ConnPool) gorm.ConnPool {
+	p.lock.RLock()
+	candidates := make([]gorm.ConnPool, 0, len(connPools))
+	for _, connPool := range connPools {
+		// Connections that aren't replicas (e.g. writers, if there are
+		// multiple) are never skipped
+		if _, ok := p.replicas[connPool]; !ok || !p.isLagging(connPool) {
+			candidates = append(candidates, connPool)
+		}
+	}
+	writers := p.writers
+	p.lock.RUnlock()
+
+	if len(candidates) > 0 {
+		return p.policy.Resolve(candidates)
+	}
+	if !p.input.DisableWriterFallback && len(writers) > 0 {
+		return p.policy.Resolve(writers)
+	}
+	return p.policy.Resolve(connPools)
+}
@@ -0,0 +1,374 @@
+package gormauth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"gorm.io/gorm"
+)
+
+// unusedConnector is a connector for connection pools that are
+// only routed to, and never connected to.
+type unusedConnector struct{}
+
+func (c unusedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return nil, stackerr.Errorf("not implemented")
+}
+
+func (c unusedConnector) Driver() driver.Driver {
+	return nil
+}
+
+func newUnusedSqlDb(t *testing.T) *sql.DB {
+	db := sql.OpenDB(unusedConnector{})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func connPools(dbs ...*sql.DB) []gorm.ConnPool {
+	pools := make([]gorm.ConnPool, len(dbs))
+	for idx, db := range dbs {
+		pools[idx] = db
+	}
+	return pools
+}
+
+// fakeReplicaLags returns the configured lag (or error) of each replica,
+// and counts how many times the lag has been sampled.
+type fakeReplicaLags struct {
+	lock    sync.Mutex
+	lags    map[*sql.DB]time.Duration
+	errs    map[*sql.DB]stackerr.Error
+	samples int
+	// OPTIONAL: A channel that each sample waits on before returning
+	release chan struct{}
+}
+
+func newFakeReplicaLags() *fakeReplicaLags {
+	return &fakeReplicaLags{
+		lags: map[*sql.DB]time.Duration{},
+		errs: map[*sql.DB]stackerr.Error{},
+	}
+}
+
+func (f *fakeReplicaLags) set(replica *sql.DB, lag time.Duration, err stackerr.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lags[replica] = lag
+	f.errs[replica] = err
+}
+
+func (f *fakeReplicaLags) getSamples() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.samples
+}
+
+func (f *fakeReplicaLags) getReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, stackerr.Error) {
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return 0, stackerr.Wrap(ctx.Err())
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.samples++
+	return f.lags[db], f.errs[db]
+}
+
+// newTestReplicaLagPolicy creates a policy with a writer and three
+// replicas. Once the initial samples have been taken in the background,
+// the lag is only sampled again when the test asks for it.
+func newTestReplicaLagPolicy(t *testing.T, lags *fakeReplicaLags, input ReplicaLagPolicyInput) (*ReplicaLagPolicy, *sql.DB, []*sql.DB) {
+	writer := newUnusedSqlDb(t)
+	replicas := []*sql.DB{newUnusedSqlDb(t), newUnusedSqlDb(t), newUnusedSqlDb(t)}
+	input.GetReplicaLag = lags.getReplicaLag
+	input.SampleInterval = time.Hour
+	policy := NewReplicaLagPolicy(input)
+	t.Cleanup(policy.Close)
+	policy.bindEndpoints([]*sql.DB{writer}, replicas)
+	return policy, writer, replicas
+}
+
+// waitForSamples waits until the lag of every replica has been sampled.
+func waitForSamples(t *testing.T, policy *ReplicaLagPolicy, replicas []*sql.DB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, replica := range replicas {
+		for {
+			policy.lock.RLock()
+			_, sampled := policy.samples[replica]
+			policy.lock.RUnlock()
+			if sampled {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the replica lag to be sampled")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// resolveAll resolves enough queries to reach every candidate, and
+// counts the number that were sent to each connection pool.
+func resolveAll(policy *ReplicaLagPolicy, replicas []*sql.DB) map[gorm.ConnPool]int {
+	resolved := map[gorm.ConnPool]int{}
+	for i := 0; i < 2*len(replicas); i++ {
+		resolved[policy.Resolve(connPools(replicas...))]++
+	}
+	return resolved
+}
+
+func TestReplicaLagPolicyUsesUnsampledReplicas(t *testing.T) {
+	lags := newFakeReplicaLags()
+	lags.release = make(chan struct{})
+	defer close(lags.release)
+	policy, writer, replicas := newTestReplicaLagPolicy(t, lags, ReplicaLagPolicyInput{
+		MaxLag: time.Second,
+	})
+
+	resolved := resolveAll(policy, replicas)
+	if resolved[writer] != 0 {
+		t.Errorf("expected no reads to be sent to the writer, got %v", resolved)
+	}
+	for _, replica := range replicas {
+		if resolved[replica] == 0 {
+			t.Errorf("expected every replica to be used before its lag was sampled, got %v", resolved)
+		}
+		if _, err := policy.Lag(replica); err == nil {
+			t.Error("expected an error for a replica whose lag hasn't been sampled")
+		}
+	}
+}
+
+func TestReplicaLagPolicySkipsLaggingReplicas(t *testing.T) {
+	lags := newFakeReplicaLags()
+	policy, writer, replicas := newTestReplicaLagPolicy(t, lags, ReplicaLagPolicyInput{
+		MaxLag: time.Second,
+	})
+	waitForSamples(t, policy, replicas)
+	healthy, lagging, failing := replicas[0], replicas[1], replicas[2]
+	lags.set(healthy, time.Second, nil)
+	lags.set(lagging, 2*time.Second, nil)
+	lags.set(failing, 0, stackerr.Errorf("replication is not running"))
+	policy.sample()
+
+	if lag, err := policy.Lag(lagging); err != nil || lag != 2*time.Second {
+		t.Errorf("expected the sampled lag to be reported, got %s (%v)", lag, err)
+	}
+	if _, err := policy.Lag(failing); err == nil {
+		t.Error("expected the sampling error to be reported")
+	}
+	if resolved := resolveAll(policy, replicas); resolved[healthy] != 2*len(replicas) {
+		t.Errorf("expected only the replica within the maximum lag to be used, got %v", resolved)
+	}
+
+	// Once it catches up, the replica is used again
+	lags.set(lagging, 0, nil)
+	policy.sample()
+	if resolved := resolveAll(policy, replicas); resolved[healthy] == 0 || resolved[lagging] == 0 || resolved[failing] != 0 || resolved[writer] != 0 {
+		t.Errorf("expected the replica that caught up to be used again, got %v", resolved)
+	}
+}
+
+func TestReplicaLagPolicyFallsBackToTheWriter(t *testing.T) {
+	for _, disableWriterFallback := range []bool{false, true} {
+		lags := newFakeReplicaLags()
+		policy, writer, replicas := newTestReplicaLagPolicy(t, lags, ReplicaLagPolicyInput{
+			MaxLag:                time.Second,
+			DisableWriterFallback: disableWriterFallback,
+		})
+		waitForSamples(t, policy, replicas)
+		for _, replica := range replicas {
+			lags.set(replica, time.Minute, nil)
+		}
+		policy.sample()
+
+		resolved := resolveAll(policy, replicas)
+		if !disableWriterFallback && resolved[writer] != 2*len(replicas) {
+			t.Errorf("expected reads to fall back to the writer when every replica is lagging, got %v", resolved)
+		}
+		if disableWriterFallback {
+			if resolved[writer] != 0 {
+				t.Errorf("expected reads not to fall back to the writer when the fallback is disabled, got %v", resolved)
+			}
+			for _, replica := range replicas {
+				if resolved[replica] == 0 {
+					t.Errorf("expected reads to be sent to every replica when the fallback is disabled, got %v", resolved)
+				}
+			}
+		}
+	}
+}
+
+func TestReplicaLagPolicyNeverSkipsNonReplicas(t *testing.T) {
+	lags := newFakeReplicaLags()
+	policy, _, replicas := newTestReplicaLagPolicy(t, lags, ReplicaLagPolicyInput{
+		MaxLag: time.Second,
+	})
+	waitForSamples(t, policy, replicas)
+	for _, replica := range replicas {
+		lags.set(replica, time.Minute, nil)
+	}
+	policy.sample()
+
+	// A second writer that's resolved along with a lagging replica is used
+	otherWriter := newUnusedSqlDb(t)
+	for i := 0; i < 2; i++ {
+		if resolved := policy.Resolve(connPools(replicas[0], otherWriter)); resolved != otherWriter {
+			t.Fatal("expected the connection pool that isn't a replica to be used")
+		}
+	}
+	if lags.getSamples() != 2*len(replicas) {
+		t.Errorf("expected only the replicas to be sampled, got %d samples", lags.getSamples())
+	}
+}
+
+func TestReplicaLagPolicyCloseStopsSampling(t *testing.T) {
+	lags := newFakeReplicaLags()
+	policy := NewReplicaLagPolicy(ReplicaLagPolicyInput{
+		GetReplicaLag:  lags.getReplicaLag,
+		MaxLag:         time.Second,
+		SampleInterval: time.Millisecond,
+	})
+	policy.bindEndpoints([]*sql.DB{newUnusedSqlDb(t)}, []*sql.DB{newUnusedSqlDb(t)})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lags.getSamples() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the replica lag to be sampled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	policy.Close()
+	// Closing it again is harmless
+	policy.Close()
+
+	// Any sample that was already in progress finishes
+	time.Sleep(20 * time.Millisecond)
+	samples := lags.getSamples()
+	time.Sleep(50 * time.Millisecond)
+	if lags.getSamples() != samples {
+		t.Errorf("expected sampling to stop once the policy was closed, got %d more samples", lags.getSamples()-samples)
+	}
+}
+
+// fakeReplicaStatusConnector is a connector for a server whose
+// `SHOW REPLICA STATUS` returns the given rows.
+type fakeReplicaStatusConnector struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+type fakeReplicaStatusConn struct {
+	connector *fakeReplicaStatusConnector
+}
+
+type fakeReplicaStatusRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (c *fakeReplicaStatusConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeReplicaStatusConn{connector: c}, nil
+}
+
+func (c *fakeReplicaStatusConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *fakeReplicaStatusConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, stackerr.Errorf("not implemented")
+}
+
+func (c *fakeReplicaStatusConn) Close() error {
+	return nil
+}
+
+func (c *fakeReplicaStatusConn) Begin() (driver.Tx, error) {
+	return nil, stackerr.Errorf("not implemented")
+}
+
+func (c *fakeReplicaStatusConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query != "SHOW REPLICA STATUS" {
+		return nil, stackerr.Errorf("unexpected query: %s", query)
+	}
+	return &fakeReplicaStatusRows{
+		columns: c.connector.columns,
+		rows:    c.connector.rows,
+	}, nil
+}
+
+func (r *fakeReplicaStatusRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeReplicaStatusRows) Close() error {
+	return nil
+}
+
+func (r *fakeReplicaStatusRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestGetMysqlReplicaLag(t *testing.T) {
+	getLag := func(columns []string, rows ...[]driver.Value) (time.Duration, stackerr.Error) {
+		db := sql.OpenDB(&fakeReplicaStatusConnector{
+			columns: columns,
+			rows:    rows,
+		})
+		defer db.Close()
+		return GetMysqlReplicaLag(context.Background(), db)
+	}
+
+	// The largest lag of all replication channels is used
+	columns := []string{"Replica_IO_State", "Seconds_Behind_Source", "Channel_Name"}
+	lag, err := getLag(columns,
+		[]driver.Value{"Waiting for source to send event", "3", "first"},
+		[]driver.Value{"Waiting for source to send event", "12", "second"},
+		[]driver.Value{"Waiting for source to send event", "0", "third"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag != 12*time.Second {
+		t.Errorf("expected the largest channel lag, got %s", lag)
+	}
+
+	// Older versions use the `Seconds_Behind_Master` column
+	lag, err = getLag([]string{"Slave_IO_State", "Seconds_Behind_Master"}, []driver.Value{"Waiting for master to send event", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag != 5*time.Second {
+		t.Errorf("expected the lag from the older column, got %s", lag)
+	}
+
+	// Any channel that isn't replicating is an error
+	if _, err := getLag(columns,
+		[]driver.Value{"Waiting for source to send event", "3", "first"},
+		[]driver.Value{"", nil, "second"},
+	); err == nil {
+		t.Error("expected an error when replication isn't running")
+	}
+	if _, err := getLag(columns); err == nil {
+		t.Error("expected an error when the server isn't a replica")
+	}
+	if _, err := getLag([]string{"Replica_IO_State"}, []driver.Value{""}); err == nil {
+		t.Error("expected an error when the lag column is missing")
+	}
+}
@@ -0,0 +1,57 @@
+package gormauth
+
+import (
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Telemetry settings that are applied to all connectors created by
+// GetMysqlGorm or GetPostgresGorm. Connectors are automatically given
+// the writer or reader role, based on which parameters they came from.
+type TelemetrySettings struct {
+	// OPTIONAL: The OpenTelemetry meter provider to record metrics with.
+	// If not provided, no metrics are recorded.
+	MeterProvider metric.MeterProvider
+	// OPTIONAL: The OpenTelemetry tracer provider to create spans with.
+	// If not provided, no spans are created.
+	TracerProvider trace.TracerProvider
+	// OPTIONAL: The logger to log connector events with (e.g. a
+	// *slog.Logger). If not provided, nothing is logged.
+	Logger connectors.Logger
+}
+
+// connectorOptions gets the connector options for connectors with the given role.
+func (settings TelemetrySettings) connectorOptions(role string) []connectors.ConnectorOption {
+	options := []connectors.ConnectorOption{
+		connectors.WithRole(role),
+	}
+	if settings.MeterProvider != nil {
+		options = append(options, connectors.WithMeterProvider(settings.MeterProvider))
+	}
+	if settings.TracerProvider != nil {
+		options = append(options, connectors.WithTracerProvider(settings.TracerProvider))
+	}
+	if settings.Logger != nil {
+		options = append(options, connectors.WithLogger(settings.Logger))
+	}
+	return options
+}
+
+// getConnectorOptions gets the connector options for connectors
+// with the given role, including the telemetry settings and hooks.
+func getConnectorOptions(settings TelemetrySettings, hooks connectors.Hooks, role string) []connectors.ConnectorOption {
+	return append(settings.connectorOptions(role), connectors.WithHooks(hooks))
+}
+
+// withConnectorOptions returns a copy of the dialector input with the given
+// connector options added, without modifying the original options slice.
+func withConnectorOptions(input dialectors.DialectorInput, options []connectors.ConnectorOption) dialectors.DialectorInput {
+	combined := make([]connectors.ConnectorOption, 0, len(options)+len(input.ConnectorOptions))
+	// Options that were set on the dialector itself take priority
+	combined = append(combined, options...)
+	combined = append(combined, input.ConnectorOptions...)
+	input.ConnectorOptions = combined
+	return input
+}
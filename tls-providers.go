@@ -0,0 +1,112 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// Options for the TLS configs that are created by the generic
+// TLS config providers.
+type TlsConfigOptions struct {
+	// OPTIONAL: The server name to verify the server's certificate
+	// against. If not provided, the host being connected to is used.
+	ServerName string
+	// OPTIONAL: The minimum TLS version to accept (e.g. tls.VersionTLS13).
+	// If not provided, Go's default minimum version for clients is used.
+	MinVersion uint16
+	// OPTIONAL: A function that performs additional verification of the
+	// server's certificate, after the normal verification has succeeded.
+	// See tls.Config.VerifyPeerCertificate.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+// newTlsConfig creates a TLS config that trusts the given root CAs.
+func (options TlsConfigOptions) newTlsConfig(rootCas *x509.CertPool, host string) *tls.Config {
+	serverName := options.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &tls.Config{
+		RootCAs:               rootCas,
+		ServerName:            serverName,
+		MinVersion:            options.MinVersion,
+		VerifyPeerCertificate: options.VerifyPeerCertificate,
+	}
+}
+
+// NewCaFileTlsConfigCallback creates a GetTlsConfigCallback that trusts the
+// CAs in a PEM-encoded file. The file is read each time a TLS config is
+// requested, so a CA file that is replaced on disk is picked up the next
+// time the connector is reconfigured.
+func NewCaFileTlsConfigCallback(caFile string, options TlsConfigOptions) GetTlsConfigCallback {
+	return func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		pemBytes, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		rootCas := x509.NewCertPool()
+		if ok := rootCas.AppendCertsFromPEM(pemBytes); !ok {
+			return nil, stackerr.Errorf("no certificates found in CA file '%s'", caFile)
+		}
+		return options.newTlsConfig(rootCas, host), nil
+	}
+}
+
+// NewCaDirectoryTlsConfigCallback creates a GetTlsConfigCallback that trusts
+// the CAs in all PEM-encoded files in a directory (subdirectories are not
+// searched). Files that don't contain any certificates are ignored, but at
+// least one certificate must be found. The directory is read each time a
+// TLS config is requested.
+func NewCaDirectoryTlsConfigCallback(caDirectory string, options TlsConfigOptions) GetTlsConfigCallback {
+	return func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		entries, err := os.ReadDir(caDirectory)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		rootCas := x509.NewCertPool()
+		found := false
+		for _, entry := range entries {
+			path := filepath.Join(caDirectory, entry.Name())
+			// Stat the path rather than using the entry's type, so
+			// that symlinks (e.g. from c_rehash) are followed
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			pemBytes, err := os.ReadFile(path)
+			if err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+			if rootCas.AppendCertsFromPEM(pemBytes) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, stackerr.Errorf("no certificates found in CA directory '%s'", caDirectory)
+		}
+		return options.newTlsConfig(rootCas, host), nil
+	}
+}
+
+// NewSystemPoolTlsConfigCallback creates a GetTlsConfigCallback that trusts
+// the system's root CAs, along with any additional PEM-encoded CAs that are
+// provided.
+func NewSystemPoolTlsConfigCallback(extraCaPems [][]byte, options TlsConfigOptions) GetTlsConfigCallback {
+	return func(ctx context.Context, host string) (*tls.Config, stackerr.Error) {
+		rootCas, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		for idx, pemBytes := range extraCaPems {
+			if ok := rootCas.AppendCertsFromPEM(pemBytes); !ok {
+				return nil, stackerr.Errorf("no certificates found in additional CA PEM %d", idx)
+			}
+		}
+		return options.newTlsConfig(rootCas, host), nil
+	}
+}
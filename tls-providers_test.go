@@ -0,0 +1,158 @@
+package gormauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// parseTestCertificate parses a PEM-encoded certificate.
+func parseTestCertificate(t *testing.T, certPem []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		t.Fatal("no PEM block found")
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+// expectTrusted checks whether the TLS config returned by the callback
+// trusts each of the certificates.
+func expectTrusted(t *testing.T, callback GetTlsConfigCallback, trusted map[*x509.Certificate]bool) *tls.Config {
+	t.Helper()
+	tlsConfig, err := callback(context.Background(), "db.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for crt, expected := range trusted {
+		_, verifyErr := crt.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs})
+		if (verifyErr == nil) != expected {
+			t.Errorf("expected %s to be trusted: %t, got %v", crt.Subject.CommonName, expected, verifyErr)
+		}
+	}
+	return tlsConfig
+}
+
+func TestCaFileTlsConfigCallback(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	firstPem, _ := newTestCertificate(t, "first CA", true)
+	secondPem, _ := newTestCertificate(t, "second CA", true)
+	writeTestFile(t, caFile, firstPem, time.Now())
+	callback := NewCaFileTlsConfigCallback(caFile, TlsConfigOptions{})
+
+	tlsConfig := expectTrusted(t, callback, map[*x509.Certificate]bool{
+		parseTestCertificate(t, firstPem):  true,
+		parseTestCertificate(t, secondPem): false,
+	})
+	if tlsConfig.ServerName != "db.example.com" {
+		t.Errorf("expected the host to be used as the server name, got %s", tlsConfig.ServerName)
+	}
+
+	// The file is read again for each TLS config
+	writeTestFile(t, caFile, secondPem, time.Now())
+	expectTrusted(t, callback, map[*x509.Certificate]bool{
+		parseTestCertificate(t, firstPem):  false,
+		parseTestCertificate(t, secondPem): true,
+	})
+
+	writeTestFile(t, caFile, []byte("not a certificate"), time.Now())
+	if _, err := callback(context.Background(), "db.example.com"); err == nil {
+		t.Error("expected an error for a file without any certificates")
+	}
+}
+
+func TestCaDirectoryTlsConfigCallback(t *testing.T) {
+	dir := t.TempDir()
+	caDirectory := filepath.Join(dir, "cas")
+	if err := os.Mkdir(caDirectory, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	callback := NewCaDirectoryTlsConfigCallback(caDirectory, TlsConfigOptions{})
+	if _, err := callback(context.Background(), "db.example.com"); err == nil {
+		t.Error("expected an error for an empty directory")
+	}
+
+	firstPem, _ := newTestCertificate(t, "first CA", true)
+	linkedPem, _ := newTestCertificate(t, "linked CA", true)
+	nestedPem, _ := newTestCertificate(t, "nested CA", true)
+	writeTestFile(t, filepath.Join(caDirectory, "first.pem"), firstPem, time.Now())
+	writeTestFile(t, filepath.Join(caDirectory, "README"), []byte("not a certificate"), time.Now())
+	// Symlinked files are followed, as created by c_rehash
+	writeTestFile(t, filepath.Join(dir, "linked.pem"), linkedPem, time.Now())
+	if err := os.Symlink(filepath.Join(dir, "linked.pem"), filepath.Join(caDirectory, "5d2c1a0e.0")); err != nil {
+		t.Fatal(err)
+	}
+	// Subdirectories aren't searched, even through symlinks
+	if err := os.Mkdir(filepath.Join(caDirectory, "nested"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(caDirectory, "nested", "nested.pem"), nestedPem, time.Now())
+	if err := os.Symlink(filepath.Join(caDirectory, "nested"), filepath.Join(caDirectory, "linked-dir")); err != nil {
+		t.Fatal(err)
+	}
+	// Broken symlinks are ignored
+	if err := os.Symlink(filepath.Join(dir, "missing.pem"), filepath.Join(caDirectory, "missing.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTrusted(t, callback, map[*x509.Certificate]bool{
+		parseTestCertificate(t, firstPem):  true,
+		parseTestCertificate(t, linkedPem): true,
+		parseTestCertificate(t, nestedPem): false,
+	})
+}
+
+func TestSystemPoolTlsConfigCallback(t *testing.T) {
+	extraPem, _ := newTestCertificate(t, "extra CA", true)
+	expectTrusted(t, NewSystemPoolTlsConfigCallback([][]byte{extraPem}, TlsConfigOptions{}), map[*x509.Certificate]bool{
+		parseTestCertificate(t, extraPem): true,
+	})
+
+	if _, err := NewSystemPoolTlsConfigCallback([][]byte{extraPem, []byte("not a certificate")}, TlsConfigOptions{})(context.Background(), "db.example.com"); err == nil {
+		t.Error("expected an error for an additional CA without any certificates")
+	}
+}
+
+func TestTlsConfigOptions(t *testing.T) {
+	dir := t.TempDir()
+	caPem, _ := newTestCertificate(t, "CA", true)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, caPem, time.Now())
+	verified := false
+	options := TlsConfigOptions{
+		ServerName: "proxy.example.com",
+		MinVersion: tls.VersionTLS13,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			verified = true
+			return nil
+		},
+	}
+
+	for name, callback := range map[string]GetTlsConfigCallback{
+		"CA file":      NewCaFileTlsConfigCallback(caFile, options),
+		"CA directory": NewCaDirectoryTlsConfigCallback(dir, options),
+		"system pool":  NewSystemPoolTlsConfigCallback(nil, options),
+	} {
+		tlsConfig, err := callback(context.Background(), "db.example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tlsConfig.ServerName != options.ServerName || tlsConfig.MinVersion != options.MinVersion {
+			t.Errorf("%s: expected the options to be used, got %+v", name, tlsConfig)
+		}
+		verified = false
+		if tlsConfig.VerifyPeerCertificate == nil || tlsConfig.VerifyPeerCertificate(nil, nil) != nil || !verified {
+			t.Errorf("%s: expected the additional verification to be used", name)
+		}
+	}
+}
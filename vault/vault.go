@@ -0,0 +1,472 @@
+package gormauthvault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+	"github.com/Invicton-Labs/gorm-auth/authenticators"
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+)
+
+const (
+	// The default mount path of the database secrets engine
+	defaultMount string = "database"
+	// The default maximum lifetime of a connection
+	defaultConnMaxLifetime time.Duration = 10 * time.Minute
+	// The default interval between checks for leases that need renewing
+	defaultRenewCheckInterval time.Duration = 30 * time.Second
+	// The extra margin to leave, beyond the maximum connection lifetime,
+	// before a lease expires
+	leaseExpiryMargin time.Duration = time.Minute
+)
+
+// A lease on a set of dynamic database credentials
+type lease struct {
+	id        string
+	username  string
+	password  string
+	renewable bool
+	// Whether the last renewal was capped by the lease's maximum TTL
+	capped bool
+	// The duration of the lease when it was issued
+	duration time.Duration
+	// When the lease will expire if it isn't renewed
+	expiresAt time.Time
+	// When the lease stopped being used for new connections,
+	// or zero if it's still the current lease
+	retiredAt time.Time
+}
+
+// CredentialsProvider gets dynamic database credentials from the HashiCorp
+// Vault database secrets engine, and renews their leases while connections
+// that use them may still be open.
+//
+// New credentials are requested before a lease reaches its maximum TTL, at
+// which point the provider's version changes so that connectors reconfigure.
+// Connections are retired using ConnMaxLifetime, and leases continue to be
+// renewed for ConnMaxLifetime after they stop being used for new connections.
+type CredentialsProvider struct {
+	// The address of the Vault server (e.g. https://vault.example.com:8200)
+	Address string
+	// The Vault token to authenticate with
+	Token string
+	// OPTIONAL: The Vault namespace to use
+	Namespace string
+	// OPTIONAL: The mount path of the database secrets engine.
+	// Defaults to `database`.
+	Mount string
+	// The name of the role to request credentials for
+	Role string
+	// OPTIONAL: The HTTP client to use. If not provided,
+	// http.DefaultClient is used.
+	HttpClient *http.Client
+	// OPTIONAL: The maximum lifetime of a connection. Defaults to 10 minutes.
+	// New credentials are requested when the current lease can't be renewed
+	// for at least this long, and this is applied to dialectors with
+	// ApplyDialectorSettings. For leases that are too short for this, a
+	// third of the lease duration is used instead.
+	ConnMaxLifetime time.Duration
+	// OPTIONAL: The interval between checks for leases that need renewing.
+	// Defaults to 30 seconds.
+	RenewCheckInterval time.Duration
+	// OPTIONAL: The clock to use for lease timing. If not provided,
+	// the system clock is used.
+	Clock connectors.Clock
+
+	lock    sync.Mutex
+	current *lease
+	retired []*lease
+	// Whether the current lease can no longer be renewed for long enough
+	rotate bool
+	// The request for new credentials that is in progress, if any
+	fetching *leaseFetch
+	stop     chan struct{}
+	stopped  bool
+}
+
+// A request for new credentials, which concurrent callers wait
+// for instead of each requesting their own credentials.
+type leaseFetch struct {
+	done  chan struct{}
+	lease *lease
+	err   stackerr.Error
+}
+
+func (p *CredentialsProvider) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (p *CredentialsProvider) getConnMaxLifetime() time.Duration {
+	if p.ConnMaxLifetime > 0 {
+		return p.ConnMaxLifetime
+	}
+	return defaultConnMaxLifetime
+}
+
+// leaseConnMaxLifetime gets the maximum lifetime of connections that use a
+// lease. It's capped at a third of the lease's duration, so that connections
+// can outlive their lease's rotation threshold even for short leases.
+func (p *CredentialsProvider) leaseConnMaxLifetime(l *lease) time.Duration {
+	connMaxLifetime := p.getConnMaxLifetime()
+	if limit := l.duration / 3; limit > 0 && connMaxLifetime > limit {
+		return limit
+	}
+	return connMaxLifetime
+}
+
+// minimumLeaseRemaining is the minimum duration that a lease must remain
+// valid for to be used for new connections, so that any connection opened
+// with it can live for its full lifetime. It's capped at half of the lease's
+// duration, so that a lease that is shorter than the connection lifetime
+// isn't replaced on every renewal check.
+func (p *CredentialsProvider) minimumLeaseRemaining(l *lease) time.Duration {
+	remaining := p.getConnMaxLifetime() + leaseExpiryMargin
+	if limit := l.duration / 2; limit > 0 && remaining > limit {
+		return limit
+	}
+	return remaining
+}
+
+type vaultErrorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+type vaultLeaseResponse struct {
+	LeaseId       string `json:"lease_id"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+}
+
+// request makes a request to the Vault API.
+func (p *CredentialsProvider) request(ctx context.Context, method string, path string, body any, out any) stackerr.Error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s", strings.TrimRight(p.Address, "/"), path), bodyReader)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	req.Header.Set("X-Vault-Request", "true")
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := p.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errResp vaultErrorResponse
+		_ = json.Unmarshal(respBody, &errResp)
+		return stackerr.Errorf("vault request to %s failed with status %d: %s", path, resp.StatusCode, strings.Join(errResp.Errors, "; "))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// fetchLease requests a new set of credentials, and makes them the current
+// lease. The lock must not be held, so that new connections that can use the
+// current lease aren't blocked by the request.
+func (p *CredentialsProvider) fetchLease(ctx context.Context, inFlight *leaseFetch) {
+	mount := p.Mount
+	if mount == "" {
+		mount = defaultMount
+	}
+	var resp vaultLeaseResponse
+	err := p.request(ctx, http.MethodGet, fmt.Sprintf("%s/creds/%s", strings.Trim(mount, "/"), p.Role), nil, &resp)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	defer close(inFlight.done)
+	p.fetching = nil
+	if err != nil {
+		inFlight.err = err
+		return
+	}
+
+	now := p.now()
+	duration := time.Duration(resp.LeaseDuration) * time.Second
+	if p.current != nil {
+		// Keep renewing the previous lease, since there
+		// may still be open connections that use it
+		p.current.retiredAt = now
+		p.retired = append(p.retired, p.current)
+	}
+	p.current = &lease{
+		id:        resp.LeaseId,
+		username:  resp.Data.Username,
+		password:  resp.Data.Password,
+		renewable: resp.Renewable,
+		duration:  duration,
+		expiresAt: now.Add(duration),
+	}
+	p.rotate = false
+	inFlight.lease = p.current
+
+	// Start renewing leases in the background
+	if p.stop == nil && !p.stopped {
+		p.stop = make(chan struct{})
+		go p.renewLoop(p.stop)
+	}
+}
+
+// currentLease gets a lease that is valid for long enough to be used for a
+// new connection, requesting new credentials if required. If new credentials
+// are already being requested, it waits for them instead of requesting its
+// own. The lock must not be held.
+func (p *CredentialsProvider) currentLease(ctx context.Context) (*lease, stackerr.Error) {
+	p.lock.Lock()
+	current := p.current
+	// After an authentication failure, the lease is only replaced if it's
+	// the one that failed, since another connector may already have
+	// replaced it
+	authFailed := connectors.IsAuthFailureRetry(ctx)
+	if authFailed && current != nil {
+		failedVersion := connectors.FailedCredentialVersion(ctx)
+		authFailed = failedVersion == "" || failedVersion == current.id
+	}
+	if current != nil && !p.rotate && !authFailed && p.now().Before(current.expiresAt) {
+		p.lock.Unlock()
+		return current, nil
+	}
+
+	inFlight := p.fetching
+	if inFlight == nil {
+		inFlight = &leaseFetch{
+			done: make(chan struct{}),
+		}
+		p.fetching = inFlight
+		p.lock.Unlock()
+		p.fetchLease(ctx, inFlight)
+	} else {
+		p.lock.Unlock()
+	}
+
+	select {
+	case <-inFlight.done:
+		return inFlight.lease, inFlight.err
+	case <-ctx.Done():
+		return nil, stackerr.Wrap(ctx.Err())
+	}
+}
+
+// GetCredentials gets the username and password that should be used for
+// the next connection. It can be used as the `GetCredentials` callback
+// for authenticators.ConnectionParametersPassword.
+func (p *CredentialsProvider) GetCredentials(ctx context.Context) (authenticators.PasswordCredentials, stackerr.Error) {
+	current, err := p.currentLease(ctx)
+	if err != nil {
+		return authenticators.PasswordCredentials{}, err
+	}
+	return authenticators.PasswordCredentials{
+		Username: current.username,
+		Password: current.password,
+		Version:  current.id,
+	}, nil
+}
+
+// GetVersion gets the lease ID of the credentials that should be used for
+// the next connection, requesting new credentials if the current lease is
+// close to its maximum TTL. It can be used with connectors.NewVersionChangedStrategy.
+func (p *CredentialsProvider) GetVersion(ctx context.Context) (string, stackerr.Error) {
+	current, err := p.currentLease(ctx)
+	if err != nil {
+		return "", err
+	}
+	return current.id, nil
+}
+
+// ReconfigureStrategy creates a strategy that requests a reconfiguration
+// whenever new credentials have been issued.
+func (p *CredentialsProvider) ReconfigureStrategy() connectors.ReconfigureStrategy {
+	return connectors.NewVersionChangedStrategy(p.GetVersion)
+}
+
+// ApplyDialectorSettings sets the reconfiguration strategy of the dialector
+// input, and ensures that its ConnMaxLifetime is no longer than the provider's,
+// so that connections using old credentials are retired before their leases
+// stop being renewed. Credentials are requested if there is no current lease,
+// so that the ConnMaxLifetime can also be capped below the lease duration.
+func (p *CredentialsProvider) ApplyDialectorSettings(ctx context.Context, dialectorInput dialectors.DialectorInput) (dialectors.DialectorInput, stackerr.Error) {
+	current, err := p.currentLease(ctx)
+	if err != nil {
+		return dialectorInput, err
+	}
+	connMaxLifetime := p.leaseConnMaxLifetime(current)
+	if dialectorInput.ConnMaxLifetime == nil || *dialectorInput.ConnMaxLifetime <= 0 || *dialectorInput.ConnMaxLifetime > connMaxLifetime {
+		dialectorInput.ConnMaxLifetime = &connMaxLifetime
+	}
+	dialectorInput.ReconfigureStrategy = p.ReconfigureStrategy()
+	return dialectorInput, nil
+}
+
+type vaultRenewRequest struct {
+	LeaseId   string `json:"lease_id"`
+	Increment int64  `json:"increment"`
+}
+
+// renewLease renews a single lease. The lock must not be held,
+// so that new connections aren't blocked by the request.
+func (p *CredentialsProvider) renewLease(ctx context.Context, id string, duration time.Duration) (vaultLeaseResponse, stackerr.Error) {
+	var resp vaultLeaseResponse
+	err := p.request(ctx, http.MethodPut, "sys/leases/renew", vaultRenewRequest{
+		LeaseId:   id,
+		Increment: int64(duration / time.Second),
+	}, &resp)
+	return resp, err
+}
+
+type leaseRenewal struct {
+	lease     *lease
+	id        string
+	duration  time.Duration
+	resp      vaultLeaseResponse
+	renewedAt time.Time
+	err       stackerr.Error
+}
+
+// RenewLeases renews any leases that are past the halfway point of their
+// duration, and stops renewing leases that are no longer in use. It is
+// called periodically in the background, but can also be called directly.
+func (p *CredentialsProvider) RenewLeases(ctx context.Context) stackerr.Error {
+	p.lock.Lock()
+	now := p.now()
+
+	// Stop tracking retired leases once every connection that
+	// used them has reached its maximum lifetime
+	retired := make([]*lease, 0, len(p.retired))
+	for _, l := range p.retired {
+		if now.Sub(l.retiredAt) < p.leaseConnMaxLifetime(l) && now.Before(l.expiresAt) {
+			retired = append(retired, l)
+		}
+	}
+	p.retired = retired
+
+	leases := p.retired
+	if p.current != nil {
+		leases = append([]*lease{p.current}, leases...)
+	}
+	renewals := []*leaseRenewal{}
+	for _, l := range leases {
+		if !l.renewable || now.Before(l.expiresAt.Add(-l.duration/2)) {
+			continue
+		}
+		renewals = append(renewals, &leaseRenewal{
+			lease:    l,
+			id:       l.id,
+			duration: l.duration,
+		})
+	}
+	p.lock.Unlock()
+
+	// Renew the leases without holding the lock
+	for _, renewal := range renewals {
+		renewal.resp, renewal.err = p.renewLease(ctx, renewal.id, renewal.duration)
+		renewal.renewedAt = p.now()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var firstErr stackerr.Error
+	for _, renewal := range renewals {
+		l := renewal.lease
+		if renewal.err != nil {
+			if firstErr == nil {
+				firstErr = renewal.err
+			}
+			if l == p.current {
+				// The lease may have been revoked, so get new credentials
+				p.rotate = true
+			}
+			continue
+		}
+		l.expiresAt = renewal.renewedAt.Add(time.Duration(renewal.resp.LeaseDuration) * time.Second)
+		l.renewable = renewal.resp.Renewable
+		// If the lease wasn't extended by the full increment,
+		// it has reached its maximum TTL
+		l.capped = renewal.resp.LeaseDuration < int64(l.duration/time.Second)
+	}
+
+	// If the current lease can't be renewed for long enough (it's
+	// reaching its maximum TTL), new credentials are needed
+	now = p.now()
+	if p.current != nil && (!p.current.renewable || p.current.capped) && p.current.expiresAt.Sub(now) < p.minimumLeaseRemaining(p.current) {
+		p.rotate = true
+	}
+
+	return firstErr
+}
+
+func (p *CredentialsProvider) renewLoop(stop chan struct{}) {
+	interval := p.RenewCheckInterval
+	if interval <= 0 {
+		interval = defaultRenewCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			// Errors are retried on the next tick, and a lease that can't be
+			// renewed causes new credentials to be requested.
+			_ = p.RenewLeases(ctx)
+			cancel()
+		}
+	}
+}
+
+// Close stops renewing leases in the background. Leases are
+// not revoked, and will expire at the end of their duration.
+func (p *CredentialsProvider) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.stopped = true
+}
@@ -0,0 +1,360 @@
+package gormauthvault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Invicton-Labs/gorm-auth/connectors"
+	"github.com/Invicton-Labs/gorm-auth/dialectors"
+)
+
+// fakeVault is a local stand-in for the Vault API, which issues
+// dynamic database credentials and renews their leases.
+type fakeVault struct {
+	lock sync.Mutex
+	// The duration of each new lease, in seconds
+	leaseDuration int64
+	// Whether new leases are renewable
+	renewable bool
+	// The duration that renewals extend leases by, in seconds, or
+	// zero to extend them by the requested increment
+	renewDuration int64
+	// If not nil, renewals wait until this channel is closed
+	blockRenewals chan struct{}
+	// If not nil, requests for new credentials wait until this channel is closed
+	blockLeases chan struct{}
+	// Closed when a renewal request is received
+	renewalReceived chan struct{}
+
+	leases   int
+	renewals []string
+}
+
+func newFakeVault(t *testing.T, leaseDuration time.Duration, renewable bool) (*fakeVault, *CredentialsProvider) {
+	fake := &fakeVault{
+		leaseDuration:   int64(leaseDuration / time.Second),
+		renewable:       renewable,
+		renewalReceived: make(chan struct{}),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	provider := &CredentialsProvider{
+		Address: server.URL,
+		Token:   "token",
+		Role:    "app",
+		Clock:   newFakeClock(),
+	}
+	t.Cleanup(provider.Close)
+	return fake, provider
+}
+
+func (f *fakeVault) getLeases() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.leases
+}
+
+func (f *fakeVault) getRenewals() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.renewals...)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(vaultErrorResponse{Errors: []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/database/creds/app":
+		f.lock.Lock()
+		f.leases++
+		resp := map[string]any{
+			"lease_id":       fmt.Sprintf("database/creds/app/lease-%d", f.leases),
+			"lease_duration": f.leaseDuration,
+			"renewable":      f.renewable,
+			"data": map[string]string{
+				"username": fmt.Sprintf("user-%d", f.leases),
+				"password": fmt.Sprintf("password-%d", f.leases),
+			},
+		}
+		block := f.blockLeases
+		f.lock.Unlock()
+		if block != nil {
+			<-block
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/renew":
+		var req vaultRenewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.lock.Lock()
+		f.renewals = append(f.renewals, req.LeaseId)
+		block := f.blockRenewals
+		duration := req.Increment
+		if f.renewDuration > 0 {
+			duration = f.renewDuration
+		}
+		f.lock.Unlock()
+		select {
+		case <-f.renewalReceived:
+		default:
+			close(f.renewalReceived)
+		}
+		if block != nil {
+			<-block
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"lease_id":       req.LeaseId,
+			"lease_duration": duration,
+			"renewable":      true,
+		})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func advance(provider *CredentialsProvider, d time.Duration) {
+	clock := provider.Clock.(*fakeClock)
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func getVersion(t *testing.T, provider *CredentialsProvider) string {
+	t.Helper()
+	version, err := provider.GetVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func renewLeases(t *testing.T, provider *CredentialsProvider) {
+	t.Helper()
+	if err := provider.RenewLeases(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenewLeasesRenewsAndRetiresLeases(t *testing.T) {
+	fake, provider := newFakeVault(t, time.Hour, true)
+
+	creds, err := provider.GetCredentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Username != "user-1" || creds.Password != "password-1" || creds.Version != "database/creds/app/lease-1" {
+		t.Fatalf("unexpected credentials %+v", creds)
+	}
+
+	// Leases aren't renewed until they're halfway through their duration
+	renewLeases(t, provider)
+	if renewals := fake.getRenewals(); len(renewals) != 0 {
+		t.Fatalf("expected no renewals, got %v", renewals)
+	}
+	advance(provider, 31*time.Minute)
+	renewLeases(t, provider)
+	if renewals := fake.getRenewals(); len(renewals) != 1 || renewals[0] != "database/creds/app/lease-1" {
+		t.Fatalf("expected the lease to be renewed, got %v", renewals)
+	}
+	if version := getVersion(t, provider); version != "database/creds/app/lease-1" {
+		t.Errorf("expected the renewed lease to still be used, got %s", version)
+	}
+
+	// Once the lease reaches its maximum TTL, new credentials are requested
+	fake.lock.Lock()
+	fake.renewDuration = int64((5 * time.Minute) / time.Second)
+	fake.lock.Unlock()
+	advance(provider, 31*time.Minute)
+	renewLeases(t, provider)
+	if version := getVersion(t, provider); version != "database/creds/app/lease-2" {
+		t.Fatalf("expected new credentials once the lease was capped, got %s", version)
+	}
+
+	// The retired lease is still renewed while connections may be using it,
+	// and is no longer tracked once they have reached their maximum lifetime
+	if len(provider.retired) != 1 {
+		t.Fatalf("expected 1 retired lease, got %d", len(provider.retired))
+	}
+	advance(provider, 10*time.Minute)
+	renewLeases(t, provider)
+	if len(provider.retired) != 0 {
+		t.Errorf("expected the retired lease to no longer be tracked, got %d", len(provider.retired))
+	}
+}
+
+func TestShortLeasesAreNotReplacedOnEveryCheck(t *testing.T) {
+	// The lease is shorter than the default connection lifetime
+	fake, provider := newFakeVault(t, 5*time.Minute, false)
+
+	if version := getVersion(t, provider); version != "database/creds/app/lease-1" {
+		t.Fatalf("expected the first lease, got %s", version)
+	}
+	for i := 0; i < 4; i++ {
+		advance(provider, 30*time.Second)
+		renewLeases(t, provider)
+		if version := getVersion(t, provider); version != "database/creds/app/lease-1" {
+			t.Fatalf("expected the lease to be kept until halfway through its duration, got %s after %d checks", version, i+1)
+		}
+	}
+
+	// Halfway through its duration, the lease is replaced
+	advance(provider, 31*time.Second)
+	renewLeases(t, provider)
+	if version := getVersion(t, provider); version != "database/creds/app/lease-2" {
+		t.Fatalf("expected the lease to be replaced, got %s", version)
+	}
+	advance(provider, 30*time.Second)
+	renewLeases(t, provider)
+	if version := getVersion(t, provider); version != "database/creds/app/lease-2" {
+		t.Errorf("expected the new lease not to be replaced on the next check, got %s", version)
+	}
+	if leases := fake.getLeases(); leases != 2 {
+		t.Errorf("expected 2 leases, got %d", leases)
+	}
+}
+
+func TestApplyDialectorSettingsCapsConnMaxLifetime(t *testing.T) {
+	_, provider := newFakeVault(t, 6*time.Minute, false)
+
+	connMaxLifetime := time.Hour
+	dialectorInput, err := provider.ApplyDialectorSettings(context.Background(), dialectors.DialectorInput{
+		ConnMaxLifetime: &connMaxLifetime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dialectorInput.ConnMaxLifetime != 2*time.Minute {
+		t.Errorf("expected the connection lifetime to be capped at a third of the lease duration, got %s", *dialectorInput.ConnMaxLifetime)
+	}
+	if dialectorInput.ReconfigureStrategy == nil {
+		t.Error("expected a reconfigure strategy to be set")
+	}
+
+	_, provider = newFakeVault(t, time.Hour, true)
+	dialectorInput, err = provider.ApplyDialectorSettings(context.Background(), dialectors.DialectorInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dialectorInput.ConnMaxLifetime != defaultConnMaxLifetime {
+		t.Errorf("expected the default connection lifetime, got %s", *dialectorInput.ConnMaxLifetime)
+	}
+}
+
+func TestRenewLeasesDoesNotBlockNewConnections(t *testing.T) {
+	fake, provider := newFakeVault(t, time.Hour, true)
+	fake.blockRenewals = make(chan struct{})
+
+	if version := getVersion(t, provider); version != "database/creds/app/lease-1" {
+		t.Fatalf("expected the first lease, got %s", version)
+	}
+	advance(provider, 31*time.Minute)
+
+	renewed := make(chan error, 1)
+	go func() {
+		renewed <- provider.RenewLeases(context.Background())
+	}()
+	<-fake.renewalReceived
+
+	// Credentials can be retrieved while the renewal is in progress
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := provider.GetCredentials(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("getting credentials was blocked by the lease renewal")
+	}
+
+	close(fake.blockRenewals)
+	if err := <-renewed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentCallersShareNewCredentials(t *testing.T) {
+	fake, provider := newFakeVault(t, time.Hour, true)
+	fake.blockLeases = make(chan struct{})
+
+	versions := make(chan string, 3)
+	for i := 0; i < cap(versions); i++ {
+		go func() {
+			creds, err := provider.GetCredentials(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			versions <- creds.Version
+		}()
+	}
+	for fake.getLeases() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The lock isn't held while the credentials are requested
+	if !provider.lock.TryLock() {
+		t.Fatal("expected the lock not to be held while credentials are requested")
+	}
+	provider.lock.Unlock()
+
+	close(fake.blockLeases)
+	for i := 0; i < cap(versions); i++ {
+		if version := <-versions; version != "database/creds/app/lease-1" {
+			t.Errorf("expected every caller to get the first lease, got %s", version)
+		}
+	}
+	if leases := fake.getLeases(); leases != 1 {
+		t.Errorf("expected 1 lease, got %d", leases)
+	}
+}
+
+func TestAuthFailuresOnlyReplaceTheFailedLease(t *testing.T) {
+	fake, provider := newFakeVault(t, time.Hour, true)
+
+	failed := getVersion(t, provider)
+	retryCtx := connectors.WithAuthFailureRetry(context.Background(), failed)
+	for i := 0; i < 2; i++ {
+		creds, err := provider.GetCredentials(retryCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.Version != "database/creds/app/lease-2" {
+			t.Errorf("expected the failed lease to be replaced once, got %s", creds.Version)
+		}
+	}
+	if leases := fake.getLeases(); leases != 2 {
+		t.Errorf("expected 2 leases, got %d", leases)
+	}
+}